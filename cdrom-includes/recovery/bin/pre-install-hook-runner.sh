@@ -7,25 +7,22 @@ RECO_MNT="/run/recovery"
 
 mount --bind $CDROM_MNT $RECO_MNT
 
-hookdir=$(awk -F ": " '/oem-preinst-hook-dir/{print $2 }' $RECO_MNT/recovery/config.yaml)
-if [ ! -z $hookdir ]; then
-    OEM_PREINST_HOOK_DIR=$RECO_MNT/recovery/factory/$hookdir
-fi
+# Check the recovery type
+for x in $(cat /proc/cmdline); do
+    case ${x} in
+        recoverytype=*)
+            recoverytype=${x#*=}
+        ;;
+        recoveryos=*)
+            recoveryos=${x#*=}
+        ;;
+        recovery=LABEL=*)
+            recoverylabel=${x#*=LABEL=}
+        ;;
+     esac
+done
 
-# The preinstall hook not needed in headless_installer
-if [ -d $OEM_PREINST_HOOK_DIR ]; then
-    echo "[Factory Install Preinstall hook] Run scripts in $OEM_PREINST_HOOK_DIR"
-    export RECOVERYTYPE=$recoverytype
-    export RECOVERYMNT=$RECO_MNT
-    find "$OEM_PREINST_HOOK_DIR" -type f ! -name ".gitkeep" | sort | while read -r filename;
-    do
-        bash "$filename" 2>&1 | (tee -a /var/log/recovery/preinstall_hooks.log &)
-        ret=${PIPESTATUS[0]}
-        if [ $ret -ne 0 ];then
-            echo "Hook return error in $filename , return=$ret" >> /var/log/recovery/preinstall_hooks.err
-        fi
-        echo "\n" >> /var/log/recovery/preinstall_hooks.log
-    done
-fi
+# The hook directory, timeout and failure policy are in config.yaml
+$RECO_MNT/recovery/bin/recovery.bin hook -shell bash pre-install "$recoverytype" "$recoverylabel" "$recoveryos"
 
 umount $RECO_MNT
@@ -76,7 +76,7 @@ chroot_cmd() {
 }
 
 update_grub_menu() {
-    LABEL=$(awk -F ": " '/filesystem-label/{print $2 }' $RECO_MNT/recovery/config.yaml)
+    LABEL=$(awk -F ": " '/^ *filesystem-label:/{print $2 }' $RECO_MNT/recovery/config.yaml)
     if [ ! -n "$LABEL" ]; then
         exit 1
     fi
@@ -208,31 +208,16 @@ for x in $(cat /proc/cmdline); do
         recoveryos=*)
             recoveryos=${x#*=}
         ;;
+        recovery=LABEL=*)
+            recoverylabel=${x#*=LABEL=}
+        ;;
      esac
 done
 
-# execute the hooks
-hookdir=$(awk -F ": " '/oem-postinst-hook-dir/{print $2 }' $RECO_MNT/recovery/config.yaml)
-if [ ! -z $hookdir ]; then
-    OEM_POSTINST_HOOK_DIR=$RECO_MNT/recovery/factory/$hookdir
-fi
-
 # The factory_restore posthook not needed in headless_installer
 if [ ! -z $recoverytype ] && [ $recoverytype != "headless_installer" ]; then
-    if [ -d $OEM_POSTINST_HOOK_DIR ]; then
-        echo "[Factory Restore Posthook] Run scripts in $OEM_POSTINST_HOOK_DIR"
-        export RECOVERYTYPE=$recoverytype
-        export RECOVERYMNT=$RECO_MNT
-        find "$OEM_POSTINST_HOOK_DIR" -type f ! -name ".gitkeep" | sort | while read -r filename;
-        do
-            bash "$filename" 2>&1 | (tee -a /var/log/recovery/postinst_hooks.log &)
-            ret=${PIPESTATUS[0]}
-            if [ $ret -ne 0 ];then
-	            echo "Hook return error in $filename , return=$ret" >> /var/log/recovery/postinst_hooks.err
-            fi
-            echo "\n" >> /var/log/recovery/postinst_hooks.log
-        done
-    fi
+    # The hook directory, timeout and failure policy are in config.yaml
+    $RECO_MNT/recovery/bin/recovery.bin hook -shell bash post-restore "$recoverytype" "$recoverylabel" "$recoveryos"
 fi
 
 move_log_to_rootfs
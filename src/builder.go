@@ -21,7 +21,6 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -31,7 +30,6 @@ import (
 	"regexp"
 	"strings"
 	"syscall"
-	"time"
 
 	uenv "github.com/mvo5/uboot-go/uenv"
 
@@ -40,7 +38,7 @@ import (
 )
 
 const GRUB_MENUENTRY_FACTORY_RESTORE = `
-menuentry "Factory Restore" {
+menuentry "Factory Restore" {###AUTH_CMDS###
 		###OS_GRUB_MENU_CMDS###
         # load recovery system
         echo "[grub.cfg] load factory_restore system"
@@ -96,6 +94,7 @@ func UpdateGrubCfg(recovery_part_label string, grub_cfg string, grub_env string,
 		menuentry = strings.Replace(menuentry, "###RECO_BOOTIMG_PATH###", RECO_BOOTIMG_PATH_UBUNTU_CORE, -1)
 	}
 	menuentry = strings.Replace(menuentry, "###RECO_PARTITION_LABEL###", recovery_part_label, -1)
+	menuentry = strings.Replace(menuentry, "###AUTH_CMDS###", grubAuthCmds(), -1)
 
 	if _, err = f.WriteString(menuentry); err != nil {
 		return err
@@ -201,6 +200,17 @@ func UpdateFstab(parts *Partitions, recoveryos string) error {
 	return nil
 }
 
+// the bind mounts in the chroot of writable, in mount order
+func chrootBindMounts(writableMnt string, sysbootMnt string) [][3]string {
+	return [][3]string{
+		{sysbootMnt, filepath.Join(writableMnt, "boot", Efi_dir), "vfat"},
+		{"/sys", filepath.Join(writableMnt, "sys"), "sysfs"},
+		{"/proc", filepath.Join(writableMnt, "proc"), "proc"},
+		{"/dev", filepath.Join(writableMnt, "dev"), "devtmpfs"},
+		{"/run", filepath.Join(writableMnt, "run"), "tmpfs"},
+	}
+}
+
 func chrootWritablePrepare(writableMnt string, sysbootMnt string) error {
 	var efiMnt = filepath.Join(writableMnt, "boot", Efi_dir)
 	if _, err := os.Stat(efiMnt); os.IsNotExist(err) {
@@ -210,51 +220,31 @@ func chrootWritablePrepare(writableMnt string, sysbootMnt string) error {
 
 	}
 
-	if err := syscall.Mount(sysbootMnt, efiMnt, "vfat", syscall.MS_BIND, ""); err != nil {
-		return err
-	}
-
-	if err := syscall.Mount("/sys", filepath.Join(writableMnt, "sys"), "sysfs", syscall.MS_BIND, ""); err != nil {
-		return err
-	}
-
-	if err := syscall.Mount("/proc", filepath.Join(writableMnt, "proc"), "proc", syscall.MS_BIND, ""); err != nil {
-		return err
-	}
-
-	if err := syscall.Mount("/dev", filepath.Join(writableMnt, "dev"), "devtmpfs", syscall.MS_BIND, ""); err != nil {
-		return err
-	}
-
-	if err := syscall.Mount("/run", filepath.Join(writableMnt, "run"), "tmpfs", syscall.MS_BIND, ""); err != nil {
-		return err
+	binds := chrootBindMounts(writableMnt, sysbootMnt)
+	for i, m := range binds {
+		if err := mounts.Mount(m[0], m[1], m[2], syscall.MS_BIND, ""); err != nil {
+			// undo the mounted ones, nothing is left mounted on failure
+			for j := i - 1; j >= 0; j-- {
+				mounts.Unmount(binds[j][1])
+			}
+			return err
+		}
 	}
 
 	return nil
 }
 
+// chrootUmountBinded unmounts all the bind mounts in reverse order, even if
+// some failed, and returns the first error
 func chrootUmountBinded(writableMnt string) error {
-	if err := syscall.Unmount(filepath.Join(writableMnt, "boot", Efi_dir), 0); err != nil {
-		return err
-	}
-
-	if err := syscall.Unmount(filepath.Join(writableMnt, "sys"), 0); err != nil {
-		return err
-	}
-
-	if err := syscall.Unmount(filepath.Join(writableMnt, "proc"), 0); err != nil {
-		return err
-	}
-
-	if err := syscall.Unmount(filepath.Join(writableMnt, "dev"), 0); err != nil {
-		return err
-	}
-
-	if err := syscall.Unmount(filepath.Join(writableMnt, "run"), 0); err != nil {
-		return err
+	var firstErr error
+	binds := chrootBindMounts(writableMnt, "")
+	for i := len(binds) - 1; i >= 0; i-- {
+		if err := mounts.Unmount(binds[i][1]); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-
-	return nil
+	return firstErr
 }
 
 func GrubInstall(writableMnt string, sysbootMnt string, recoveryos string, displayGrubMenu bool, swapenable bool, swapfile bool, resumeDev string) error {
@@ -371,11 +361,39 @@ func releaseDhcp() error {
 	return cmd.Run()
 }
 
+// easier for function mocking
+var askUser = askUserConfirm
+
+// confirmDecision returns whether the restore is confirmed for the prehook
+// decision, and by whom. The user is asked if the prehook does not decide. The
+// restore password is asked whenever it is set, even if the prehook approves.
+func confirmDecision(decision string, timeout int64) (confirmed bool, confirmBy string) {
+	confirmed, confirmBy = false, "prehook"
+	switch decision {
+	case hooks.ConfirmApprove:
+		confirmed = true
+	case hooks.ConfirmDeny:
+		confirmed = false
+	default:
+		for _, line := range restoreSummary(&parts) {
+			showStatus(line)
+		}
+		answer := askUser(timeout)
+		confirmed = answer == "y" || answer == "Y"
+		confirmBy = "user"
+		if answer == "" {
+			confirmBy = "timeout"
+		}
+	}
+	if confirmed && !checkRestorePassword(timeout) {
+		log.Println(msg(rplib.MSG_PASSWORD_FAILED))
+		confirmed, confirmBy = false, "password"
+	}
+	return confirmed, confirmBy
+}
+
 func ConfirmRecovery(timeout int64, recoveryos string) bool {
 	const (
-		msg1         = "Factory Restore: "
-		msg2         = "Factory Restore will delete all user data, are you sure? [y/N] "
-		msg3         = "(press [y] + [enter] to confirm) "
 		event_start  = "start"
 		event_finish = "finish"
 		curtin_yaml  = "/var/log/installer/subiquity-curtin-install.conf"
@@ -383,75 +401,44 @@ func ConfirmRecovery(timeout int64, recoveryos string) bool {
 
 	usbhid()
 
-	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC_CURTIN {
-		exec.Command("plymouth", "quit").Run()
-		time.Sleep(1 * time.Second)
-	}
+	// the prompt is on plymouth if running, or on the consoles
+	usePlymouth()
 	ioutil.WriteFile("/proc/sys/kernel/printk", []byte("0 0 0 0"), 0644)
 
+	hookRunnerConfig(&hooks.RestoreConfirmPrehook.Runner)
+	hookRunnerConfig(&hooks.RestoreConfirmPosthook.Runner)
+	decision := hooks.ConfirmAsk
 	if configs.Recovery.RestoreConfirmPrehookFile != "" {
 		hooks.RestoreConfirmPrehook.SetPath(HOOKS_DIR + configs.Recovery.RestoreConfirmPrehookFile)
 		if hooks.RestoreConfirmPrehook.IsHookExist() {
-			err := hooks.RestoreConfirmPrehook.Run(RECO_ROOT_DIR, false, "", "")
+			var err error
+			decision, err = hooks.RestoreConfirmPrehook.Decide(RECO_ROOT_DIR)
 			if err != nil {
 				log.Println(err)
 			}
+			log.Println("Confirm prehook decision:", decision)
 		}
 	}
-	log.Println("Wait user confirmation timeout:", timeout, "sec")
-	log.Println("Factory Restore will delete all user data, are you sure? [y/N] ")
 
-	tty, err := os.Open("/dev/tty1")
-	if err != nil {
-		panic(err)
-	}
-
-	// disable input buffering
-	exec.Command("stty", "-F", "/dev/tty1", "cbreak", "min", "1").Run()
-	// do not display entered characters on the screen
-	exec.Command("stty", "-F", "/dev/tty1", "-echo").Run()
-	defer exec.Command("stty", "-F", "/dev/tty1", "echo").Run()
-
-	var b []byte = make([]byte, 1)
-	response := make(chan []byte)
-	go func() {
-		for {
-			tty.Read(b)
-			if string(b) == "y" || string(b) == "Y" || string(b) == "n" || string(b) == "N" {
-				response <- b
-			}
-		}
-	}()
-
-	select {
-	case s := <-response:
-		log.Println("response:", string(s))
-	case <-time.After(time.Second * time.Duration(timeout)):
-		log.Println("Timeout:", timeout, "sec. Reboot system!")
-	}
+	confirmed, confirmBy := confirmDecision(decision, timeout)
 
 	ioutil.WriteFile("/proc/sys/kernel/printk", []byte("4 4 1 7"), 0644)
 	if configs.Recovery.RestoreConfirmPosthookFile != "" {
 		hooks.RestoreConfirmPosthook.SetPath(HOOKS_DIR + configs.Recovery.RestoreConfirmPosthookFile)
 	}
 
-	if "y" != string(b) && "Y" != string(b) {
-		if hooks.RestoreConfirmPosthook.IsHookExist() {
-			err := hooks.RestoreConfirmPosthook.Run(RECO_ROOT_DIR, true, "USERCONFIRM", "no")
-			if err != nil {
-				log.Println(err)
-			}
-		}
-		return false
+	userConfirm := "no"
+	if confirmed {
+		userConfirm = "yes"
 	}
-
 	if hooks.RestoreConfirmPosthook.IsHookExist() {
-		err := hooks.RestoreConfirmPosthook.Run(RECO_ROOT_DIR, true, "USERCONFIRM", "yes")
+		hooks.RestoreConfirmPosthook.Runner.Env = append(hooks.RestoreConfirmPosthook.Runner.Env, fmt.Sprintf("%s=%s", hooks.EnvConfirmBy, confirmBy))
+		err := hooks.RestoreConfirmPosthook.Run(RECO_ROOT_DIR, true, "USERCONFIRM", userConfirm)
 		if err != nil {
 			log.Println(err)
 		}
 	}
-	return true
+	return confirmed
 }
 
 func BackupAssertions(parts *Partitions) error {
@@ -464,11 +451,11 @@ func BackupAssertions(parts *Partitions) error {
 	if err != nil {
 		return err
 	}
-	err = syscall.Mount(fmtPartPath(parts.TargetDevPath, parts.Writable_nr), WRITABLE_MNT_DIR, "ext4", 0, "")
+	err = mounts.Mount(fmtPartPath(parts.TargetDevPath, parts.Writable_nr), WRITABLE_MNT_DIR, "ext4", 0, "")
 	if err != nil {
 		return err
 	}
-	defer syscall.Unmount(WRITABLE_MNT_DIR, 0)
+	defer mounts.Unmount(WRITABLE_MNT_DIR)
 
 	// back up assertion if ever signed
 	if _, err := os.Stat(filepath.Join(WRITABLE_MNT_DIR, ASSERTION_DIR)); err == nil {
@@ -500,6 +487,29 @@ func RestoreAsserions() error {
 	return nil
 }
 
+// The log file in writable, and the early log which is flushed to it
+var logFile *os.File
+var earlyLog *rplib.EarlyLog
+
+// setLogSinks sets the log sinks to logSinks and extra, and the early log if
+// it is not flushed to the log file yet
+func setLogSinks(extra ...rplib.LogSink) {
+	sinks := append(append([]rplib.LogSink{}, logSinks...), extra...)
+	if earlyLog != nil {
+		sinks = append(sinks, earlyLog)
+	}
+	rplib.DefaultLogger.SetSinks(sinks...)
+}
+
+// recoveryLogPath returns the log path of recovery.bin in writable
+func recoveryLogPath(recoveryos string) string {
+	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CORE {
+		return CORE_LOG_PATH
+	}
+	return CLASSIC_LOG_PATH
+}
+
+// EnableLogger writes the log in logPath, starting with the early log
 func EnableLogger(logPath string) error {
 	if _, err := os.Stat(path.Dir(logPath)); err != nil {
 		err = os.MkdirAll(path.Dir(logPath), 0755)
@@ -512,11 +522,33 @@ func EnableLogger(logPath string) error {
 		return err
 	}
 
-	f := io.MultiWriter(log_writable, os.Stdout)
-	log.SetOutput(f)
+	// the log file of the previous call is closed once the log is switched
+	if logFile != nil {
+		defer logFile.Close()
+	}
+	logFile = log_writable
+	if earlyLog != nil {
+		// the early log writes to the log file from now on
+		if err := earlyLog.FlushTo(log_writable); err != nil {
+			return err
+		}
+		setLogSinks()
+	} else {
+		setLogSinks(rplib.WriterSink{W: log_writable})
+	}
 	return nil
 }
 
+// DisableLogger closes the log file, before writable is unmounted
+func DisableLogger() {
+	earlyLog = nil
+	setLogSinks()
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+}
+
 func CopySnapsAsserts() error {
 	if _, err := os.Stat(SNAPS_DST_PATH); err != nil {
 		err = os.MkdirAll(SNAPS_DST_PATH, 0755)
@@ -23,7 +23,6 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -83,39 +82,14 @@ func (s *BuilderSuite) TearDownSuite(c *C) {
 }
 
 func (s *BuilderSuite) TestConfirmRecovery(c *C) {
-
-	in, err := ioutil.TempFile("", "")
-	if err != nil {
-		c.Fatal(err)
+	for answer, confirmed := range map[string]bool{"y": true, "Y": true, "n": false, "N": false, "": false} {
+		restore := reco.MockAskUser(func(timeout int64) string {
+			c.Check(timeout, Equals, int64(300))
+			return answer
+		})
+		c.Check(reco.ConfirmRecovery(300, rplib.RECOVERY_OS_UBUNTU_CORE), Equals, confirmed, Commentf("answer %q", answer))
+		restore()
 	}
-	defer in.Close()
-
-	//input 'y'
-	io.WriteString(in, "y\n")
-	in.Seek(0, os.SEEK_SET)
-	ret_bool := reco.ConfirmRecovery(300)
-	c.Check(ret_bool, Equals, true)
-
-	//input 'Y'
-	in.Seek(0, os.SEEK_SET)
-	io.WriteString(in, "Y\n")
-	in.Seek(0, os.SEEK_SET)
-	ret_bool = reco.ConfirmRecovery(300)
-	c.Check(ret_bool, Equals, true)
-
-	//input 'n'
-	in.Seek(0, os.SEEK_SET)
-	io.WriteString(in, "n\n")
-	in.Seek(0, os.SEEK_SET)
-	ret_bool = reco.ConfirmRecovery(300)
-	c.Check(ret_bool, Equals, false)
-
-	//input 'N'
-	in.Seek(0, os.SEEK_SET)
-	io.WriteString(in, "N\n")
-	in.Seek(0, os.SEEK_SET)
-	ret_bool = reco.ConfirmRecovery(300)
-	c.Check(ret_bool, Equals, false)
 }
 
 func (s *BuilderSuite) TestBackupAssertions(c *C) {
@@ -204,13 +178,14 @@ func (s *BuilderSuite) TestEnableLogger(c *C) {
 	//Create testing files
 	wdata := []byte("hello logger\n")
 
-	err := reco.EnableLogger(CORE_LOG_PATH)
+	err := reco.EnableLogger(reco.CORE_LOG_PATH)
 	c.Assert(err, IsNil)
+	defer reco.DisableLogger()
 
 	log.Printf("%s", wdata)
 
 	// Verify
-	rdata, err := ioutil.ReadFile(reco.LOG_PATH)
+	rdata, err := ioutil.ReadFile(reco.CORE_LOG_PATH)
 	c.Assert(err, IsNil)
 	found := strings.Contains(string(rdata), string(wdata))
 	c.Assert(found, Equals, true)
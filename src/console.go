@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+// The directory of console devices, changed in tests
+var devDir = "/dev/"
+
+// Console is an opened VT or serial console
+type Console struct {
+	Name string
+	File *os.File
+}
+
+var consoles []*Console
+
+// openConsoles opens the consoles of config.yaml and kernel cmdline, the
+// missing ones are skipped
+func openConsoles() []*Console {
+	var opened []*Console
+	for _, name := range rplib.ConsoleNames(configs.Recovery.SerialConsole, readKernelCmdline()) {
+		f, err := os.OpenFile(devDir+name, os.O_RDWR|syscall.O_NOCTTY, 0)
+		if err != nil {
+			log.Printf("Console %s not available: %v", name, err)
+			continue
+		}
+		opened = append(opened, &Console{Name: name, File: f})
+	}
+	return opened
+}
+
+func sameDevice(a, b *os.File) bool {
+	ai, err1 := a.Stat()
+	bi, err2 := b.Stat()
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	as, ok1 := ai.Sys().(*syscall.Stat_t)
+	bs, ok2 := bi.Sys().(*syscall.Stat_t)
+	return ok1 && ok2 && as.Rdev == bs.Rdev && ai.Mode()&os.ModeCharDevice != 0
+}
+
+// consoleWriter writes to all the consoles, a console failed to write does
+// not stop the others
+type consoleWriter []*Console
+
+func (w consoleWriter) Write(p []byte) (int, error) {
+	for _, c := range w {
+		c.File.Write(p)
+	}
+	return len(p), nil
+}
+
+// consoleLog returns the writer mirroring the log to the consoles, except the
+// ones which are already stdout or stderr
+func consoleLog() io.Writer {
+	var w consoleWriter
+	for _, c := range consoles {
+		if !sameDevice(c.File, os.Stdout) && !sameDevice(c.File, os.Stderr) {
+			w = append(w, c)
+		}
+	}
+	return w
+}
+
+// The log sinks besides the log file: stderr, the consoles, and the kernel
+// log and journal if available
+var logSinks = []rplib.LogSink{rplib.WriterSink{W: os.Stderr}}
+
+// mirrorLogToConsoles opens the consoles and mirrors the log on them, and
+// the kernel log and journal
+func mirrorLogToConsoles() {
+	consoles = openConsoles()
+	logSinks = []rplib.LogSink{rplib.WriterSink{W: os.Stderr}, rplib.WriterSink{W: consoleLog()}}
+	if kmsg, err := rplib.NewKmsgSink(rplib.KMSG_PATH); err == nil {
+		logSinks = append(logSinks, kmsg)
+	} else {
+		log.Println("The kernel log is not available:", err)
+	}
+	if journal, err := rplib.NewJournalSink(rplib.JOURNAL_SOCKET); err == nil {
+		logSinks = append(logSinks, journal)
+	}
+	setLogSinks()
+}
+
+// consoleKey is a key pressed on console
+type consoleKey struct {
+	console *Console
+	key     byte
+}
+
+// consoleInput reads the keys from all the consoles during one prompt
+type consoleInput struct {
+	keys     chan consoleKey
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stty     map[*Console]string
+	consoles []*Console
+}
+
+// TCFLSH of x86 and arm, missing in syscall of some architectures
+const tcflsh = 0x540B
+
+// startConsoleInput starts reading the keys from all the consoles for a
+// prompt. The keys pressed before are dropped. The caller must stop it when
+// the prompt returns, so the hooks and shells run later get the consoles back.
+func startConsoleInput() *consoleInput {
+	in := &consoleInput{
+		keys: make(chan consoleKey, 64),
+		done: make(chan struct{}),
+		stty: make(map[*Console]string),
+	}
+	for _, c := range consoles {
+		// plymouth reads the keyboard on VT
+		if usePlymouth() && isVT(c.Name) {
+			continue
+		}
+		if saved, err := exec.Command("stty", "-F", devDir+c.Name, "-g").Output(); err == nil {
+			in.stty[c] = strings.TrimSpace(string(saved))
+		}
+		// disable input buffering, and do not display entered characters on the screen
+		exec.Command("stty", "-F", devDir+c.Name, "cbreak", "min", "1", "-echo").Run()
+		// not Fd(), which makes the file blocking and its read not stoppable
+		if rc, err := c.File.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) {
+				syscall.Syscall(syscall.SYS_IOCTL, fd, tcflsh, syscall.TCIFLUSH)
+			})
+		}
+
+		in.consoles = append(in.consoles, c)
+		in.wg.Add(1)
+		go func(c *Console) {
+			defer in.wg.Done()
+			b := make([]byte, 1)
+			for {
+				if _, err := c.File.Read(b); err != nil {
+					return
+				}
+				select {
+				case in.keys <- consoleKey{c, b[0]}:
+				case <-in.done:
+					return
+				}
+			}
+		}(c)
+	}
+	return in
+}
+
+// stop stops reading the consoles, and restores their terminal settings
+func (in *consoleInput) stop() {
+	close(in.done)
+	for _, c := range in.consoles {
+		// wake up the blocked read
+		if err := c.File.SetReadDeadline(time.Now()); err != nil {
+			log.Printf("Console %s input not stopped: %v", c.Name, err)
+		}
+	}
+	in.wg.Wait()
+	for _, c := range in.consoles {
+		c.File.SetReadDeadline(time.Time{})
+		if saved, ok := in.stty[c]; ok {
+			exec.Command("stty", "-F", devDir+c.Name, saved).Run()
+		} else {
+			exec.Command("stty", "-F", devDir+c.Name, "echo").Run()
+		}
+	}
+}
+
+// isVT tells whether the console is a virtual terminal, e.g. tty1
+func isVT(name string) bool {
+	return len(name) > 3 && strings.HasPrefix(name, "tty") && name[3] >= '0' && name[3] <= '9'
+}
+
+// write writes to the console, the plymouth console has no file
+func (c *Console) write(s string) {
+	if c.File != nil {
+		c.File.Write([]byte(s))
+	}
+}
+
+// askUserConfirm prompts on all the consoles, and returns the answer from
+// whichever console responds first, or "" if timeout
+func askUserConfirm(timeout int64) string {
+	in := startConsoleInput()
+	defer in.stop()
+	log.Println("Wait user confirmation timeout:", timeout, "sec")
+	log.Println(msg(rplib.MSG_CONFIRM_TITLE))
+	log.Println(msg(rplib.MSG_CONFIRM_PROMPT))
+	log.Println(msg(rplib.MSG_CONFIRM_HINT))
+	if usePlymouth() {
+		plymouth("display-message", "--text="+msg(rplib.MSG_CONFIRM_PROMPT))
+		stop := plymouthWatchKeys("yYnN", in.keys)
+		defer stop()
+	}
+
+	expired := time.After(time.Second * time.Duration(timeout))
+	for {
+		select {
+		case k := <-in.keys:
+			switch k.key {
+			case 'y', 'Y', 'n', 'N':
+				log.Printf("response from %s: %c", k.console.Name, k.key)
+				return string(k.key)
+			}
+		case <-expired:
+			log.Println(msg(rplib.MSG_CONFIRM_TIMEOUT, "timeout", fmt.Sprint(timeout)))
+			return ""
+		}
+	}
+}
+
+// readPassword prompts on all the consoles, and returns the line entered on
+// whichever console finishes first. It returns false if timeout.
+func readPassword(timeout int64) (string, bool) {
+	in := startConsoleInput()
+	defer in.stop()
+	log.Println(msg(rplib.MSG_PASSWORD_PROMPT))
+	plymouthLines := make(chan string, 1)
+	if usePlymouth() {
+		stop := plymouthAskPassword(msg(rplib.MSG_PASSWORD_PROMPT), plymouthLines)
+		defer stop()
+	}
+
+	lines := make(map[*Console][]byte)
+	expired := time.After(time.Second * time.Duration(timeout))
+	for {
+		select {
+		case line := <-plymouthLines:
+			return line, true
+		case k := <-in.keys:
+			switch k.key {
+			case '\r', '\n':
+				k.console.write("\n")
+				return string(lines[k.console]), true
+			case 0x7f, '\b':
+				if n := len(lines[k.console]); n > 0 {
+					lines[k.console] = lines[k.console][:n-1]
+					k.console.write("\b \b")
+				}
+			default:
+				lines[k.console] = append(lines[k.console], k.key)
+				k.console.write("*")
+			}
+		case <-expired:
+			log.Println(msg(rplib.MSG_CONFIRM_TIMEOUT, "timeout", fmt.Sprint(timeout)))
+			return "", false
+		}
+	}
+}
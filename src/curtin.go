@@ -162,10 +162,12 @@ func envForUbuntuClassicCurtin() error {
 	}
 
 	log.Printf("bind mount the %s to %s", CURTIN_RECO_ROOT_DIR, RECO_ROOT_DIR)
-	if err := syscall.Mount(CURTIN_RECO_ROOT_DIR, RECO_ROOT_DIR, "", syscall.MS_BIND, ""); err != nil {
+	if err := mounts.Mount(CURTIN_RECO_ROOT_DIR, RECO_ROOT_DIR, "", syscall.MS_BIND, ""); err != nil {
 		log.Println("bind mount failed, ", err.Error())
 		return err
 	}
+	// the scripts after recovery.bin run the hooks in it
+	mounts.Keep(RECO_ROOT_DIR)
 
 	return nil
 }
@@ -469,8 +471,8 @@ func writeCloudInitConf(parts *Partitions) error {
 		return err
 	}
 
-	syscall.Unmount(CURTIN_BOOT_MNT, 0)
-	syscall.Unmount(CURTIN_INSTALL_TARGET, 0)
+	mounts.Unmount(CURTIN_BOOT_MNT)
+	mounts.Unmount(CURTIN_INSTALL_TARGET)
 	return nil
 }
 
@@ -8,7 +8,6 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-	"syscall"
 
 	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
 )
@@ -23,10 +22,10 @@ func findSysBootEfi(parts *Partitions) (string, error) {
 		err := os.MkdirAll(SYSBOOT_MNT_DIR, 0755)
 		rplib.Checkerr(err)
 	}
-	if err := syscall.Mount(fmtPartPath(parts.TargetDevPath, parts.Sysboot_nr), SYSBOOT_MNT_DIR, "vfat", 0, ""); err != nil {
+	if err := mounts.Mount(fmtPartPath(parts.TargetDevPath, parts.Sysboot_nr), SYSBOOT_MNT_DIR, "vfat", 0, ""); err != nil {
 		return "", err
 	}
-	defer syscall.Unmount(SYSBOOT_MNT_DIR, 0)
+	defer mounts.Unmount(SYSBOOT_MNT_DIR)
 
 	var efiFile string
 	err := filepath.Walk(SYSBOOT_MNT_DIR, func(path string, f os.FileInfo, er error) error {
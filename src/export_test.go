@@ -0,0 +1,9 @@
+package main
+
+// MockAskUser replaces the user confirmation prompt, and returns the function
+// restoring it
+func MockAskUser(f func(timeout int64) string) (restore func()) {
+	old := askUser
+	askUser = f
+	return func() { askUser = old }
+}
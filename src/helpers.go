@@ -55,8 +55,10 @@ func usbhid() {
 
 	// insert module if not exist
 	cmd := exec.Command("sh", "-c", "lsmod | grep usbhid")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	stdout, stderr := rplib.CommandOutput("lsmod")
+	defer stdout.Close()
+	defer stderr.Close()
+	cmd.Stdout, cmd.Stderr = stdout, stderr
 	err := cmd.Run()
 
 	if err != nil {
@@ -65,8 +67,7 @@ func usbhid() {
 
 	// insert module if not exist
 	cmd = exec.Command("sh", "-c", "lsmod | grep hid_generic")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout, cmd.Stderr = stdout, stderr
 	err = cmd.Run()
 
 	if err != nil {
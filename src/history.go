@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+const (
+	// The append-only history of recoveries on recovery partition
+	RESTORE_HISTORY = RECO_ROOT_DIR + "recovery/restore-history"
+	HISTORY_MNT_DIR = "/tmp/historyMnt/"
+)
+
+// The history is recorded once, the failure after success is not recorded again
+var historyRecorded bool
+
+// recordHistory appends this recovery to the history on recovery partition,
+// result is rplib.HISTORY_SUCCESS, rplib.HISTORY_PARTIAL or rplib.HISTORY_FAILURE
+func recordHistory(result string) {
+	if historyRecorded {
+		return
+	}
+	historyRecorded = true
+
+	image, _ := imageVersion()
+	e := rplib.HistoryEntry{Time: time.Now(), Type: RecoveryType, Result: result, Duration: time.Since(report.Start), Image: image}
+	err := rplib.WithWritable(RECO_ROOT_DIR, func() error {
+		if err := os.MkdirAll(filepath.Dir(RESTORE_HISTORY), 0755); err != nil {
+			return err
+		}
+		return rplib.AppendHistory(RESTORE_HISTORY, e)
+	})
+	if err != nil {
+		log.Println("Record the restore history failed:", err)
+	}
+}
+
+// historyCommand prints the restore history and counters. The recovery
+// partition is mounted read-only by -label if it is not mounted.
+func historyCommand(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	fs.SetOutput(out)
+	file := fs.String("file", RESTORE_HISTORY, "The history file")
+	label := fs.String("label", "", "The filesystem label of recovery partition to read the history from")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	path := *file
+	if *label != "" {
+		device, err := findLabel(*label)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		if err := mountReadOnly(device, HISTORY_MNT_DIR); err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		defer mounts.Unmount(HISTORY_MNT_DIR)
+		path = filepath.Join(HISTORY_MNT_DIR, strings.TrimPrefix(RESTORE_HISTORY, RECO_ROOT_DIR))
+	}
+
+	entries, err := rplib.ReadHistory(path)
+	if os.IsNotExist(err) {
+		fmt.Fprintln(out, "No recovery history")
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	rplib.WriteHistory(out, entries)
+	return 0
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	hooks "github.com/Lyoncore/ubuntu-custom-recovery/src/hooks"
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+// The default hook directories in recovery/factory/
+const (
+	DEFAULT_PREINST_HOOK_DIR   = "factory-restore-prehook"
+	DEFAULT_POSTINST_HOOK_DIR  = "factory-restore-posthook"
+	DEFAULT_PREREBOOT_HOOK_DIR = "factory-install-prehook"
+)
+
+func hookDir(phase string) string {
+	dir := ""
+	switch phase {
+	case hooks.PhasePreInstall:
+		dir = configs.Recovery.OemPreinstHookDir
+		if dir == "" {
+			dir = DEFAULT_PREINST_HOOK_DIR
+		}
+	case hooks.PhasePostPartition:
+		dir = configs.Recovery.OemPostPartitionHookDir
+	case hooks.PhaseInTarget:
+		dir = configs.Recovery.OemInTargetHookDir
+	case hooks.PhasePostRestore:
+		dir = configs.Recovery.OemPostinstHookDir
+		if dir == "" {
+			dir = DEFAULT_POSTINST_HOOK_DIR
+		}
+	case hooks.PhasePreReboot:
+		dir = configs.Recovery.OemPrerebootHookDir
+		if dir == "" {
+			dir = DEFAULT_PREREBOOT_HOOK_DIR
+		}
+	}
+	return dir
+}
+
+// HookPartition is a partition in the hook context
+type HookPartition struct {
+	Label    string `json:"label"`
+	Number   int    `json:"number"`
+	Device   string `json:"device"`
+	UUID     string `json:"uuid,omitempty"`
+	PARTUUID string `json:"partuuid,omitempty"`
+}
+
+// HookContext is written as JSON for the hooks, the path is in
+// $RECOVERY_HOOK_CONTEXT. The config is in the same key names as config.yaml.
+type HookContext struct {
+	Phase         string                `json:"phase"`
+	RecoveryType  string                `json:"recovery-type"`
+	RecoveryOS    string                `json:"recovery-os"`
+	RecoveryLabel string                `json:"recovery-label"`
+	SourceDevice  string                `json:"source-device"`
+	TargetDevice  string                `json:"target-device"`
+	Partitions    []HookPartition       `json:"partitions"`
+	Profile       string                `json:"profile,omitempty"`
+	Config        *rplib.ConfigRecovery `json:"config"`
+	Mounts        map[string]string     `json:"mounts"`
+}
+
+// blkidValue returns the tag of device, or "" if not found
+var blkidValue = func(tag string, device string) string {
+	out, err := exec.Command("blkid", "-s", tag, "-o", "value", device).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+var procMounts = "/proc/self/mounts"
+
+// mountedDirs returns the mount points in procMounts
+func mountedDirs() map[string]bool {
+	dirs := make(map[string]bool)
+	f, err := os.Open(procMounts)
+	if err != nil {
+		return dirs
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 1 {
+			dirs[strings.TrimSuffix(fields[1], "/")] = true
+		}
+	}
+	return dirs
+}
+
+func hookPartitions(parts *Partitions) []HookPartition {
+	var list []HookPartition
+	add := func(label string, devPath string, nr int) {
+		if devPath == "" || nr < 0 {
+			return
+		}
+		dev := fmtPartPath(devPath, nr)
+		list = append(list, HookPartition{
+			Label:    label,
+			Number:   nr,
+			Device:   dev,
+			UUID:     blkidValue("UUID", dev),
+			PARTUUID: blkidValue("PARTUUID", dev),
+		})
+	}
+	add(RecoveryLabel, parts.SourceDevPath, parts.Recovery_nr)
+	add(SysbootLabel, parts.TargetDevPath, parts.Sysboot_nr)
+	add(SwapLabel, parts.TargetDevPath, parts.Swap_nr)
+	add(WritableLabel, parts.TargetDevPath, parts.Writable_nr)
+	return list
+}
+
+// hookContext returns the context of phase, from the partitions found by
+// GetPartitions and the loaded config
+func hookContext(phase string) interface{} {
+	ctx := HookContext{
+		Phase:         phase,
+		RecoveryType:  RecoveryType,
+		RecoveryOS:    RecoveryOS,
+		RecoveryLabel: RecoveryLabel,
+		SourceDevice:  parts.SourceDevPath,
+		TargetDevice:  parts.TargetDevPath,
+		Partitions:    hookPartitions(&parts),
+		Profile:       configs.Profile,
+		Config:        &configs,
+		Mounts:        make(map[string]string),
+	}
+	mounted := mountedDirs()
+	for name, dir := range map[string]string{
+		"recovery":    RECO_ROOT_DIR,
+		"writable":    WRITABLE_MNT_DIR,
+		"system-boot": SYSBOOT_MNT_DIR,
+	} {
+		if mounted[strings.TrimSuffix(dir, "/")] {
+			ctx.Mounts[name] = dir
+		}
+	}
+	return &ctx
+}
+
+// hookRunnerConfig sets the timeout, failure policy, log directory and
+// environment of runner from config.yaml
+func hookRunnerConfig(runner *hooks.Runner) {
+	runner.Timeout = time.Duration(configs.Recovery.HookTimeoutSec) * time.Second
+	runner.Policy = configs.Recovery.HookFailurePolicy
+	runner.LogDir = HOOKS_LOG_DIR
+	runner.Context = hookContext
+	runner.ContextFile = HOOKS_CONTEXT_FILE
+	runner.OnResult = recordHookResult
+	// the hook output is in the recovery.bin log, besides the hook log files
+	runner.Stdout = rplib.DefaultLogger.Writer(rplib.LevelInfo, "hook: ")
+	runner.Env = []string{
+		fmt.Sprintf("%s=%s", hooks.EnvRecoveryType, RecoveryType),
+		fmt.Sprintf("%s=%s", hooks.EnvRecoveryOS, RecoveryOS),
+		fmt.Sprintf("%s=%s", hooks.EnvRecoveryLabel, RecoveryLabel),
+		fmt.Sprintf("%s=%s", hooks.EnvRecoveryMnt, RECO_ROOT_DIR),
+	}
+}
+
+func newHookRunner(phase string) *hooks.Runner {
+	runner := &hooks.Runner{Phase: phase}
+	if dir := hookDir(phase); dir != "" {
+		runner.Path = HOOKS_DIR + dir
+	}
+	hookRunnerConfig(runner)
+	return runner
+}
+
+// RunHooks runs the OEM hooks of phase, it returns error only if the
+// failure policy is abort
+func RunHooks(phase string) error {
+	runner := newHookRunner(phase)
+	if runner.Path == "" {
+		return nil
+	}
+	return runner.Run()
+}
+
+// RunInTargetHooks runs the in-target hooks in the chroot of restored
+// writable, the chroot is torn down even if the hooks fail
+func RunInTargetHooks(recoveryos string) error {
+	runner := newHookRunner(hooks.PhaseInTarget)
+	if runner.Path == "" {
+		return nil
+	}
+	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CORE {
+		log.Println("The in-target hooks are not supported in ubuntu core, skip")
+		return nil
+	}
+	if list, err := runner.Hooks(); err != nil || len(list) == 0 {
+		return err
+	}
+
+	if err := chrootWritablePrepare(WRITABLE_MNT_DIR, SYSBOOT_MNT_DIR); err != nil {
+		return err
+	}
+	defer chrootUmountBinded(WRITABLE_MNT_DIR)
+	runner.Chroot = WRITABLE_MNT_DIR
+	return runner.Run()
+}
+
+// easier for function mocking
+var runHooks = RunHooks
+var runInTargetHooks = RunInTargetHooks
+
+// hookCommand implements `recovery.bin hook [-shell SHELL] <phase> <RECOVERY_TYPE> <RECOVERY_LABEL> <RECOVERY_OS>`
+// for the shell scripts to run the hooks, it returns the exit code.
+func hookCommand(args []string) int {
+	fs := flag.NewFlagSet("hook", flag.ContinueOnError)
+	shell := fs.String("shell", "", "The interpreter of hooks, default is sh")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 4 {
+		fmt.Fprintln(os.Stderr, "Usage: recovery.bin hook [-shell SHELL] <PHASE> <RECOVERY_TYPE> <RECOVERY_LABEL> <RECOVERY_OS>")
+		return 2
+	}
+	phase := fs.Arg(0)
+	switch phase {
+	case hooks.PhasePreInstall, hooks.PhasePostPartition, hooks.PhasePostRestore, hooks.PhasePreReboot:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown hook phase: %s\n", phase)
+		return 2
+	}
+	RecoveryType, RecoveryLabel, RecoveryOS = fs.Arg(1), fs.Arg(2), fs.Arg(3)
+
+	// a bad config does not stop the hooks, the defaults are used then
+	if err := configs.LoadHookConfig(CONFIG_YAML, readKernelCmdline(), os.Environ()); err != nil {
+		log.Println(err)
+	}
+	// for the partitions in hook context, the target may not be partitioned yet
+	if _, err := getPartitions(RecoveryLabel, RecoveryType); err != nil {
+		log.Println(err)
+	}
+	runner := newHookRunner(phase)
+	if runner.Path == "" {
+		return 0
+	}
+	runner.Shell = *shell
+	if err := runner.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,402 @@
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+// The phases of recovery which OEM hooks could run in
+const (
+	PhasePreInstall    = "pre-install"    // before recovery.bin, the recovery partition is mounted
+	PhasePostPartition = "post-partition" // the partitions are created and formatted, not restored yet
+	PhasePostRestore   = "post-restore"   // the system is restored successfully
+	PhaseInTarget      = "in-target"      // in the chroot of restored system, the network is disabled
+	PhasePreReboot     = "pre-reboot"     // before reboot or poweroff, RECOVERY_BIN_RETURN is set
+	PhaseConfirm       = "confirm"        // before and after asking the user to confirm factory restore
+)
+
+var Phases = []string{PhasePreInstall, PhasePostPartition, PhasePostRestore, PhaseInTarget, PhasePreReboot, PhaseConfirm}
+
+// The failure policies when a hook fails or times out
+const (
+	PolicyIgnore     = "ignore"      // log the failure and run the next hook
+	PolicyAbort      = "abort"       // stop running hooks and return the error
+	PolicyDebugShell = "debug-shell" // open a debug shell, then run the next hook
+)
+
+// The environment variables for hooks, besides the environment of recovery.bin:
+//
+//	RECOVERYTYPE           factory_install, factory_restore or headless_installer
+//	RECOVERYOS             ubuntu_core, ubuntu_classic or ubuntu_classic_curtin
+//	RECOVERYLABEL          the filesystem label of recovery partition
+//	RECOVERYMNT            the mount point of recovery partition
+//	RECOVERY_HOOK_PHASE    the phase running
+//	RECOVERY_HOOK_LOG      the log file of this hook
+//	RECOVERY_HOOK_CONTEXT  the JSON context file, see Runner.Context
+const (
+	EnvRecoveryType  = "RECOVERYTYPE"
+	EnvRecoveryOS    = "RECOVERYOS"
+	EnvRecoveryLabel = "RECOVERYLABEL"
+	EnvRecoveryMnt   = "RECOVERYMNT"
+	EnvHookPhase     = "RECOVERY_HOOK_PHASE"
+	EnvHookLog       = "RECOVERY_HOOK_LOG"
+	EnvHookContext   = "RECOVERY_HOOK_CONTEXT"
+)
+
+// Runner runs the hooks of a phase in lexical order
+type Runner struct {
+	Phase   string
+	Path    string        // the hooks directory, or a single hook file
+	Shell   string        // the interpreter of hooks, "sh" if not set
+	Timeout time.Duration // for each hook, no timeout if 0
+	Policy  string        // PolicyIgnore if not set
+	LogDir  string        // the log file of each hook is written in, no log file if not set
+	Env     []string      // the extra environment variables, "NAME=value"
+	Stdout  io.Writer     // os.Stdout if not set
+
+	// Chroot is the root directory of the restored system the hooks run in,
+	// with network disabled. The hooks are copied into it before running.
+	Chroot string
+
+	// Context returns the context of phase, which is written as JSON in
+	// ContextFile before each hook runs. No context file if not set.
+	Context     func(phase string) interface{}
+	ContextFile string
+
+	// OnResult is called after each hook runs if set, e.g. for the recovery report
+	OnResult func(HookResult)
+}
+
+// HookResult is the result of a hook run
+type HookResult struct {
+	Phase       string    `json:"phase"`
+	Hook        string    `json:"hook"`
+	Start       time.Time `json:"start"`
+	DurationSec float64   `json:"duration-sec"`
+	ExitCode    int       `json:"exit-code"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// easier for function mocking
+var debugShell = rplib.Debugshell
+
+func isHookFile(info os.FileInfo) bool {
+	name := info.Name()
+	return info.Mode().IsRegular() && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, "~")
+}
+
+// Hooks returns the hook files in lexical order
+func (r *Runner) Hooks() ([]string, error) {
+	info, err := os.Stat(r.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{r.Path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []string
+	for _, e := range entries {
+		if isHookFile(e) {
+			hooks = append(hooks, filepath.Join(r.Path, e.Name()))
+		}
+	}
+	sort.Strings(hooks)
+	return hooks, nil
+}
+
+// writeContext writes the JSON context file for the hook
+func (r *Runner) writeContext() error {
+	data, err := json.MarshalIndent(r.Context(r.Phase), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.ContextFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.ContextFile, append(data, '\n'), 0644)
+}
+
+func (r *Runner) logPath(i int, hook string) string {
+	if r.LogDir == "" {
+		return ""
+	}
+	return filepath.Join(r.LogDir, fmt.Sprintf("%s-%02d-%s.log", r.Phase, i, filepath.Base(hook)))
+}
+
+// hookOutputDelay is how long the output of a hook is still read after it
+// exits, the processes it started in background may keep the output open
+var hookOutputDelay = 2 * time.Second
+
+// foregroundTerminal tells whether the stdin of recovery.bin is the terminal
+// it is in the foreground of, then the hooks run in the foreground there
+func foregroundTerminal() bool {
+	pgrp, err := tcgetpgrp(0)
+	return err == nil && pgrp == syscall.Getpgrp()
+}
+
+func tcgetpgrp(fd int) (int, error) {
+	var pgrp int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
+
+// tcsetpgrp makes pgrp the foreground process group of the terminal fd, it
+// ignores SIGTTOU meanwhile as recovery.bin may be in background
+func tcsetpgrp(fd int, pgrp int) error {
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	id := int32(pgrp)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&id))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// runHook runs the hook in its own process group, and kills it with its
+// children if timeout. The group is in the foreground of the terminal if
+// recovery.bin is, for the interactive hooks.
+func (r *Runner) runHook(hook string, logPath string) error {
+	shell := r.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+	stdout := r.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+
+	cmd := exec.Command(shell, hook)
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	if r.Chroot != "" {
+		// the shell and hook are in the chroot, the new network namespace
+		// has only the loopback interface
+		path := shell
+		if !filepath.IsAbs(shell) {
+			path = "/bin/" + shell
+		}
+		cmd = &exec.Cmd{Path: path, Args: []string{shell, hook}, Dir: "/"}
+		attr.Chroot = r.Chroot
+		attr.Cloneflags = syscall.CLONE_NEWNET
+	}
+	cmd.Stdin = os.Stdin
+	foreground := foregroundTerminal()
+	if foreground {
+		// Ctty is the fd of the terminal in the hook
+		attr.Foreground = true
+		attr.Ctty = 0
+	}
+	cmd.SysProcAttr = attr
+	cmd.Env = append(os.Environ(), r.Env...)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvHookPhase, r.Phase))
+
+	out := stdout
+	if logPath != "" {
+		if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(logPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvHookLog, logPath))
+		out = io.MultiWriter(stdout, f)
+	}
+
+	if r.Context != nil && r.ContextFile != "" {
+		if err := r.writeContext(); err != nil {
+			return fmt.Errorf("write hook context: %v", err)
+		}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvHookContext, r.ContextFile))
+	}
+
+	// the hook writes to a pipe of *os.File, so cmd.Wait doesn't wait for
+	// the processes it started in background and still holding the pipe
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(out, pr)
+		close(copied)
+	}()
+	defer func() {
+		select {
+		case <-copied:
+		case <-time.After(hookOutputDelay):
+			log.Printf("[%s hooks] The output of %s is still open in background, stop reading it", r.Phase, hook)
+			pr.Close()
+			<-copied
+		}
+		pr.Close()
+	}()
+
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		return err
+	}
+	if foreground {
+		defer func() {
+			if err := tcsetpgrp(0, syscall.Getpgrp()); err != nil {
+				log.Println("Restore the foreground process group:", err)
+			}
+		}()
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	if r.Timeout <= 0 {
+		return <-done
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(r.Timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		select {
+		case <-done:
+		case <-time.After(hookOutputDelay):
+			log.Printf("[%s hooks] %s is not reaped after killed", r.Phase, hook)
+		}
+		return fmt.Errorf("timeout after %v", r.Timeout)
+	}
+}
+
+// runReported runs the hook as runHook, and reports the result to OnResult
+func (r *Runner) runReported(hook string, path string, logPath string) error {
+	start := time.Now()
+	err := r.runHook(path, logPath)
+	if r.OnResult != nil {
+		result := HookResult{Phase: r.Phase, Hook: hook, Start: start, DurationSec: time.Since(start).Seconds()}
+		if err != nil {
+			result.Error = err.Error()
+			result.ExitCode = -1
+			if code, ok := exitCode(err); ok {
+				result.ExitCode = code
+			}
+		}
+		r.OnResult(result)
+	}
+	return err
+}
+
+const resolvConf = "etc/resolv.conf"
+
+// enterChroot copies the hooks into the chroot, and replaces the resolv.conf
+// there since the network is disabled. It returns the paths of hooks in the
+// chroot, and the function to undo the changes.
+func (r *Runner) enterChroot(hooks []string) ([]string, func(), error) {
+	stage, err := ioutil.TempDir(filepath.Join(r.Chroot, "tmp"), "recovery-hooks-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(stage) }
+
+	var staged []string
+	for _, hook := range hooks {
+		data, err := ioutil.ReadFile(hook)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		dst := filepath.Join(stage, filepath.Base(hook))
+		if err := ioutil.WriteFile(dst, data, 0755); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		staged = append(staged, "/"+strings.TrimPrefix(dst, filepath.Clean(r.Chroot)+"/"))
+	}
+
+	// keep the resolv.conf of the target (usually a symlink into /run)
+	// as it was, the hooks see a resolv.conf without nameserver
+	resolv := filepath.Join(r.Chroot, resolvConf)
+	saved := resolv + ".recovery-hooks"
+	if _, err := os.Lstat(resolv); err == nil {
+		if err := os.Rename(resolv, saved); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	} else {
+		saved = ""
+	}
+	if err := ioutil.WriteFile(resolv, []byte("# The network is disabled for the recovery in-target hooks\n"), 0644); err != nil {
+		log.Println(err)
+	}
+
+	return staged, func() {
+		os.Remove(resolv)
+		if saved != "" {
+			if err := os.Rename(saved, resolv); err != nil {
+				log.Println(err)
+			}
+		}
+		cleanup()
+	}, nil
+}
+
+// Run runs all the hooks, the failure is handled by the policy.
+// It returns the first error if the policy is abort.
+func (r *Runner) Run() error {
+	hooks, err := r.Hooks()
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	log.Printf("[%s hooks] Run scripts in %s", r.Phase, r.Path)
+	paths := hooks
+	if r.Chroot != "" {
+		var leave func()
+		if paths, leave, err = r.enterChroot(hooks); err != nil {
+			return fmt.Errorf("%s hooks: prepare chroot %s: %v", r.Phase, r.Chroot, err)
+		}
+		defer leave()
+	}
+	for i, hook := range hooks {
+		start := time.Now()
+		err := r.runReported(hook, paths[i], r.logPath(i, hook))
+		if err == nil {
+			log.Printf("[%s hooks] %s finished in %v", r.Phase, hook, time.Since(start))
+			continue
+		}
+
+		err = fmt.Errorf("%s hook %s failed: %v", r.Phase, hook, err)
+		log.Println(err)
+		switch r.Policy {
+		case PolicyAbort:
+			return err
+		case PolicyDebugShell:
+			debugShell()
+		}
+	}
+	return nil
+}
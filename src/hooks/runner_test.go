@@ -0,0 +1,271 @@
+package hooks_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	hooks "github.com/Lyoncore/ubuntu-custom-recovery/src/hooks"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type RunnerSuite struct{}
+
+var _ = Suite(&RunnerSuite{})
+
+func writeHooks(c *C, dir string, hooks map[string]string) {
+	for name, content := range hooks {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0755), IsNil)
+	}
+}
+
+func (s *RunnerSuite) TestHooksOrder(c *C) {
+	dir := c.MkDir()
+	writeHooks(c, dir, map[string]string{
+		"20-second": "",
+		"10-first":  "",
+		".gitkeep":  "",
+		"30-old~":   "",
+	})
+	c.Assert(os.Mkdir(filepath.Join(dir, "40-dir"), 0755), IsNil)
+
+	r := hooks.Runner{Path: dir}
+	found, err := r.Hooks()
+	c.Assert(err, IsNil)
+	c.Check(found, DeepEquals, []string{filepath.Join(dir, "10-first"), filepath.Join(dir, "20-second")})
+
+	r.Path = filepath.Join(dir, "not-exist")
+	found, err = r.Hooks()
+	c.Assert(err, IsNil)
+	c.Check(found, HasLen, 0)
+}
+
+func (s *RunnerSuite) TestRunLogAndEnv(c *C) {
+	dir := c.MkDir()
+	logDir := c.MkDir()
+	writeHooks(c, dir, map[string]string{
+		"10-env":  "echo $RECOVERYTYPE $RECOVERY_HOOK_PHASE\n",
+		"20-echo": "echo second\n",
+	})
+
+	var out bytes.Buffer
+	r := hooks.Runner{
+		Phase:  hooks.PhasePostRestore,
+		Path:   dir,
+		LogDir: logDir,
+		Env:    []string{"RECOVERYTYPE=factory_restore"},
+		Stdout: &out,
+	}
+	c.Assert(r.Run(), IsNil)
+	c.Check(out.String(), Equals, "factory_restore post-restore\nsecond\n")
+
+	data, err := ioutil.ReadFile(filepath.Join(logDir, "post-restore-00-10-env.log"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "factory_restore post-restore\n")
+	data, err = ioutil.ReadFile(filepath.Join(logDir, "post-restore-01-20-echo.log"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "second\n")
+}
+
+func (s *RunnerSuite) TestRunContext(c *C) {
+	dir := c.MkDir()
+	ctxFile := filepath.Join(c.MkDir(), "hooks", "context.json")
+	writeHooks(c, dir, map[string]string{"10-cat": "cat $RECOVERY_HOOK_CONTEXT\n"})
+
+	var out bytes.Buffer
+	r := hooks.Runner{
+		Phase:       hooks.PhasePostPartition,
+		Path:        dir,
+		Stdout:      &out,
+		ContextFile: ctxFile,
+		Context: func(phase string) interface{} {
+			return map[string]string{"phase": phase}
+		},
+	}
+	c.Assert(r.Run(), IsNil)
+	c.Check(out.String(), Equals, "{\n  \"phase\": \"post-partition\"\n}\n")
+}
+
+func (s *RunnerSuite) TestRunPolicy(c *C) {
+	dir := c.MkDir()
+	writeHooks(c, dir, map[string]string{
+		"10-fail": "exit 3\n",
+		"20-echo": "echo second\n",
+	})
+
+	var out bytes.Buffer
+	r := hooks.Runner{Phase: hooks.PhasePreInstall, Path: dir, Stdout: &out}
+	c.Check(r.Run(), IsNil)
+	c.Check(out.String(), Equals, "second\n")
+
+	out.Reset()
+	r.Policy = hooks.PolicyAbort
+	err := r.Run()
+	c.Assert(err, NotNil)
+	c.Check(strings.Contains(err.Error(), "10-fail"), Equals, true)
+	c.Check(out.String(), Equals, "")
+}
+
+func (s *RunnerSuite) TestRunResult(c *C) {
+	dir := c.MkDir()
+	writeHooks(c, dir, map[string]string{
+		"10-fail": "exit 3\n",
+		"20-echo": "echo second\n",
+	})
+
+	var results []hooks.HookResult
+	r := hooks.Runner{
+		Phase:    hooks.PhasePostRestore,
+		Path:     dir,
+		Stdout:   &bytes.Buffer{},
+		OnResult: func(result hooks.HookResult) { results = append(results, result) },
+	}
+	c.Assert(r.Run(), IsNil)
+	c.Assert(results, HasLen, 2)
+	c.Check(results[0].Phase, Equals, hooks.PhasePostRestore)
+	c.Check(results[0].Hook, Equals, filepath.Join(dir, "10-fail"))
+	c.Check(results[0].ExitCode, Equals, 3)
+	c.Check(results[0].Error, Not(Equals), "")
+	c.Check(results[1].Hook, Equals, filepath.Join(dir, "20-echo"))
+	c.Check(results[1].ExitCode, Equals, 0)
+	c.Check(results[1].Error, Equals, "")
+}
+
+func (s *RunnerSuite) TestRunTimeout(c *C) {
+	dir := c.MkDir()
+	// the child process is killed with the hook
+	writeHooks(c, dir, map[string]string{"10-sleep": "sleep 10 &\nsleep 10\n"})
+
+	r := hooks.Runner{
+		Phase:   hooks.PhasePreReboot,
+		Path:    dir,
+		Timeout: 100 * time.Millisecond,
+		Policy:  hooks.PolicyAbort,
+		Stdout:  ioutil.Discard,
+	}
+	start := time.Now()
+	err := r.Run()
+	c.Assert(err, NotNil)
+	c.Check(strings.Contains(err.Error(), "timeout"), Equals, true)
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+func (s *RunnerSuite) TestRunBackgroundOutput(c *C) {
+	dir := c.MkDir()
+	// the daemon keeps the output open after the hook exits
+	writeHooks(c, dir, map[string]string{"10-daemon": "echo started\nsleep 10 &\n"})
+
+	var out bytes.Buffer
+	r := hooks.Runner{
+		Phase:  hooks.PhasePostRestore,
+		Path:   dir,
+		LogDir: c.MkDir(),
+		Policy: hooks.PolicyAbort,
+		Stdout: &out,
+	}
+	start := time.Now()
+	c.Assert(r.Run(), IsNil)
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+	c.Check(out.String(), Equals, "started\n")
+}
+
+func (s *RunnerSuite) TestConfirmHookEnv(c *C) {
+	dir := c.MkDir()
+	hook := filepath.Join(dir, "confirm-prehook")
+	out := filepath.Join(dir, "out")
+	writeHooks(c, dir, map[string]string{"confirm-prehook": "echo $RECOVERYMNT $USERCHOICE > " + out + "\n"})
+
+	var h hooks.RestoreComfirmHooks
+	h.SetPath(hook)
+	c.Assert(h.Run("/recovery", true, "USERCHOICE", "yes"), IsNil)
+	data, err := ioutil.ReadFile(out)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "/recovery yes\n")
+}
+
+func (s *RunnerSuite) TestConfirmDecide(c *C) {
+	dir := c.MkDir()
+	hook := filepath.Join(dir, "prehook.sh")
+	for script, expected := range map[string]string{
+		"exit 0":                                 hooks.ConfirmAsk,
+		"exit 10":                                hooks.ConfirmApprove,
+		"exit 11":                                hooks.ConfirmDeny,
+		"echo RECOVERY_CONFIRM=deny":             hooks.ConfirmDeny,
+		"echo RECOVERY_CONFIRM=approve; exit 11": hooks.ConfirmApprove,
+		"echo RECOVERY_CONFIRM=ask; exit 10":     hooks.ConfirmAsk,
+		"echo token checked; exit 10":            hooks.ConfirmApprove,
+		"echo RECOVERY_CONFIRM=maybe":            hooks.ConfirmAsk,
+		"exit 1":                                 hooks.ConfirmAsk,
+	} {
+		writeHooks(c, dir, map[string]string{"prehook.sh": script + "\n"})
+		var h hooks.RestoreComfirmHooks
+		h.SetPath(hook)
+		h.Runner.Stdout = ioutil.Discard
+		decision, _ := h.Decide("/recovery")
+		c.Check(decision, Equals, expected, Commentf(script))
+	}
+
+	// the missing hook is an error, the user is asked
+	var h hooks.RestoreComfirmHooks
+	h.SetPath(filepath.Join(dir, "not-exist"))
+	decision, err := h.Decide("/recovery")
+	c.Check(err, NotNil)
+	c.Check(decision, Equals, hooks.ConfirmAsk)
+}
+
+// minimalRoot makes a root directory with /bin/sh and its libraries
+func minimalRoot(c *C) string {
+	if os.Getuid() != 0 {
+		c.Skip("chroot needs root")
+	}
+	out, err := exec.Command("ldd", "/bin/sh").Output()
+	if err != nil {
+		c.Skip("ldd not found")
+	}
+	root := c.MkDir()
+	files := []string{"/bin/sh"}
+	for _, f := range strings.Fields(string(out)) {
+		if filepath.IsAbs(f) {
+			files = append(files, f)
+		}
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		c.Assert(err, IsNil)
+		dst := filepath.Join(root, f)
+		c.Assert(os.MkdirAll(filepath.Dir(dst), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(dst, data, 0755), IsNil)
+	}
+	c.Assert(os.MkdirAll(filepath.Join(root, "tmp"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(root, "etc"), 0755), IsNil)
+	return root
+}
+
+func (s *RunnerSuite) TestRunChroot(c *C) {
+	root := minimalRoot(c)
+	c.Assert(os.Symlink("../run/systemd/resolve/stub-resolv.conf", filepath.Join(root, "etc/resolv.conf")), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "etc/hostname"), []byte("target\n"), 0644), IsNil)
+
+	dir := c.MkDir()
+	writeHooks(c, dir, map[string]string{"10-target": "read name < /etc/hostname; echo $name; read line < /etc/resolv.conf; echo $line\n"})
+
+	var out bytes.Buffer
+	r := hooks.Runner{Phase: hooks.PhaseInTarget, Path: dir, Chroot: root, Policy: hooks.PolicyAbort, Stdout: &out}
+	c.Assert(r.Run(), IsNil)
+	c.Check(out.String(), Equals, "target\n# The network is disabled for the recovery in-target hooks\n")
+
+	// the resolv.conf is restored and the staged hooks are removed
+	link, err := os.Readlink(filepath.Join(root, "etc/resolv.conf"))
+	c.Assert(err, IsNil)
+	c.Check(link, Equals, "../run/systemd/resolve/stub-resolv.conf")
+	entries, err := ioutil.ReadDir(filepath.Join(root, "tmp"))
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 0)
+}
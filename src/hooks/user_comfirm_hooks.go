@@ -1,10 +1,15 @@
 package hooks
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
+	"syscall"
 )
 
 type hooks interface {
@@ -14,6 +19,8 @@ type hooks interface {
 
 type RestoreComfirmHooks struct {
 	path string
+	// The timeout, log directory and environment of hook
+	Runner Runner
 }
 
 func (RCHook *RestoreComfirmHooks) SetPath(path string) {
@@ -28,22 +35,104 @@ func (RCHook *RestoreComfirmHooks) IsHookExist() bool {
 	}
 }
 
+// Run runs the hook with RECOVERYMNT, and the extra envName=envValue if envValEn
 func (RCHook *RestoreComfirmHooks) Run(recoveryMnt string, envValEn bool, envName string, envValue string) error {
 	log.Println("Run scripts: " + RCHook.path)
-	if RCHook.IsHookExist() {
-		cmd := exec.Command("/bin/bash", RCHook.path)
-		cmd.Env = os.Environ()
-		cmd.Env = append(cmd.Env, fmt.Sprintf("RECOVERYMNT=%s", recoveryMnt))
-		if envValEn {
-			cmd.Env = os.Environ()
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", envName, envValue))
+	if !RCHook.IsHookExist() {
+		return fmt.Errorf("Hook not found: %s\n", RCHook.path)
+	}
+
+	runner := RCHook.Runner
+	runner.Phase = PhaseConfirm
+	runner.Path = RCHook.path
+	runner.Shell = "/bin/bash"
+	runner.Env = append(append([]string{}, runner.Env...), fmt.Sprintf("%s=%s", EnvRecoveryMnt, recoveryMnt))
+	if envValEn {
+		runner.Env = append(runner.Env, fmt.Sprintf("%s=%s", envName, envValue))
+	}
+	return runner.runReported(RCHook.path, RCHook.path, runner.logPath(0, RCHook.path))
+}
+
+// The decisions of confirm prehook. The prehook could decide by the exit code:
+//
+//	0   ask the user by the built-in prompt
+//	10  approve the factory restore without asking
+//	11  deny the factory restore without asking
+//
+// or by printing a line "RECOVERY_CONFIRM=<approve|deny|ask>", which wins over
+// the exit code. The other exit codes are errors, and the user is asked.
+const (
+	ConfirmApprove = "approve"
+	ConfirmDeny    = "deny"
+	ConfirmAsk     = "ask"
+
+	ConfirmExitApprove = 10
+	ConfirmExitDeny    = 11
+	ConfirmStdoutKey   = "RECOVERY_CONFIRM="
+)
+
+// The posthook gets USERCONFIRM=yes|no, and who decided it in
+// RECOVERY_CONFIRM_BY: prehook, user or timeout
+const EnvConfirmBy = "RECOVERY_CONFIRM_BY"
+
+func exitCode(err error) (int, bool) {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus(), true
 		}
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		return err
 	}
-	return fmt.Errorf("Hook not found: %s\n", RCHook.path)
+	return 0, false
+}
+
+// parseDecision returns the last decision printed in out, or "" if none
+func parseDecision(out []byte) (string, error) {
+	decision := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, ConfirmStdoutKey) {
+			continue
+		}
+		switch d := strings.TrimPrefix(line, ConfirmStdoutKey); d {
+		case ConfirmApprove, ConfirmDeny, ConfirmAsk:
+			decision = d
+		default:
+			return "", fmt.Errorf("unknown decision %q", line)
+		}
+	}
+	return decision, nil
+}
+
+// Decide runs the confirm prehook and returns its decision. It returns
+// ConfirmAsk with the error if the hook fails, the user is asked then.
+func (RCHook *RestoreComfirmHooks) Decide(recoveryMnt string) (string, error) {
+	var out bytes.Buffer
+	stdout := RCHook.Runner.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	hook := *RCHook
+	hook.Runner.Stdout = io.MultiWriter(stdout, &out)
+
+	err := hook.Run(recoveryMnt, false, "", "")
+	decision, perr := parseDecision(out.Bytes())
+	if perr != nil {
+		return ConfirmAsk, perr
+	}
+	if decision != "" {
+		return decision, nil
+	}
+
+	if err == nil {
+		return ConfirmAsk, nil
+	}
+	switch code, _ := exitCode(err); code {
+	case ConfirmExitApprove:
+		return ConfirmApprove, nil
+	case ConfirmExitDeny:
+		return ConfirmDeny, nil
+	}
+	return ConfirmAsk, err
 }
 
 var RestoreConfirmPrehook RestoreComfirmHooks
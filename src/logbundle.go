@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+const (
+	OEM_LOG_MNT_DIR    = "/tmp/oemlogMnt/"
+	OEM_LOG_BUNDLE_DIR = "recovery-logs/"
+	EARLY_LOG_COPY     = "/tmp/recovery.bin.early.log"
+)
+
+// logBundle returns the logs of this recovery
+func logBundle() *rplib.LogBundle {
+	bundle := &rplib.LogBundle{
+		Files: map[string]string{
+			"recovery.bin.log":                     recoveryLogPath(RecoveryOS),
+			"hooks":                                HOOKS_LOG_DIR,
+			"hook-context.json":                    HOOKS_CONTEXT_FILE,
+			REPORT_NAME:                            REPORT_TMP_PATH,
+			"config.yaml":                          CONFIG_YAML,
+			"var-log-recovery":                     "/var/log/recovery",
+			"curtin/curtin-recovery-cfg.yaml":      CURTIN_CONF_FILE,
+			"curtin/curtin-error-logs.tar":         "/var/log/curtin/curtin-error-logs.tar",
+			"curtin/subiquity-curtin-install.conf": "/var/log/installer/subiquity-curtin-install.conf",
+		},
+		Commands: map[string][]string{
+			"efibootmgr.txt": {EFIBOOTMGR, "-v"},
+			"dmesg.txt":      {"dmesg"},
+			"lsblk.txt":      {"lsblk", "-o", "NAME,SIZE,FSTYPE,LABEL,UUID,PARTUUID,MOUNTPOINT"},
+			"parted.txt":     {"parted", "-s", "-l"},
+		},
+	}
+	if earlyLog != nil && !earlyLog.Flushed() && writeEarlyLog(EARLY_LOG_COPY) == nil {
+		// writable is not mounted yet
+		bundle.Files["recovery.bin.early.log"] = EARLY_LOG_COPY
+	}
+	if parts.TargetDevPath != "" {
+		bundle.Commands["parted.txt"] = []string{"parted", "-s", parts.TargetDevPath, "unit", "B", "print"}
+	}
+	return bundle
+}
+
+// writeEarlyLog writes the early log not flushed to writable yet in path
+func writeEarlyLog(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return earlyLog.CopyTo(f)
+}
+
+// findLabel returns the device of filesystem label
+var findLabel = func(label string) (string, error) {
+	out, err := exec.Command("findfs", "LABEL="+label).Output()
+	if err != nil {
+		return "", fmt.Errorf("filesystem LABEL=%s not found", label)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// collectLogBundle writes the log bundle to the OEM log partition or USB
+// labeled oem-log-dir in config.yaml, status is success, partial or failure
+func collectLogBundle(status string) {
+	label := configs.Recovery.OemLogDir
+	if label == "" {
+		return
+	}
+	device, err := findLabel(label)
+	if err != nil {
+		log.Println("Skip the log bundle:", err)
+		return
+	}
+	if err := os.MkdirAll(OEM_LOG_MNT_DIR, 0755); err != nil {
+		log.Println(err)
+		return
+	}
+	fstype := blkidValue("TYPE", device)
+	if fstype == "" {
+		log.Printf("Skip the log bundle: unknown filesystem on %s", device)
+		return
+	}
+	if err := mounts.Mount(device, OEM_LOG_MNT_DIR, fstype, 0, ""); err != nil {
+		log.Println("Mount the OEM log media failed:", err)
+		return
+	}
+	defer mounts.Unmount(OEM_LOG_MNT_DIR)
+
+	dir := filepath.Join(OEM_LOG_MNT_DIR, OEM_LOG_BUNDLE_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println(err)
+		return
+	}
+	name := fmt.Sprintf("recovery-%s-%s.tar.gz", time.Now().UTC().Format("20060102-150405"), status)
+	log.Printf("Write the log bundle %s to %s (LABEL=%s)", name, device, label)
+	if err := logBundle().WriteFile(filepath.Join(dir, name)); err != nil {
+		log.Println("Write the log bundle failed:", err)
+	}
+	syscall.Sync()
+}
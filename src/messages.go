@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+// The message catalog files <locale>.yaml on recovery partition
+const MESSAGES_DIR = RECO_ROOT_DIR + "recovery/messages/"
+
+var messages *rplib.MessageCatalog
+
+// recoveryLocale returns the locale= of kernel cmdline, or the locale in config.yaml
+func recoveryLocale() string {
+	for _, arg := range strings.Fields(readKernelCmdline()) {
+		if strings.HasPrefix(arg, "locale=") {
+			return strings.TrimPrefix(arg, "locale=")
+		}
+	}
+	return configs.Recovery.Locale
+}
+
+// loadMessages loads the message catalog of the recovery locale
+func loadMessages() {
+	product := configs.Recovery.ProductName
+	if product == "" {
+		product = rplib.ReadSystemIdentity().ProductName
+	}
+	messages = rplib.LoadMessageCatalog(MESSAGES_DIR, recoveryLocale(), product)
+}
+
+// msg returns the localized message of id, see rplib.MessageCatalog.Get
+func msg(id string, pairs ...string) string {
+	return messages.Get(id, pairs...)
+}
@@ -21,13 +21,15 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
 
+	hooks "github.com/Lyoncore/ubuntu-custom-recovery/src/hooks"
 	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
 )
 
@@ -308,11 +310,11 @@ func CopyRecoveryPart(parts *Partitions) error {
 	if err != nil {
 		return err
 	}
-	err = syscall.Mount(recovery_path, RECO_TAR_MNT_DIR, "vfat", 0, "")
+	err = mounts.Mount(recovery_path, RECO_TAR_MNT_DIR, "vfat", 0, "")
 	if err != nil {
 		return err
 	}
-	defer syscall.Unmount(RECO_TAR_MNT_DIR, 0)
+	defer mounts.Unmount(RECO_TAR_MNT_DIR)
 	rplib.Shellcmd(fmt.Sprintf("cd %s ; cp -a `ls | grep -v NvVars` %s", RECO_ROOT_DIR, RECO_TAR_MNT_DIR))
 	rplib.Shellexec("sync")
 
@@ -328,9 +330,229 @@ func CopyRecoveryPart(parts *Partitions) error {
 	return nil
 }
 
+// easier for function mocking
+var gadgetYamlPath = GADGET_YAML
+
+// loadGadgetVolume loads the boot volume from the gadget.yaml backed up in recovery partition.
+// If there is no gadget.yaml, it returns nil volume and the hard-coded layout would be used.
+func loadGadgetVolume(gadgetYaml string) (*rplib.GadgetVolume, error) {
+	if _, err := os.Stat(gadgetYaml); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var gi rplib.GadgetInfo
+	if err := gi.Load(gadgetYaml); err != nil {
+		return nil, err
+	}
+	_, vol, err := gi.BootVolume()
+	if err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+func partedFsType(filesystem string) string {
+	switch filesystem {
+	case "vfat":
+		return "fat32"
+	case "ext4":
+		return "ext4"
+	}
+	return ""
+}
+
+func mkGadgetPart(st *rplib.LaidOutStructure, schema string, devPath string) {
+	nr := strconv.Itoa(st.PartitionNumber)
+	args := []string{"-a", "none", "-ms", devPath, "--", "mkpart", "primary"}
+	if fsType := partedFsType(st.Filesystem); fsType != "" {
+		args = append(args, fsType)
+	}
+	args = append(args, fmt.Sprintf("%dB", st.StartOffset), fmt.Sprintf("%dB", st.End()-1))
+	if schema == rplib.GadgetSchemaGPT && st.Name != "" {
+		args = append(args, "name", nr, st.Name)
+	}
+	rplib.Shellexec("parted", args...)
+
+	if schema == rplib.GadgetSchemaGPT && st.GPTType() != "" {
+		rplib.Shellexec("sgdisk", devPath, fmt.Sprintf("--typecode=%s:%s", nr, st.GPTType()))
+	} else if schema == rplib.GadgetSchemaMBR && st.MBRType() != "" {
+		rplib.Shellexec("sfdisk", "--part-type", devPath, nr, st.MBRType())
+	}
+	rplib.Shellexec("udevadm", "settle")
+}
+
+func setSysbootPart(parts *Partitions, st *rplib.LaidOutStructure) {
+	parts.Sysboot_nr = st.PartitionNumber
+	parts.Sysboot_start = st.StartOffset / (1024 * 1024)
+	parts.Sysboot_end = st.End() / (1024 * 1024)
+}
+
+// createGadgetParts recreates the partitions after recovery partition as described in gadget.yaml.
+// The partitions before recovery are kept, except the lost system-boot is recreated in place.
+// The system-boot and writable numbers and locations are updated in parts.
+func createGadgetParts(parts *Partitions, vol *rplib.GadgetVolume, layout []rplib.LaidOutStructure, devPath string) error {
+	recovery := rplib.FindStructureByLabel(layout, configs.Recovery.FsLabel)
+	if recovery == nil {
+		return fmt.Errorf("Recovery partition (LABEL=%s) not found in gadget.yaml", configs.Recovery.FsLabel)
+	}
+	if parts.SourceDevPath == parts.TargetDevPath && recovery.PartitionNumber != parts.Recovery_nr {
+		return fmt.Errorf("Recovery partition number %d mismatches gadget.yaml %d", parts.Recovery_nr, recovery.PartitionNumber)
+	}
+
+	schema := vol.EffectiveSchema()
+	lastNr := recovery.PartitionNumber
+	lastEnd := recovery.End()
+	parts.Swap_nr = -1
+	parts.Writable_nr = -1
+	for i := range layout {
+		st := &layout[i]
+		if !st.IsPartition() {
+			continue
+		}
+
+		if st.Index < recovery.Index {
+			if st.EffectiveRole() == rplib.GadgetRoleSystemBoot && parts.Sysboot_nr == -1 {
+				log.Println("The system-boot partition is lost, recreate it from gadget.yaml")
+				mkGadgetPart(st, schema, devPath)
+				setSysbootPart(parts, st)
+			}
+			continue
+		} else if st.Index == recovery.Index {
+			continue
+		}
+		lastNr = st.PartitionNumber
+		lastEnd = st.End()
+
+		if st.EffectiveRole() == rplib.GadgetRoleSystemData || st.Label == WritableLabel {
+			// writable is created as the last partition and enlarged to maximum
+			parts.Writable_nr = st.PartitionNumber
+			parts.Writable_start = st.StartOffset / (1024 * 1024)
+			continue
+		}
+
+		mkGadgetPart(st, schema, devPath)
+
+		if st.EffectiveRole() == rplib.GadgetRoleSystemBoot {
+			// system-boot is formatted and restored later
+			setSysbootPart(parts, st)
+			continue
+		}
+
+		partPath := fmtPartPath(parts.TargetDevPath, st.PartitionNumber)
+		switch st.Filesystem {
+		case "vfat":
+			rplib.Shellexec("mkfs.vfat", "-F", "32", "-n", st.Label, partPath)
+		case "ext4":
+			rplib.Shellexec("mkfs.ext4", "-F", "-L", st.Label, partPath)
+		}
+	}
+
+	if parts.Writable_nr == -1 {
+		parts.Writable_nr = lastNr + 1
+		// round up to MiB for alignment
+		parts.Writable_start = (lastEnd + 1024*1024 - 1) / (1024 * 1024)
+	}
+	return nil
+}
+
+// checkGadgetImages checks the images of raw structures are all in imageDir
+// and fit in their structures. No image is written if imageDir is not found.
+func checkGadgetImages(layout []rplib.LaidOutStructure, imageDir string) error {
+	if _, err := os.Stat(imageDir); os.IsNotExist(err) {
+		return nil
+	}
+	for i := range layout {
+		st := &layout[i]
+		if st.Filesystem != "" {
+			continue
+		}
+		if _, err := st.LayoutContent(layout, imageDir); err != nil {
+			return fmt.Errorf("Raw structure #%d (%q) could not be restored: %v", st.Index, st.Name, err)
+		}
+	}
+	return nil
+}
+
+// writeGadgetImages writes the raw structures (bootloader images, offset-write) of gadget.yaml
+// from the gadget content backed up in recovery partition.
+func writeGadgetImages(devPath string, layout []rplib.LaidOutStructure, imageDir string) error {
+	if _, err := os.Stat(imageDir); os.IsNotExist(err) {
+		log.Printf("The gadget images dir %s not found, skip writing raw structures", imageDir)
+		return nil
+	}
+
+	for i := range layout {
+		st := &layout[i]
+		// The structures with filesystem are restored by their contents
+		if st.Filesystem != "" {
+			continue
+		}
+		if err := rplib.WriteRawContent(devPath, layout, st, imageDir); err != nil {
+			return fmt.Errorf("Write raw structure %q failed: %v", st.Name, err)
+		}
+	}
+	return nil
+}
+
+var applyOverlay = rplib.ApplyOverlay
+
+// applyOverlays applies the overlay payloads in overlayDir onto target in the
+// order of names, or all the payloads in lexical order if names is empty
+func applyOverlays(overlayDir string, names []string, target string) error {
+	if len(names) == 0 {
+		entries, err := ioutil.ReadDir(overlayDir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && rplib.IsOverlayPayload(e.Name()) {
+				names = append(names, e.Name())
+			}
+		}
+	}
+
+	for _, name := range names {
+		if filepath.Base(name) != name || !rplib.IsOverlayPayload(name) {
+			log.Printf("Skip the invalid overlay %q", name)
+			continue
+		}
+		if err := applyOverlay(filepath.Join(overlayDir, name), target); err != nil {
+			return fmt.Errorf("Oops, apply overlay %s failed: %v", name, err)
+		}
+	}
+	return nil
+}
+
 func RestoreParts(parts *Partitions, bootloader string, partType string, recoveryos string) error {
 	var dev_path string = strings.Replace(parts.TargetDevPath, "mapper/", "", -1)
 	part_nr := parts.Last_part_nr
+
+	// Ubuntu Core takes the partition layout from gadget.yaml if it is backed up in recovery partition
+	// The structures before recovery are only known to exist on the source device
+	var gadgetVol *rplib.GadgetVolume
+	var layout []rplib.LaidOutStructure
+	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CORE && parts.SourceDevPath == parts.TargetDevPath {
+		var err error
+		if gadgetVol, err = loadGadgetVolume(gadgetYamlPath); err != nil {
+			return err
+		}
+		if gadgetVol != nil {
+			if gadgetVol.EffectiveSchema() != partType {
+				log.Printf("The partition type %s in config.yaml is overridden by gadget.yaml schema %s", partType, gadgetVol.EffectiveSchema())
+				partType = gadgetVol.EffectiveSchema()
+			}
+			// fail before any partition is removed
+			if layout, err = gadgetVol.Layout(); err != nil {
+				return err
+			}
+			if err := checkGadgetImages(layout, GADGET_IMAGES_DIR); err != nil {
+				return err
+			}
+		}
+	}
+
 	if bootloader == "u-boot" {
 		parts.Writable_nr = parts.Recovery_nr + 1 //writable is one after recovery
 	} else if bootloader == "grub" {
@@ -370,8 +592,17 @@ func RestoreParts(parts *Partitions, bootloader string, partType string, recover
 	}
 
 	// Restore system-boot
-	sysboot_path := fmtPartPath(parts.TargetDevPath, parts.Sysboot_nr)
-	if bootloader == "u-boot" {
+	if gadgetVol != nil {
+		if err := createGadgetParts(parts, gadgetVol, layout, dev_path); err != nil {
+			return err
+		}
+		if parts.Sysboot_nr == -1 {
+			return fmt.Errorf("Oops, We lose system-boot")
+		}
+		if err := writeGadgetImages(dev_path, layout, GADGET_IMAGES_DIR); err != nil {
+			return err
+		}
+	} else if bootloader == "u-boot" {
 		// In u-boot, it keeps system-boot partition, and only mkfs
 		if parts.Sysboot_nr == -1 {
 			// oops, don't known the location of system-boot.
@@ -390,16 +621,17 @@ func RestoreParts(parts *Partitions, bootloader string, partType string, recover
 
 	exec.Command("partprobe").Run()
 	rplib.Shellexec("sleep", "2") //wait the partition presents
+	sysboot_path := fmtPartPath(parts.TargetDevPath, parts.Sysboot_nr)
 	rplib.Shellexec("mkfs.vfat", "-F", "32", "-n", SysbootLabel, sysboot_path)
 	err := os.MkdirAll(SYSBOOT_MNT_DIR, 0755)
 	if err != nil {
 		return err
 	}
-	err = syscall.Mount(sysboot_path, SYSBOOT_MNT_DIR, "vfat", 0, "")
+	err = mounts.Mount(sysboot_path, SYSBOOT_MNT_DIR, "vfat", 0, "")
 	if err != nil {
 		return err
 	}
-	defer syscall.Unmount(SYSBOOT_MNT_DIR, 0)
+	defer mounts.Unmount(SYSBOOT_MNT_DIR)
 
 	// The ubuntu classic would install grub by grub-install
 	// If the sysboot tarball file not exists, just ignore it
@@ -411,10 +643,18 @@ func RestoreParts(parts *Partitions, bootloader string, partType string, recover
 		rplib.Shellexec("cp", "-r", "/tmp/tmp/.", SYSBOOT_MNT_DIR)
 		rplib.Shellexec("rm", "-rf", "/tmp/tmp/")
 	}
-	rplib.Shellexec("parted", "-ms", dev_path, "set", strconv.Itoa(parts.Sysboot_nr), "boot", "on")
+	if gadgetVol == nil || partType == "mbr" {
+		// The partition type of system-boot in gpt is from gadget.yaml
+		rplib.Shellexec("parted", "-ms", dev_path, "set", strconv.Itoa(parts.Sysboot_nr), "boot", "on")
+	}
 
 	// Create swap partition
-	if configs.Configs.Swap == true && configs.Configs.SwapFile != true && configs.Configs.SwapSize > 0 {
+	swapPart := configs.Configs.Swap == true && configs.Configs.SwapFile != true && configs.Configs.SwapSize > 0
+	if swapPart && gadgetVol != nil {
+		log.Println("The swap partition is not supported with gadget.yaml layout, please use swapfile")
+		swapPart = false
+	}
+	if swapPart {
 		if partType == "gpt" {
 			rplib.Shellexec("parted", "-a", "optimal", "-ms", dev_path, "--", "mkpart", "primary", "linux-swap", fmt.Sprintf("%vMiB", parts.Swap_start), fmt.Sprintf("%vMiB", parts.Swap_end), "name", fmt.Sprintf("%v", parts.Swap_nr), SwapLabel)
 		} else if partType == "mbr" {
@@ -424,11 +664,13 @@ func RestoreParts(parts *Partitions, bootloader string, partType string, recover
 		rplib.Shellexec("mkswap", fmtPartPath(parts.TargetDevPath, parts.Swap_nr))
 	}
 
-	// Restore writable
-	if configs.Configs.Swap == true && configs.Configs.SwapFile != true && configs.Configs.SwapSize > 0 {
-		parts.Writable_start = parts.Swap_end
-	} else {
-		parts.Writable_start = parts.Sysboot_end
+	// Restore writable, the start is from gadget.yaml if using gadget layout
+	if gadgetVol == nil {
+		if swapPart {
+			parts.Writable_start = parts.Swap_end
+		} else {
+			parts.Writable_start = parts.Sysboot_end
+		}
 	}
 	var writable_start string = fmt.Sprintf("%vMiB", parts.Writable_start)
 	var writable_nr string = strconv.Itoa(parts.Writable_nr)
@@ -444,12 +686,22 @@ func RestoreParts(parts *Partitions, bootloader string, partType string, recover
 	exec.Command("partprobe").Run()
 
 	rplib.Shellexec("mkfs.ext4", "-F", "-L", WritableLabel, writable_path)
+
+	if err := runHooks(hooks.PhasePostPartition); err != nil {
+		return err
+	}
+	showProgress(30, msg(rplib.MSG_PROGRESS_RESTORE))
 	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC_CURTIN {
 		// Curtin will handle the partition mounting and partition restore
 		err := generateCurtinConf(parts)
 		rplib.Checkerr(err)
 		err = runCurtin()
 		rplib.Checkerr(err)
+		// curtin keeps the installed target mounted, the per-SKU payloads
+		// are layered over it
+		if err := applyOverlays(OVERLAYS_DIR, configs.Recovery.Overlays, CURTIN_INSTALL_TARGET); err != nil {
+			return err
+		}
 		// If the image is deployed by maas, there will be a curtin/ directory in recovery partition
 		// The nocloud-net config files are not needed, which using maas cloud-init config files
 		// Or we write a nocloud-net config for user config, hostname config ... etc
@@ -461,9 +713,9 @@ func RestoreParts(parts *Partitions, bootloader string, partType string, recover
 	} else {
 		err = os.MkdirAll(WRITABLE_MNT_DIR, 0755)
 		rplib.Checkerr(err)
-		err = syscall.Mount(writable_path, WRITABLE_MNT_DIR, "ext4", 0, "")
+		err = mounts.Mount(writable_path, WRITABLE_MNT_DIR, "ext4", 0, "")
 		rplib.Checkerr(err)
-		defer syscall.Unmount(WRITABLE_MNT_DIR, 0)
+		defer mounts.Unmount(WRITABLE_MNT_DIR)
 		// Here to support install rootfs from squashfs file
 		// If the writable tarball file not exists, just ignore it and unsquashfs the squashfs file
 		if _, err := os.Stat(WRITABLE_TARBALL); !os.IsNotExist(err) {
@@ -471,6 +723,11 @@ func RestoreParts(parts *Partitions, bootloader string, partType string, recover
 		} else if _, err := os.Stat(ROOTFS_SQUASHFS); !os.IsNotExist(err) {
 			rplib.Shellexec("unsquashfs", "-d", WRITABLE_MNT_DIR, "-f", ROOTFS_SQUASHFS)
 		}
+
+		// The per-SKU payloads are layered over the base rootfs
+		if err := applyOverlays(OVERLAYS_DIR, configs.Recovery.Overlays, WRITABLE_MNT_DIR); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -351,7 +351,7 @@ func (s *GetPartSuite) TestRestoreParts(c *C) {
 	cmd.Run()
 	parts, err := reco.GetPartitions(RecoveryLabel, rplib.FACTORY_RESTORE)
 	c.Assert(err, IsNil)
-	err = reco.RestoreParts(parts, "grub", "gpt")
+	err = reco.RestoreParts(parts, "grub", "gpt", rplib.RECOVERY_OS_UBUNTU_CORE)
 	c.Check(err, IsNil)
 
 	err = os.MkdirAll(gptMnt, 0755)
@@ -391,11 +391,11 @@ func (s *GetPartSuite) TestRestoreParts(c *C) {
 	MountTestImg("", gptLoop)
 
 	//Unsupported partition type
-	err = reco.RestoreParts(parts, "u-boot", "OthersPartType")
+	err = reco.RestoreParts(parts, "u-boot", "OthersPartType", rplib.RECOVERY_OS_UBUNTU_CORE)
 	c.Check(err.Error(), Equals, "Oops, unknown partition type:OthersPartType")
 
 	//Unsupported partition type
-	err = reco.RestoreParts(parts, "OthersBootloader", "gpt")
+	err = reco.RestoreParts(parts, "OthersBootloader", "gpt", rplib.RECOVERY_OS_UBUNTU_CORE)
 	c.Check(err.Error(), Equals, "Oops, unknown bootloader:OthersBootloader")
 
 	os.RemoveAll(reco.SYSBOOT_MNT_DIR)
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+const (
+	DEFAULT_RESTORE_PASSWORD_RETRIES = 3
+	GRUB_RESTORE_USER                = "recovery"
+)
+
+// The grub commands at the beginning of Factory Restore menuentry to ask the
+// password. The superusers is set in the menuentry, so the other menuentries
+// are not restricted.
+const GRUB_MENUENTRY_AUTH_CMDS = `
+        set superusers="###GRUB_USER###"
+        password_pbkdf2 ###GRUB_USER### ###GRUB_PASSWORD###
+        if ! authenticate ###GRUB_USER###; then
+                echo "[grub.cfg] authentication failed"
+                sleep 3
+                reboot
+        fi`
+
+// restorePasswordHash returns the restore password hash, the device-specific
+// file on recovery partition wins over config.yaml. It returns "" if the
+// password is not set.
+func restorePasswordHash() string {
+	if configs.Recovery.RestorePasswordFile != "" {
+		data, err := ioutil.ReadFile(RECO_ROOT_DIR + configs.Recovery.RestorePasswordFile)
+		if err == nil && strings.TrimSpace(string(data)) != "" {
+			return strings.TrimSpace(string(data))
+		}
+		log.Printf("Restore password file %s not available: %v", configs.Recovery.RestorePasswordFile, err)
+	}
+	return configs.Recovery.RestorePassword
+}
+
+// easier for function mocking
+var readRestorePassword = readPassword
+
+// checkRestorePassword asks the restore password if set, and returns whether
+// the right password is entered within the retries
+func checkRestorePassword(timeout int64) bool {
+	hash := restorePasswordHash()
+	if hash == "" {
+		return true
+	}
+	retries := configs.Recovery.RestorePasswordRetries
+	if retries <= 0 {
+		retries = DEFAULT_RESTORE_PASSWORD_RETRIES
+	}
+
+	for i := retries; i > 0; i-- {
+		password, ok := readRestorePassword(timeout)
+		if !ok {
+			return false
+		}
+		match, err := rplib.VerifyPassword(hash, password)
+		if err != nil {
+			log.Println("Invalid restore password hash:", err)
+			return false
+		}
+		if match {
+			return true
+		}
+		log.Println(msg(rplib.MSG_PASSWORD_WRONG, "retries", fmt.Sprint(i-1)))
+	}
+	return false
+}
+
+// grubAuthCmds returns the grub commands asking the restore password, or ""
+// if the menuentry is not protected
+func grubAuthCmds() string {
+	if !configs.Recovery.RestorePasswordGrub {
+		return ""
+	}
+	hash := restorePasswordHash()
+	if hash == "" {
+		return ""
+	}
+	cmds := strings.Replace(GRUB_MENUENTRY_AUTH_CMDS, "###GRUB_USER###", GRUB_RESTORE_USER, -1)
+	return strings.Replace(cmds, "###GRUB_PASSWORD###", hash, -1)
+}
+
+// passwdCommand implements `recovery.bin passwd`, which reads the password
+// from in and prints the hash for restore-password
+func passwdCommand(in io.Reader, out io.Writer) int {
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fmt.Fprintln(out, "Usage: echo PASSWORD | recovery.bin passwd")
+		return 2
+	}
+	hash, err := rplib.HashPassword(password)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	fmt.Fprintln(out, hash)
+	return 0
+}
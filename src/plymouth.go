@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+// The plymouth client, changed in tests
+var plymouthBin = "plymouth"
+
+var plymouthOnce sync.Once
+var plymouthActive bool
+
+func plymouth(args ...string) error {
+	return exec.Command(plymouthBin, args...).Run()
+}
+
+// usePlymouth tells whether the plymouth daemon is running, the prompts and
+// progress are shown by plymouth then instead of the kernel console
+func usePlymouth() bool {
+	plymouthOnce.Do(func() {
+		plymouthActive = plymouth("--ping") == nil
+		if plymouthActive {
+			log.Println("Plymouth is running, show the prompts and progress by plymouth")
+		}
+	})
+	return plymouthActive
+}
+
+// plymouthWatchKeys sends the keys pressed on plymouth to keys until stop is
+// called
+func plymouthWatchKeys(allowed string, keys chan<- consoleKey) (stop func()) {
+	var mutex sync.Mutex
+	var cmd *exec.Cmd
+	stopped := false
+	console := &Console{Name: "plymouth"}
+
+	go func() {
+		for {
+			mutex.Lock()
+			if stopped {
+				mutex.Unlock()
+				return
+			}
+			cmd = exec.Command(plymouthBin, "watch-keystroke", "--keys="+allowed)
+			mutex.Unlock()
+
+			// watch-keystroke prints the key pressed and exits
+			out, err := cmd.Output()
+			if err != nil {
+				return
+			}
+			if k := strings.TrimSpace(string(out)); k != "" {
+				keys <- consoleKey{console, k[0]}
+			}
+		}
+	}()
+
+	return func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		stopped = true
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+}
+
+// plymouthAskPassword sends the password entered on plymouth to lines until
+// stop is called
+func plymouthAskPassword(prompt string, lines chan<- string) (stop func()) {
+	cmd := exec.Command(plymouthBin, "ask-for-password", "--prompt="+prompt)
+	go func() {
+		if out, err := cmd.Output(); err == nil {
+			lines <- strings.TrimRight(string(out), "\n")
+		}
+	}()
+	return func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+}
+
+// showStatus shows the message on plymouth if running, and logs it
+func showStatus(text string) {
+	log.Println(text)
+	if usePlymouth() {
+		plymouth("display-message", "--text="+text)
+	}
+}
+
+// showProgress shows the restore progress in percent and the message
+func showProgress(percent int, text string) {
+	log.Printf("[%d%%] %s", percent, text)
+	if usePlymouth() {
+		plymouth("system-update", fmt.Sprintf("--progress=%d", percent))
+		plymouth("display-message", "--text="+text)
+	}
+}
+
+// reportFailure shows the restore failure when recovery.bin panics
+func reportFailure() {
+	if r := recover(); r != nil {
+		showStatus(msg(rplib.MSG_RESTORE_FAILED))
+		writeReport("failure", r)
+		recordHistory(rplib.HISTORY_FAILURE)
+		collectLogBundle("failure")
+		cleanupPartitions(RecoveryOS)
+		panic(r)
+	}
+}
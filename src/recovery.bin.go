@@ -44,6 +44,7 @@ const (
 	ASSERTION_BACKUP_DIR = "/tmp/assert_backup/"
 	RECO_ROOT_DIR        = "/run/recovery/"
 	CONFIG_YAML          = RECO_ROOT_DIR + "recovery/config.yaml"
+	GADGET_YAML          = RECO_ROOT_DIR + "recovery/gadget.yaml"
 	WRITABLE_MNT_DIR     = "/tmp/writableMnt/"
 	SYSBOOT_MNT_DIR      = "/tmp/system-boot/"
 	RECO_TAR_MNT_DIR     = "/tmp/recoMnt/"
@@ -51,6 +52,11 @@ const (
 	SYSBOOT_TARBALL      = RECO_FACTORY_DIR + "system-boot.tar.xz"
 	WRITABLE_TARBALL     = RECO_FACTORY_DIR + "writable.tar.xz"
 	ROOTFS_SQUASHFS      = RECO_FACTORY_DIR + "rootfs.squashfs"
+	GADGET_IMAGES_DIR    = RECO_FACTORY_DIR + "gadget/"
+	OVERLAYS_DIR         = RECO_FACTORY_DIR + "overlays/"
+	HOOKS_LOG_DIR        = "/tmp/recovery-hooks/"
+	HOOKS_CONTEXT_FILE   = "/run/recovery-hooks/context.json"
+	EARLY_LOG_SPILL_DIR  = "/tmp/"
 	CORE_LOG_PATH        = WRITABLE_MNT_DIR + "system-data/var/log/recovery/recovery.bin.log"
 	CLASSIC_LOG_PATH     = WRITABLE_MNT_DIR + "var/log/recovery/recovery.bin.log"
 
@@ -99,13 +105,44 @@ func parseConfigs(configFilePath string) {
 	// Load config.yaml
 	err := configs.Load(configPath)
 	rplib.Checkerr(err)
+
+	// Override configs by kernel cmdline and environment variables, the
+	// invalid ones are ignored
+	overrides, errs := configs.ApplyOverrides(readKernelCmdline(), os.Environ())
+	for _, o := range overrides {
+		log.Println(o)
+	}
+	for _, err := range errs {
+		rplib.LogWarning("Ignore the config override: " + err.Error())
+	}
 	log.Println(configs)
 }
 
 // easier for function mocking
+var readKernelCmdline = rplib.ReadKernelCmdline
 var getPartitions = GetPartitions
 var restoreParts = RestoreParts
-var syscallMount = syscall.Mount
+
+// The mounts of recovery, unmounted in reverse order even if it fails
+var mounts = rplib.NewMountRegistry(rplib.SyscallMounter{})
+
+// mountReadOnly mounts device on dir read-only by its filesystem type from
+// blkid. The ext3/ext4 journal is not replayed, so the filesystem is kept as
+// it was.
+func mountReadOnly(device string, dir string) error {
+	fstype := blkidValue("TYPE", device)
+	if fstype == "" {
+		return fmt.Errorf("unknown filesystem on %s", device)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data := ""
+	if fstype == "ext3" || fstype == "ext4" {
+		data = "noload"
+	}
+	return mounts.Mount(device, dir, fstype, syscall.MS_RDONLY, data)
+}
 
 func getBootEntryName(recoveryos string) string {
 	if RecoveryOS == rplib.RECOVERY_OS_UBUNTU_CORE {
@@ -115,48 +152,9 @@ func getBootEntryName(recoveryos string) string {
 	return rplib.BOOT_ENTRY_UBUNTU_CLASSIC
 }
 
-func preparePartitions(parts *Partitions, recoveryos string) {
-	// TODO: verify the image
-	// If this is user triggered factory restore (first time is in factory and should happen automatically), ask user for confirm.
-	var timeout int64
-	if rplib.FACTORY_RESTORE == RecoveryType {
-		if configs.Recovery.RestoreConfirmTimeoutSec > 0 {
-			timeout = configs.Recovery.RestoreConfirmTimeoutSec
-		} else {
-			timeout = 300
-		}
-
-		if ConfirmRecovery(timeout, recoveryos) == false {
-			os.Exit(0x55) //ERESTART
-		}
-
-		//backup assertions
-		BackupAssertions(parts)
-	}
-
-	// rebuild the partitions
-	log.Println("[rebuild the partitions]")
-	restoreParts(parts, configs.Configs.Bootloader, configs.Configs.PartitionType, recoveryos)
-
-	//Mount writable for logger and restore data
-	if _, err := os.Stat(WRITABLE_MNT_DIR); err != nil {
-		err := os.MkdirAll(WRITABLE_MNT_DIR, 0755)
-		rplib.Checkerr(err)
-	}
-	err := syscallMount(fmtPartPath(parts.TargetDevPath, parts.Writable_nr), WRITABLE_MNT_DIR, "ext4", 0, "")
-	rplib.Checkerr(err)
-
-	//Mount system-boot for logger and restore data
-	if _, err = os.Stat(SYSBOOT_MNT_DIR); err != nil {
-		err := os.MkdirAll(SYSBOOT_MNT_DIR, 0755)
-		rplib.Checkerr(err)
-	}
-	err = syscallMount(fmtPartPath(parts.TargetDevPath, parts.Sysboot_nr), SYSBOOT_MNT_DIR, "vfat", 0, "")
-	rplib.Checkerr(err)
-}
-
 // easier for function mocking
 var enableLogger = EnableLogger
+var disableLogger = DisableLogger
 var copySnapsAsserts = CopySnapsAsserts
 var restoreAsserions = RestoreAsserions
 var updateUbootEnv = UpdateUbootEnv
@@ -187,104 +185,49 @@ func find_efi_dir() error {
 	return nil
 }
 
-func recoverProcess(parts *Partitions, recoveryos string) {
-	commitstampInt64, _ := strconv.ParseInt(commitstamp, 10, 64)
-
-	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CORE {
-		// stream log to stdout and writable partition
-		err := enableLogger(CORE_LOG_PATH)
-		rplib.Checkerr(err)
-		log.Printf("Version: %v, Commit: %v, Build date: %v\n", version, commit, time.Unix(commitstampInt64, 0).UTC())
-		// Copy snaps
-		log.Println("[Add additional snaps/asserts]")
-		err = copySnapsAsserts()
-		rplib.Checkerr(err)
-
-		// Ubuntu core default is using EFI directory for boot partition
-		// Here to support both efi/EFI direcroty for classic and core
-		err = find_efi_dir()
-		rplib.Checkerr(err)
-
-	} else if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC {
-		err := enableLogger(CLASSIC_LOG_PATH)
-		rplib.Checkerr(err)
-		log.Printf("Version: %v, Commit: %v, Build date: %v\n", version, commit, time.Unix(commitstampInt64, 0).UTC())
-		log.Println("[Update fstab]")
-		err = updateFstab(parts, recoveryos)
-		rplib.Checkerr(err)
-	} else if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC_CURTIN {
-		// Update grub menu configs if using curtin
-		writable_uuid := rplib.Shellcmdoutput(fmt.Sprintf("blkid -s UUID -o value %s", fmtPartPath(parts.TargetDevPath, parts.Writable_nr)))
-		err := grubInstall(WRITABLE_MNT_DIR, SYSBOOT_MNT_DIR, recoveryos, false, configs.Configs.Swap, configs.Configs.SwapFile, fmt.Sprintf("UUID=%s", writable_uuid))
-		if err != nil {
-			fmt.Println(err)
-		}
-		return
-	}
-
-	switch RecoveryType {
-	case rplib.FACTORY_INSTALL:
-		log.Println("[EXECUTE FACTORY INSTALL]")
-
-	case rplib.FACTORY_RESTORE:
-		log.Println("[User restores system]")
-		// restore assertion if ever signed
-		restoreAsserions()
-	}
-
-	if configs.Configs.Bootloader == "u-boot" {
-		// update uboot env
-		log.Println("[Update uboot env]")
-		err := updateUbootEnv(RecoveryLabel)
-		rplib.Checkerr(err)
-	} else if configs.Configs.Bootloader == "grub" {
-		// update uboot env
-		log.Println("[Update grub cfg/env]")
-
-		var grub_cfg string
-		if recoveryos == rplib.RECOVERY_OS_UBUNTU_CORE {
-			grub_cfg = SYSBOOT_GRUB_CFG
-		} else if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC {
-			grub_cfg = WRITABLE_GRUB_40_CUSTOM
-		}
-		// mount as writable before editing
-		rplib.Shellexec("mount", "-o", "rw,remount", RECO_ROOT_DIR)
-		err := updateGrubCfg(RecoveryLabel, grub_cfg, RECO_PART_GRUB_ENV, recoveryos)
-		rplib.Shellexec("mount", "-o", "ro,remount", RECO_ROOT_DIR)
-		rplib.Checkerr(err)
-
-		// update efi Boot Entries
-		log.Println("[Update boot entries]")
-		if recoveryos == rplib.RECOVERY_OS_UBUNTU_CORE {
-			updateBootEntries(parts, getBootEntryName(RecoveryOS))
-		} else if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC {
-			// grub install also updates the boot entries
-			if configs.Configs.Swap {
-				grubInstall(WRITABLE_MNT_DIR, SYSBOOT_MNT_DIR, recoveryos, true, true, configs.Configs.SwapFile, fmtPartPath(parts.TargetDevPath, parts.Writable_nr))
-			} else {
-				grubInstall(WRITABLE_MNT_DIR, SYSBOOT_MNT_DIR, recoveryos, true, false, configs.Configs.SwapFile, "")
-			}
-		}
-	}
-}
-
-var syscallUnMount = syscall.Unmount
-
+// cleanupPartitions unmounts all the mounts of recovery, the ones left
+// mounted are logged
 func cleanupPartitions(recoveryos string) {
-	syscallUnMount(WRITABLE_MNT_DIR, 0)
-	syscallUnMount(SYSBOOT_MNT_DIR, 0)
+	disableLogger()
+	if err := mounts.UnmountAll(); err != nil {
+		log.Println(err)
+	}
 }
 
 func main() {
+	rplib.RedirectStdLog()
 	flag.Parse()
-	if len(flag.Args()) != 3 {
-		log.Panicf(fmt.Sprintf("Need two arguments. [RECOVERY_TYPE] [RECOVERY_LABEL] [RECOVERY_OS]. Current arguments: %v", flag.Args()))
+	switch flag.Arg(0) {
+	case "validate":
+		os.Exit(validateConfig(flag.Args()[1:], os.Stdout))
+	case "hook":
+		os.Exit(hookCommand(flag.Args()[1:]))
+	case "passwd":
+		os.Exit(passwdCommand(os.Stdin, os.Stdout))
+	case "history":
+		os.Exit(historyCommand(flag.Args()[1:], os.Stdout))
 	}
+	args := flag.Args()
+	var opts stepOptions
+	if flag.Arg(0) == "run" {
+		var err error
+		if opts, args, err = parseRunArgs(args[1:], os.Stderr); err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+	}
+	if len(args) != 3 {
+		log.Panicf(fmt.Sprintf("Need two arguments. [RECOVERY_TYPE] [RECOVERY_LABEL] [RECOVERY_OS]. Current arguments: %v", args))
+	}
+	// keep the log until writable is mounted
+	earlyLog = rplib.NewEarlyLog(rplib.EARLY_LOG_MAX_MEMORY, EARLY_LOG_SPILL_DIR)
+	rplib.DefaultLogger.AddSink(earlyLog)
 	// TODO: use enum to represent RECOVERY_TYPE
-	RecoveryType, RecoveryLabel, RecoveryOS = flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	RecoveryType, RecoveryLabel, RecoveryOS = args[0], args[1], args[2]
 	log.Printf("RECOVERY_TYPE: %s", RecoveryType)
 	log.Printf("RECOVERY_LABEL: %s", RecoveryLabel)
 	log.Printf("RECOVERY_OS: %s", RecoveryOS)
+	startReport()
 
 	// setup environment for ubuntu server curtin
 	if RecoveryOS == rplib.RECOVERY_OS_UBUNTU_CLASSIC_CURTIN {
@@ -296,12 +239,17 @@ func main() {
 	}
 
 	parseConfigs(CONFIG_YAML)
+	mirrorLogToConsoles()
+	loadMessages()
+	defer reportFailure()
 
 	// Find boot device, all other partiitons info
+	endStep := reportStep("find-partitions")
 	parts, err := getPartitions(RecoveryLabel, RecoveryType)
 	if err != nil {
 		log.Panicf("Boot device not found, error: %s\n", err)
 	}
+	endStep()
 
 	// Check boot entries if corrupted and in recovery mode.
 	// Currently only support amd64
@@ -323,7 +271,24 @@ func main() {
 	if configs.Configs.Swap == true && configs.Configs.SwapFile != true && configs.Configs.SwapSize > 0 {
 		SetPartitionStartEnd(parts, SwapLabel, configs.Configs.SwapSize, configs.Configs.Bootloader)
 	}
-	preparePartitions(parts, RecoveryOS)
-	recoverProcess(parts, RecoveryOS)
+	showProgress(0, msg(rplib.MSG_RESTORE_START))
+	runRestoreSteps(parts, RecoveryOS, opts)
+	result := rplib.HISTORY_SUCCESS
+	if opts.selected() {
+		// the recovery is not done by the selected steps, the state and the
+		// recovery boot are kept for the whole recovery
+		log.Println("The selected steps are done, the recovery is not finished")
+		result = rplib.HISTORY_PARTIAL
+	}
+	writeReport(result, nil)
+	collectLogBundle(result)
+	endStep = reportStep("cleanup")
 	cleanupPartitions(RecoveryOS)
+	endStep()
+	recordHistory(result)
+	if !opts.selected() {
+		recordRestoreDuration()
+		finishRestoreState(parts, RecoveryOS)
+	}
+	showProgress(100, msg(rplib.MSG_RESTORE_DONE))
 }
@@ -20,11 +20,16 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	. "gopkg.in/check.v1"
 
+	hooks "github.com/Lyoncore/ubuntu-custom-recovery/src/hooks"
 	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
 )
 
@@ -53,7 +58,7 @@ func (s *MainTestSuite) TestparseConfigs(c *C) {
 	parseConfigs(configFile)
 }
 
-func (s *MainTestSuite) TestpreparePartitions(c *C) {
+func (s *MainTestSuite) TestmountPartitions(c *C) {
 	recoveryDir := filepath.Join("/tmp", filepath.Dir(RECO_FACTORY_DIR), "..")
 	err := os.MkdirAll(recoveryDir, 0755)
 	c.Assert(err, IsNil)
@@ -65,7 +70,7 @@ func (s *MainTestSuite) TestpreparePartitions(c *C) {
 	oldArgs := os.Args
 	defer func() { os.Args = oldArgs }()
 
-	os.Args = []string{"TestpreparePartitions", "recovery", "recovery"}
+	os.Args = []string{"TestmountPartitions", "recovery", "recovery"}
 	configFile := filepath.Join(recoveryDir, configName)
 	parseConfigs(configFile)
 
@@ -78,46 +83,55 @@ func (s *MainTestSuite) TestpreparePartitions(c *C) {
 		// check if GetPartitions() is called with correct RecoveryLabel
 		c.Assert(label, Equals, "recovery")
 		c.Assert(rtype, Equals, rplib.FACTORY_RESTORE)
-		parts := Partitions{"testSrcdevnode", "testSrcdevpath", "testTardevnode", "testTardevpath", -1, -1, -1, -1, -1, -1, -1, -1, -1, -1}
+		parts := Partitions{"testSrcdevnode", "testSrcdevpath", "testTardevnode", "testTardevpath", -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1}
 		return &parts, nil
 	}
 	defer func() { getPartitions = origGetPartitions }()
 
-	origRestoreParts := restoreParts
-	restoreParts = func(parts *Partitions, bootloader string, partType string, recoveryos string) error {
-		// check if RestoreParts is caled correctly with *parts returned
-		c.Assert(parts.SourceDevNode, Equals, "testSrcdevnode")
-		c.Assert(parts.SourceDevPath, Equals, "testSrcdevpath")
-		c.Assert(parts.TargetDevNode, Equals, "testTardevnode")
-		c.Assert(parts.TargetDevPath, Equals, "testTardevpath")
-		return nil
-	}
-	defer func() { restoreParts = origRestoreParts }()
+	origEnableLogger := enableLogger
+	enableLogger = func(logPath string) error { return nil }
+	defer func() { enableLogger = origEnableLogger }()
 
-	origSyscallMount := syscallMount
-	var mountCalled = 0
-	syscallMount = func(source string, target string, fstype string, flags uintptr, data string) error {
-		mountCalled++
-		return nil
-	}
+	origMounts := mounts
+	fake := &fakeMounter{}
+	mounts = rplib.NewMountRegistry(fake)
 	defer func() {
-		// syscallMount should be called twice
-		c.Assert(mountCalled, Equals, 2)
-		syscallMount = origSyscallMount
+		// writable and system-boot should be mounted
+		c.Assert(fake.Calls, HasLen, 2)
+		mounts = origMounts
 	}()
 
 	parts, _ := getPartitions("recovery", rplib.FACTORY_RESTORE)
-	preparePartitions(parts)
+	c.Assert(mountPartitions(parts, rplib.RECOVERY_OS_UBUNTU_CLASSIC), IsNil)
 }
 
-func (s *MainTestSuite) TestrecoverProcess(c *C) {
+func (s *MainTestSuite) TestrunRestoreSteps(c *C) {
 	RecoveryType = "factory_restore"
 	RecoveryLabel = "recovery"
 
 	origEnableLogger := enableLogger
-	enableLogger = func() error { return nil }
+	enableLogger = func(logPath string) error { return nil }
 	defer func() { enableLogger = origEnableLogger }()
 
+	origRestoreParts := restoreParts
+	restoreParts = func(parts *Partitions, bootloader string, partType string, recoveryos string) error {
+		// check if RestoreParts is caled correctly with *parts returned
+		c.Assert(parts.SourceDevNode, Equals, "testSrcdevnode")
+		c.Assert(parts.SourceDevPath, Equals, "testSrcdevpath")
+		c.Assert(parts.TargetDevNode, Equals, "testTardevnode")
+		c.Assert(parts.TargetDevPath, Equals, "testTardevpath")
+		return nil
+	}
+	defer func() { restoreParts = origRestoreParts }()
+
+	origMounts := mounts
+	mounts = rplib.NewMountRegistry(&fakeMounter{})
+	defer func() { mounts = origMounts }()
+
+	// the efi directory of the restored system-boot
+	c.Assert(os.MkdirAll(filepath.Join(SYSBOOT_MNT_DIR, "efi"), 0755), IsNil)
+	defer os.RemoveAll(SYSBOOT_MNT_DIR)
+
 	origCopySnaps := copySnapsAsserts
 	copySnapsAsserts = func() error { return nil }
 	defer func() { copySnapsAsserts = origCopySnaps }()
@@ -169,27 +183,144 @@ func (s *MainTestSuite) TestrecoverProcess(c *C) {
 		// check if GetPartitions() is called with correct RecoveryLabel
 		c.Assert(label, Equals, "recovery")
 		c.Assert(rtype, Equals, rplib.FACTORY_RESTORE)
-		parts := Partitions{"testSrcdevnode", "testSrcdevpath", "testTardevnode", "testTardevpath", -1, -1, -1, -1, -1, -1, -1, -1, -1, -1}
+		parts := Partitions{"testSrcdevnode", "testSrcdevpath", "testTardevnode", "testTardevpath", -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1, -1}
 		return &parts, nil
 	}
 	defer func() { getPartitions = origGetPartitions }()
 
+	// the confirmation is interactive, the selected steps don't checkpoint
+	// or arm the recovery boot
 	parts, _ := getPartitions("recovery", rplib.FACTORY_RESTORE)
-	recoverProcess(parts)
+	runRestoreSteps(parts, rplib.RECOVERY_OS_UBUNTU_CORE, stepOptions{skip: stepList{STEP_CONFIRM, STEP_BACKUP_ASSERTIONS}})
 }
 
 func (s *MainTestSuite) TestcleanupPartitions(c *C) {
-	origSyscallUnMount := syscallUnMount
-	var unmountCalled = 0
-	syscallUnMount = func(target string, flags int) error {
-		unmountCalled++
-		return nil
+	origMounts := mounts
+	fake := &fakeMounter{}
+	mounts = rplib.NewMountRegistry(fake)
+	defer func() { mounts = origMounts }()
+
+	mounts.Mount("/dev/sda3", WRITABLE_MNT_DIR, "ext4", 0, "")
+	mounts.Mount("/dev/sda2", SYSBOOT_MNT_DIR, "vfat", 0, "")
+	cleanupPartitions(rplib.RECOVERY_OS_UBUNTU_CORE)
+	// unmounted in reverse order
+	c.Assert(fake.Calls[2:], DeepEquals, []string{"umount /tmp/system-boot 0", "umount /tmp/writableMnt 0"})
+	c.Assert(mounts.Mounted(), HasLen, 0)
+}
+
+func (s *MainTestSuite) TestcheckGadgetImages(c *C) {
+	vol := rplib.GadgetVolume{
+		Structure: []rplib.VolumeStructure{
+			{Type: "bare", Size: "1M", Content: []rplib.VolumeContent{{Image: "boot0.img"}}},
+			{Name: "system-boot", Role: "system-boot", Filesystem: "vfat", Size: "64M"},
+		},
 	}
-	defer func() {
-		// syscallUnMount should be called twice
-		c.Assert(unmountCalled, Equals, 2)
-		syscallUnMount = origSyscallUnMount
-	}()
+	layout, err := vol.Layout()
+	c.Assert(err, IsNil)
+
+	imageDir := c.MkDir()
+	c.Check(checkGadgetImages(layout, imageDir), ErrorMatches, `Raw structure #0 \(""\) could not be restored: .*boot0.img: no such file or directory`)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(imageDir, "boot0.img"), []byte("boot"), 0644), IsNil)
+	c.Check(checkGadgetImages(layout, imageDir), IsNil)
+
+	// no image is written without the images dir
+	c.Check(checkGadgetImages(layout, filepath.Join(imageDir, "not-exist")), IsNil)
+}
+
+func (s *MainTestSuite) TestvalidateConfig(c *C) {
+	var out bytes.Buffer
+	code := validateConfig([]string{"-cmdline", "recovery.cfg.configs.swap=maybe", configSrcPath}, &out)
+	c.Check(code, Equals, 1)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(len(lines) >= 2, Equals, true)
+	// the override problem has no line in config.yaml
+	c.Check(strings.HasPrefix(lines[0], configSrcPath+": error: "), Equals, true, Commentf("%s", lines[0]))
+	c.Check(strings.HasPrefix(lines[len(lines)-1], configSrcPath+": 1 error(s)"), Equals, true, Commentf("%s", lines[len(lines)-1]))
+}
+
+func (s *MainTestSuite) TestaskUserConfirmStopsReading(c *C) {
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	defer w.Close()
+
+	oldConsoles := consoles
+	defer func() { consoles = oldConsoles }()
+	consoles = []*Console{{Name: "ttyTEST", File: r}}
+
+	_, err = w.Write([]byte("xy"))
+	c.Assert(err, IsNil)
+	c.Check(askUserConfirm(5), Equals, "y")
+
+	// the console is not read after the prompt returns
+	_, err = w.Write([]byte("n"))
+	c.Assert(err, IsNil)
+	b := make([]byte, 1)
+	_, err = r.Read(b)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "n")
+}
+
+func (s *MainTestSuite) TestconfirmDecisionPassword(c *C) {
+	hash, err := rplib.HashPassword("secret")
+	c.Assert(err, IsNil)
+	oldConfigs := configs
+	defer func() { configs = oldConfigs }()
+	configs.Recovery.RestorePassword = hash
+	configs.Recovery.RestorePasswordRetries = 1
+
+	oldAskUser, oldReadPassword := askUser, readRestorePassword
+	defer func() { askUser, readRestorePassword = oldAskUser, oldReadPassword }()
+	askUser = func(timeout int64) string {
+		c.Error("the user is asked although the prehook decides")
+		return ""
+	}
+	password := "wrong"
+	readRestorePassword = func(timeout int64) (string, bool) { return password, true }
+
+	// the password is asked even if the prehook approves
+	confirmed, by := confirmDecision(hooks.ConfirmApprove, 1)
+	c.Check(confirmed, Equals, false)
+	c.Check(by, Equals, "password")
+
+	password = "secret"
+	confirmed, by = confirmDecision(hooks.ConfirmApprove, 1)
+	c.Check(confirmed, Equals, true)
+	c.Check(by, Equals, "prehook")
+
+	confirmed, by = confirmDecision(hooks.ConfirmDeny, 1)
+	c.Check(confirmed, Equals, false)
+	c.Check(by, Equals, "prehook")
+}
+
+func (s *MainTestSuite) TestEnableLoggerClosesPrevious(c *C) {
+	dir := c.MkDir()
+	defer DisableLogger()
+
+	c.Assert(EnableLogger(filepath.Join(dir, "first.log")), IsNil)
+	first := logFile
+	c.Assert(EnableLogger(filepath.Join(dir, "second.log")), IsNil)
+	c.Check(logFile, Not(Equals), first)
+
+	_, err := first.Write([]byte("x"))
+	c.Check(err, NotNil)
+}
+
+// fakeMounter records the mounts without mounting
+type fakeMounter struct {
+	// Calls are the calls in order, e.g. "mount /dev/sda1 /mnt" and
+	// "umount /mnt 0"
+	Calls []string
+}
+
+func (f *fakeMounter) Mount(source, target, fstype string, flags uintptr, data string) error {
+	f.Calls = append(f.Calls, fmt.Sprintf("mount %s %s", source, target))
+	return nil
+}
 
-	cleanupPartitions()
+func (f *fakeMounter) Unmount(target string, flags int) error {
+	f.Calls = append(f.Calls, fmt.Sprintf("umount %s %d", target, flags))
+	return nil
 }
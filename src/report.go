@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	hooks "github.com/Lyoncore/ubuntu-custom-recovery/src/hooks"
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+const (
+	REPORT_NAME = "recovery-report.json"
+	// The copy of report for the log bundle, the writable may be not mounted
+	REPORT_TMP_PATH = "/tmp/" + REPORT_NAME
+	// The reports of all the recoveries, one JSON per line
+	RECOVERY_REPORTS = RECO_ROOT_DIR + "recovery/recovery-reports.jsonl"
+)
+
+type ReportDisk struct {
+	Device    string `json:"device"`
+	Model     string `json:"model"`
+	Serial    string `json:"serial,omitempty"`
+	SizeBytes int64  `json:"size-bytes"`
+}
+
+type ReportPartition struct {
+	Number    int    `json:"number"`
+	Device    string `json:"device"`
+	SizeBytes int64  `json:"size-bytes"`
+	Label     string `json:"label,omitempty"`
+	FsType    string `json:"fstype,omitempty"`
+	UUID      string `json:"uuid,omitempty"`
+	PARTUUID  string `json:"partuuid,omitempty"`
+}
+
+type ReportPayload struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size-bytes"`
+	SHA256    string `json:"sha256"`
+}
+
+// ReportStep is a step of recovery with the external commands run in it
+type ReportStep struct {
+	Name        string                `json:"name"`
+	Start       time.Time             `json:"start"`
+	DurationSec float64               `json:"duration-sec"`
+	Commands    []rplib.CommandRecord `json:"commands,omitempty"`
+}
+
+// RecoveryReport is written as JSON in the restored writable, and appended
+// to RECOVERY_REPORTS on the recovery partition
+type RecoveryReport struct {
+	Version       string             `json:"version"`
+	Commit        string             `json:"commit,omitempty"`
+	BuildDate     string             `json:"build-date,omitempty"`
+	RecoveryType  string             `json:"recovery-type"`
+	RecoveryOS    string             `json:"recovery-os"`
+	RecoveryLabel string             `json:"recovery-label"`
+	Profile       string             `json:"profile,omitempty"`
+	Image         string             `json:"image"`
+	Disk          ReportDisk         `json:"disk"`
+	Partitions    []ReportPartition  `json:"partitions"`
+	Payloads      []ReportPayload    `json:"payloads"`
+	Steps         []*ReportStep      `json:"steps"`
+	Hooks         []hooks.HookResult `json:"hooks"`
+	Start         time.Time          `json:"start"`
+	DurationSec   float64            `json:"duration-sec"`
+	Status        string             `json:"status"` // success, partial or failure
+	FailedStep    string             `json:"failed-step,omitempty"`
+	Error         string             `json:"error,omitempty"`
+}
+
+var report = RecoveryReport{Start: time.Now()}
+var reportLock sync.Mutex
+
+// currentStep returns the step running, the commands before the first step
+// are in "setup"
+func currentStep() *ReportStep {
+	if len(report.Steps) == 0 {
+		report.Steps = append(report.Steps, &ReportStep{Name: "setup", Start: report.Start})
+	}
+	return report.Steps[len(report.Steps)-1]
+}
+
+// reportStep starts the step, and returns the function to end it
+func reportStep(name string) func() {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	step := &ReportStep{Name: name, Start: time.Now()}
+	report.Steps = append(report.Steps, step)
+	return func() {
+		reportLock.Lock()
+		defer reportLock.Unlock()
+		step.DurationSec = time.Since(step.Start).Seconds()
+	}
+}
+
+func recordCommand(record rplib.CommandRecord) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	step := currentStep()
+	step.Commands = append(step.Commands, record)
+}
+
+func recordHookResult(result hooks.HookResult) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	report.Hooks = append(report.Hooks, result)
+}
+
+// startReport records the external commands and the hook results from now on
+func startReport() {
+	rplib.RecordCommand = recordCommand
+}
+
+// fileSHA256 returns the hex sha256 of file
+var fileSHA256 = func(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func reportPayloads() []ReportPayload {
+	var payloads []ReportPayload
+	for _, p := range restorePayloads() {
+		info, err := os.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		sum, err := fileSHA256(p)
+		if err != nil {
+			log.Printf("Checksum %s failed: %v", p, err)
+		}
+		payloads = append(payloads, ReportPayload{Path: strings.TrimPrefix(p, RECO_ROOT_DIR), SizeBytes: info.Size(), SHA256: sum})
+	}
+	return payloads
+}
+
+func reportPartitions(disk rplib.DiskInfo) []ReportPartition {
+	var list []ReportPartition
+	for _, p := range disk.Partitions {
+		device := fmtPartPath(parts.TargetDevPath, p.Number)
+		list = append(list, ReportPartition{
+			Number:    p.Number,
+			Device:    device,
+			SizeBytes: p.SizeBytes,
+			Label:     blkidValue("LABEL", device),
+			FsType:    blkidValue("TYPE", device),
+			UUID:      blkidValue("UUID", device),
+			PARTUUID:  blkidValue("PARTUUID", device),
+		})
+	}
+	return list
+}
+
+// finishReport fills the system information and the final status
+func finishReport(status string, failure interface{}) RecoveryReport {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+
+	report.Version, report.Commit = version, commit
+	if stamp, err := strconv.ParseInt(commitstamp, 10, 64); err == nil {
+		report.BuildDate = time.Unix(stamp, 0).UTC().Format(time.RFC3339)
+	}
+	report.RecoveryType, report.RecoveryOS, report.RecoveryLabel = RecoveryType, RecoveryOS, RecoveryLabel
+	report.Profile = configs.Profile
+	report.Image, _ = imageVersion()
+	if parts.TargetDevNode != "" {
+		disk := rplib.ReadDiskInfo(parts.TargetDevNode)
+		report.Disk = ReportDisk{Device: parts.TargetDevPath, Model: disk.Model, Serial: disk.Serial, SizeBytes: disk.SizeBytes}
+		report.Partitions = reportPartitions(disk)
+	}
+	report.Payloads = reportPayloads()
+	report.DurationSec = time.Since(report.Start).Seconds()
+	report.Status = status
+	if failure != nil {
+		report.FailedStep = currentStep().Name
+		report.Error = fmt.Sprint(failure)
+	}
+	return report
+}
+
+func appendLine(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reportPath returns the report path next to the recovery.bin log in writable
+func reportPath() string {
+	return filepath.Join(filepath.Dir(recoveryLogPath(RecoveryOS)), REPORT_NAME)
+}
+
+// writeReport writes the report of this recovery, status is success, partial
+// or failure. The report is written in writable only if it is mounted.
+func writeReport(status string, failure interface{}) {
+	r := finishReport(status, failure)
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		log.Println("Encode the recovery report failed:", err)
+		return
+	}
+	data = append(data, '\n')
+
+	if err := ioutil.WriteFile(REPORT_TMP_PATH, data, 0644); err != nil {
+		log.Println(err)
+	}
+	if mountedDirs()[strings.TrimSuffix(WRITABLE_MNT_DIR, "/")] {
+		path := reportPath()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			log.Println(err)
+		} else if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			log.Println("Write the recovery report failed:", err)
+		} else {
+			log.Println("Recovery report is written in", path)
+		}
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := rplib.WithWritable(RECO_ROOT_DIR, func() error { return appendLine(RECOVERY_REPORTS, line) }); err != nil {
+		log.Println("Append the recovery report to recovery partition failed:", err)
+	}
+}
@@ -0,0 +1,120 @@
+package rplib
+
+import (
+	"fmt"
+	"log"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The config.yaml schema version this recovery.bin understands.
+// The config.yaml without schema-version is version 1.
+const CONFIG_SCHEMA_VERSION = 2
+
+// configMigrations[n] upgrades the raw config from version n+1 to n+2
+var configMigrations = []func(raw map[interface{}]interface{}) []ConfigProblem{
+	// 1 -> 2: use the dashed key names as the other keys
+	func(raw map[interface{}]interface{}) (problems []ConfigProblem) {
+		problems = append(problems, renameConfigKeys(raw, "recovery", "installerfslabel", "installer-filesystem-label")...)
+		problems = append(problems, renameConfigKeys(raw, "recovery", "oemlogdir", "oem-log-dir")...)
+		return problems
+	},
+}
+
+// renameConfigKeys renames the key in section of the config, and of the
+// overrides in each profile
+func renameConfigKeys(raw map[interface{}]interface{}, section, from, to string) []ConfigProblem {
+	problems := renameConfigKey(raw, "", section, from, to)
+	if profiles, ok := raw["profiles"].([]interface{}); ok {
+		for i, p := range profiles {
+			if m, ok := p.(map[interface{}]interface{}); ok {
+				problems = append(problems, renameConfigKey(m, fmt.Sprintf("profiles.%d.", i), section, from, to)...)
+			}
+		}
+	}
+	return problems
+}
+
+// renameConfigKey renames the key in section of raw, at is the key path of
+// raw, e.g. "profiles.0."
+func renameConfigKey(raw map[interface{}]interface{}, at, section, from, to string) []ConfigProblem {
+	sec, ok := raw[section].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	v, ok := sec[from]
+	if !ok {
+		return nil
+	}
+	delete(sec, from)
+
+	key := at + section + "." + from
+	if _, ok := sec[to]; ok {
+		return []ConfigProblem{{Key: key, Warning: true,
+			Message: fmt.Sprintf("'%s' is ignored, '%s' is set", configKeyDisplay(key), configKeyDisplay(at+section+"."+to))}}
+	}
+	sec[to] = v
+	return []ConfigProblem{{Key: key, Warning: true,
+		Message: fmt.Sprintf("'%s' is renamed to '%s' in schema-version 2", configKeyDisplay(key), configKeyDisplay(at+section+"."+to))}}
+}
+
+// migrateConfig upgrades the raw config to CONFIG_SCHEMA_VERSION in place,
+// and returns the warnings of the upgraded keys.
+// The newer schema than CONFIG_SCHEMA_VERSION is rejected.
+func migrateConfig(raw map[interface{}]interface{}) ([]ConfigProblem, error) {
+	version := 1
+	if v, ok := raw["schema-version"]; ok {
+		n, ok := v.(int)
+		if !ok || n < 1 {
+			return nil, fmt.Errorf("'schema-version' must be a positive integer, got %v", v)
+		}
+		version = n
+	}
+
+	if version > CONFIG_SCHEMA_VERSION {
+		return nil, fmt.Errorf("'schema-version' %d is newer than the supported version %d, please update recovery.bin", version, CONFIG_SCHEMA_VERSION)
+	}
+
+	var problems []ConfigProblem
+	for ; version < CONFIG_SCHEMA_VERSION; version++ {
+		problems = append(problems, configMigrations[version-1](raw)...)
+	}
+	raw["schema-version"] = CONFIG_SCHEMA_VERSION
+	return problems, nil
+}
+
+// parseConfig decodes config.yaml data into config after the schema migration,
+// with the profile matching this system merged
+func parseConfig(data []byte, config *ConfigRecovery) ([]ConfigProblem, error) {
+	var raw map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		raw = make(map[interface{}]interface{})
+	}
+
+	problems, err := migrateConfig(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	id := ReadSystemIdentity()
+	profile, err := applyConfigProfile(raw, id)
+	if err != nil {
+		return nil, err
+	}
+	if profile != "" {
+		log.Printf("Config profile %q matches system %+v", profile, id)
+	}
+
+	migrated, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(migrated, config); err != nil {
+		return nil, err
+	}
+	config.Profile = profile
+	return problems, nil
+}
@@ -0,0 +1,196 @@
+package rplib
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The config.yaml values could be overridden without re-imaging the recovery
+// partition, by the kernel command line:
+//
+//	recovery.cfg.<section>.<key>=<value>   e.g. recovery.cfg.configs.swapsize=2G
+//
+// or by the environment variables:
+//
+//	RECOVERY_CFG_<SECTION>_<KEY>=<value>   e.g. RECOVERY_CFG_CONFIGS_SWAPSIZE=2G
+//
+// The kernel command line wins over the environment variables.
+const (
+	CONFIG_OVERRIDE_CMDLINE_PREFIX = "recovery.cfg."
+	CONFIG_OVERRIDE_ENV_PREFIX     = "RECOVERY_CFG_"
+)
+
+// ConfigOverride is a config value overridden and where it comes from
+type ConfigOverride struct {
+	Key    string // e.g. "configs.swapsize"
+	Value  string
+	Source string // e.g. "kernel cmdline"
+}
+
+func (o ConfigOverride) String() string {
+	return fmt.Sprintf("'%s' is overridden to %q by %s", configKeyDisplay(o.Key), o.Value, o.Source)
+}
+
+// configFields maps the key paths to the settable fields, the same way as
+// yaml.v2 names the fields.
+func configFields(v reflect.Value, prefix string, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if f.Type.Kind() == reflect.Struct {
+			configFields(v.Field(i), prefix+name+".", fields)
+			continue
+		}
+		fields[prefix+name] = v.Field(i)
+	}
+}
+
+// envConfigKey converts the key path to the environment variable name
+func envConfigKey(key string) string {
+	return CONFIG_OVERRIDE_ENV_PREFIX + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// parseOverrideSize parses the size in MB, with optional M or G suffix
+func parseOverrideSize(value string) (int64, error) {
+	switch {
+	case strings.HasSuffix(value, "G"):
+		n, err := strconv.ParseInt(strings.TrimSuffix(value, "G"), 10, 64)
+		return n * 1024, err
+	case strings.HasSuffix(value, "M"):
+		return strconv.ParseInt(strings.TrimSuffix(value, "M"), 10, 64)
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func setConfigField(field reflect.Value, key, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		switch strings.ToLower(value) {
+		case "on", "yes", "y":
+			field.SetBool(true)
+		case "off", "no", "n":
+			field.SetBool(false)
+		default:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("'%s' expects a boolean, got %q", configKeyDisplay(key), value)
+			}
+			field.SetBool(b)
+		}
+	case reflect.Int, reflect.Int64:
+		var n int64
+		var err error
+		if strings.HasSuffix(key, "size") {
+			n, err = parseOverrideSize(value)
+		} else {
+			n, err = strconv.ParseInt(value, 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("'%s' expects an integer, got %q", configKeyDisplay(key), value)
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("'%s' could not be overridden", configKeyDisplay(key))
+	}
+	return nil
+}
+
+// ApplyOverrides merges the overrides from kernel cmdline and environment
+// variables (as os.Environ()) over config, and returns the applied ones. The
+// invalid overrides are not applied and returned as errs, so a stray variable
+// does not stop the recovery. The override making the config invalid is
+// reverted.
+func (config *ConfigRecovery) ApplyOverrides(cmdline string, environ []string) (overrides []ConfigOverride, errs []error) {
+	fields := make(map[string]reflect.Value)
+	configFields(reflect.ValueOf(config).Elem(), "", fields)
+
+	envKeys := make(map[string]string)
+	for key := range fields {
+		envKeys[envConfigKey(key)] = key
+	}
+
+	var requested []ConfigOverride
+	for _, env := range environ {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], CONFIG_OVERRIDE_ENV_PREFIX) {
+			continue
+		}
+		key, ok := envKeys[kv[0]]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown config key in environment %s", kv[0]))
+			continue
+		}
+		requested = append(requested, ConfigOverride{Key: key, Value: kv[1], Source: "environment " + kv[0]})
+	}
+
+	for _, arg := range strings.Fields(cmdline) {
+		if !strings.HasPrefix(arg, CONFIG_OVERRIDE_CMDLINE_PREFIX) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(arg, CONFIG_OVERRIDE_CMDLINE_PREFIX), "=", 2)
+		if len(kv) != 2 {
+			errs = append(errs, fmt.Errorf("invalid config override %q in kernel cmdline, should be %s<key>=<value>", arg, CONFIG_OVERRIDE_CMDLINE_PREFIX))
+			continue
+		}
+		if _, ok := fields[kv[0]]; !ok {
+			errs = append(errs, fmt.Errorf("unknown config key in kernel cmdline %q", arg))
+			continue
+		}
+		requested = append(requested, ConfigOverride{Key: kv[0], Value: kv[1], Source: "kernel cmdline"})
+	}
+
+	// the errors already in config.yaml are not caused by the overrides
+	base := len(configErrors(config.checkConfigs()))
+	for _, o := range requested {
+		field := fields[o.Key]
+		old := reflect.New(field.Type()).Elem()
+		old.Set(field)
+		if err := setConfigField(field, o.Key, o.Value); err != nil {
+			errs = append(errs, fmt.Errorf("%v by %s", err, o.Source))
+			continue
+		}
+		if problems := configErrors(config.checkConfigs()); len(problems) > base {
+			field.Set(old)
+			errs = append(errs, fmt.Errorf("invalid config after override by %s: %s", o.Source, strings.Join(problems, "; ")))
+			continue
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, errs
+}
+
+// configErrors returns the messages of errors (not warnings) in problems
+func configErrors(problems []ConfigProblem) (errs []string) {
+	for _, p := range problems {
+		if !p.Warning {
+			errs = append(errs, p.Message)
+		}
+	}
+	return errs
+}
+
+// ValidateOverrides checks the overrides from kernel cmdline and environment
+// variables over config.yaml data, the invalid ones are errors
+func ValidateOverrides(data []byte, cmdline string, environ []string) (problems []ConfigProblem) {
+	var config ConfigRecovery
+	if _, err := parseConfig(data, &config); err != nil {
+		// reported by ValidateConfig
+		return nil
+	}
+	_, errs := config.ApplyOverrides(cmdline, environ)
+	for _, err := range errs {
+		problems = append(problems, ConfigProblem{Message: err.Error()})
+	}
+	return problems
+}
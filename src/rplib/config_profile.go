@@ -0,0 +1,158 @@
+package rplib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The sysfs root to read the system identity, changed in tests
+var SysfsRoot = "/sys"
+
+// ConfigProfile is a per-SKU profile in config.yaml. The first profile which
+// matches the system identity is merged over the base config, e.g.
+//
+//	profiles:
+//	  - name: gateway-5000
+//	    match:
+//	      product-name: "Gateway 5000*"
+//	    configs:
+//	      swapsize: 2048
+//
+// The match rules are shell patterns, all the given rules must match.
+type ConfigProfile struct {
+	Name  string       `yaml:"name"`
+	Match ProfileMatch `yaml:"match"`
+}
+
+type ProfileMatch struct {
+	ProductName string `yaml:"product-name"`
+	BoardName   string `yaml:"board-name"`
+	SysVendor   string `yaml:"sys-vendor"`
+	Compatible  string `yaml:"compatible"` // device-tree compatible on ARM
+}
+
+// SystemIdentity is the hardware identity from DMI or device-tree
+type SystemIdentity struct {
+	ProductName string
+	BoardName   string
+	SysVendor   string
+	Compatible  []string
+}
+
+func readSysfsString(name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(SysfsRoot, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// ReadSystemIdentity reads the DMI identity from /sys/class/dmi/id, and the
+// device-tree compatible from /sys/firmware/devicetree/base/compatible.
+func ReadSystemIdentity() SystemIdentity {
+	id := SystemIdentity{
+		ProductName: readSysfsString("class/dmi/id/product_name"),
+		BoardName:   readSysfsString("class/dmi/id/board_name"),
+		SysVendor:   readSysfsString("class/dmi/id/sys_vendor"),
+	}
+	// the compatible strings are NUL separated
+	for _, c := range strings.Split(readSysfsString("firmware/devicetree/base/compatible"), "\x00") {
+		if c != "" {
+			id.Compatible = append(id.Compatible, c)
+		}
+	}
+	return id
+}
+
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// Matches tells whether all the given rules match the identity.
+// The empty rules match nothing.
+func (m *ProfileMatch) Matches(id SystemIdentity) bool {
+	if *m == (ProfileMatch{}) {
+		return false
+	}
+	if !matchPattern(m.ProductName, id.ProductName) || !matchPattern(m.BoardName, id.BoardName) || !matchPattern(m.SysVendor, id.SysVendor) {
+		return false
+	}
+	if m.Compatible == "" {
+		return true
+	}
+	for _, c := range id.Compatible {
+		if matchPattern(m.Compatible, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeConfigValue merges the profile value over the base value, the maps
+// are merged key by key and the others are replaced.
+func mergeConfigValue(base, profile interface{}) interface{} {
+	baseMap, ok1 := base.(map[interface{}]interface{})
+	profileMap, ok2 := profile.(map[interface{}]interface{})
+	if !ok1 || !ok2 {
+		return profile
+	}
+	for k, v := range profileMap {
+		baseMap[k] = mergeConfigValue(baseMap[k], v)
+	}
+	return baseMap
+}
+
+// mergeConfigProfile merges the sections of profile item over the raw config
+func mergeConfigProfile(raw map[interface{}]interface{}, item map[interface{}]interface{}) {
+	for k, v := range item {
+		if k == "name" || k == "match" {
+			continue
+		}
+		raw[k] = mergeConfigValue(raw[k], v)
+	}
+}
+
+func decodeConfigProfile(item interface{}) (map[interface{}]interface{}, ConfigProfile, error) {
+	var profile ConfigProfile
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, profile, fmt.Errorf("the profile must be a mapping, got %v", item)
+	}
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return nil, profile, err
+	}
+	return m, profile, yaml.Unmarshal(data, &profile)
+}
+
+// applyConfigProfile merges the first profile matching id over the raw
+// config, and returns its name. It returns "" if no profile matches.
+func applyConfigProfile(raw map[interface{}]interface{}, id SystemIdentity) (string, error) {
+	profiles, ok := raw["profiles"].([]interface{})
+	if !ok {
+		return "", nil
+	}
+	for i, item := range profiles {
+		m, profile, err := decodeConfigProfile(item)
+		if err != nil {
+			return "", fmt.Errorf("invalid profile #%d: %v", i, err)
+		}
+		if profile.Match.Matches(id) {
+			mergeConfigProfile(raw, m)
+			if profile.Name == "" {
+				profile.Name = fmt.Sprintf("#%d", i)
+			}
+			return profile.Name, nil
+		}
+	}
+	return "", nil
+}
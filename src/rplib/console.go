@@ -0,0 +1,56 @@
+package rplib
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The console to disable the serial console in config.yaml
+const CONSOLE_NULL = "null"
+
+// The consoles recovery.bin could prompt on, the VTs and serial ports
+var consoleNamePattern = regexp.MustCompile(`^(tty[0-9]+|ttyS[0-9]+|ttyAMA[0-9]+|ttyUSB[0-9]+)$`)
+
+// IsConsoleName tells whether name is a supported console, e.g. tty1 or ttyS0
+func IsConsoleName(name string) bool {
+	return consoleNamePattern.MatchString(name)
+}
+
+// splitConsoles splits the serial-console value, separated by spaces or commas
+func splitConsoles(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// ConsoleNames returns the consoles to prompt and mirror the log on: tty1,
+// the serial-console of config.yaml and the console= of kernel cmdline.
+// The serial-console "null" disables the serial consoles.
+func ConsoleNames(serialConsole string, cmdline string) []string {
+	names := []string{"tty1"}
+	add := func(name string) {
+		// tty0 is the foreground VT, which is tty1 in recovery
+		if name == "tty0" || !IsConsoleName(name) {
+			return
+		}
+		for _, n := range names {
+			if n == name {
+				return
+			}
+		}
+		names = append(names, name)
+	}
+
+	serials := splitConsoles(serialConsole)
+	if len(serials) == 1 && serials[0] == CONSOLE_NULL {
+		return names
+	}
+	for _, name := range serials {
+		add(name)
+	}
+	for _, arg := range strings.Fields(cmdline) {
+		if strings.HasPrefix(arg, "console=") {
+			// e.g. console=ttyS0,115200n8
+			add(strings.Split(strings.TrimPrefix(arg, "console="), ",")[0])
+		}
+	}
+	return names
+}
@@ -0,0 +1,17 @@
+package rplib_test
+
+import (
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type ConsoleSuite struct{}
+
+var _ = Suite(&ConsoleSuite{})
+
+func (s *ConsoleSuite) TestConsoleNames(c *C) {
+	c.Check(rplib.ConsoleNames("", ""), DeepEquals, []string{"tty1"})
+	c.Check(rplib.ConsoleNames("ttyS0", "quiet console=tty0 console=ttyS0,115200n8"), DeepEquals, []string{"tty1", "ttyS0"})
+	c.Check(rplib.ConsoleNames("ttyS0, ttyAMA0 ttyUSB0 lp0", "console=ttyS1,115200"), DeepEquals, []string{"tty1", "ttyS0", "ttyAMA0", "ttyUSB0", "ttyS1"})
+	c.Check(rplib.ConsoleNames("null", "console=ttyS0"), DeepEquals, []string{"tty1"})
+}
@@ -0,0 +1,77 @@
+package rplib
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The sector size of /sys/block/<disk>/size, always 512 bytes
+const SYSFS_SECTOR_SIZE = 512
+
+// DiskInfo is the disk information from sysfs
+type DiskInfo struct {
+	Model      string
+	Serial     string
+	SizeBytes  int64
+	Partitions []DiskPartition
+}
+
+type DiskPartition struct {
+	Number    int
+	Name      string // e.g. sda3
+	SizeBytes int64
+}
+
+type byPartNumber []DiskPartition
+
+func (p byPartNumber) Len() int           { return len(p) }
+func (p byPartNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPartNumber) Less(i, j int) bool { return p[i].Number < p[j].Number }
+
+func readSysfsInt(name string) int64 {
+	n, err := strconv.ParseInt(readSysfsString(name), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// ReadDiskInfo reads the model, serial, size and partitions of disk (e.g. sda) from
+// /sys/block
+func ReadDiskInfo(disk string) DiskInfo {
+	dir := filepath.Join("block", disk)
+	info := DiskInfo{
+		Model:     readSysfsString(filepath.Join(dir, "device/model")),
+		SizeBytes: readSysfsInt(filepath.Join(dir, "size")) * SYSFS_SECTOR_SIZE,
+	}
+	for _, name := range []string{"device/serial", "device/wwid"} {
+		if info.Serial = readSysfsString(filepath.Join(dir, name)); info.Serial != "" {
+			break
+		}
+	}
+	if info.Model == "" {
+		// mmc and sd cards
+		info.Model = readSysfsString(filepath.Join(dir, "device/name"))
+	}
+	if vendor := readSysfsString(filepath.Join(dir, "device/vendor")); vendor != "" && !strings.HasPrefix(info.Model, vendor) {
+		info.Model = strings.TrimSpace(vendor + " " + info.Model)
+	}
+
+	entries, _ := ioutil.ReadDir(filepath.Join(SysfsRoot, dir))
+	for _, e := range entries {
+		nr := readSysfsInt(filepath.Join(dir, e.Name(), "partition"))
+		if nr <= 0 {
+			continue
+		}
+		info.Partitions = append(info.Partitions, DiskPartition{
+			Number:    int(nr),
+			Name:      e.Name(),
+			SizeBytes: readSysfsInt(filepath.Join(dir, e.Name(), "size")) * SYSFS_SECTOR_SIZE,
+		})
+	}
+	sort.Sort(byPartNumber(info.Partitions))
+	return info
+}
@@ -0,0 +1,42 @@
+package rplib_test
+
+import (
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type DiskSuite struct{}
+
+var _ = Suite(&DiskSuite{})
+
+func (s *DiskSuite) TestReadDiskInfo(c *C) {
+	sysfs := writeSysfs(c, map[string]string{
+		"block/sda/device/model":    "Samsung SSD 860",
+		"block/sda/device/vendor":   "ATA",
+		"block/sda/device/wwid":     "t10.ATA S3Z9NB0K",
+		"block/sda/size":            "1000215216",
+		"block/sda/sda1/partition":  "1",
+		"block/sda/sda1/size":       "1536000",
+		"block/sda/sda10/partition": "10",
+		"block/sda/sda10/size":      "2048",
+		"block/sda/sda2/partition":  "2",
+		"block/sda/sda2/size":       "998676480",
+	})
+	c.Assert(os.MkdirAll(filepath.Join(sysfs, "block/sda/queue"), 0755), IsNil)
+	orig := rplib.SysfsRoot
+	rplib.SysfsRoot = sysfs
+	defer func() { rplib.SysfsRoot = orig }()
+
+	info := rplib.ReadDiskInfo("sda")
+	c.Check(info.Model, Equals, "ATA Samsung SSD 860")
+	c.Check(info.Serial, Equals, "t10.ATA S3Z9NB0K")
+	c.Check(info.SizeBytes, Equals, int64(1000215216*512))
+	c.Check(info.Partitions, DeepEquals, []rplib.DiskPartition{
+		{Number: 1, Name: "sda1", SizeBytes: 1536000 * 512},
+		{Number: 2, Name: "sda2", SizeBytes: 998676480 * 512},
+		{Number: 10, Name: "sda10", SizeBytes: 2048 * 512},
+	})
+}
@@ -0,0 +1,119 @@
+package rplib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// The early log kept in memory, the more spills to a file
+const EARLY_LOG_MAX_MEMORY = 1024 * 1024
+
+// EarlyLog keeps the log from the process start until the persistent log is
+// available. The log over maxMemory bytes spills to a file in spillDir, and
+// is dropped only if the spill file could not be written.
+type EarlyLog struct {
+	mu        sync.Mutex
+	maxMemory int
+	spillDir  string
+	buf       bytes.Buffer
+	spill     *os.File
+	dropped   int
+	out       io.Writer // the persistent log after FlushTo
+}
+
+// NewEarlyLog returns the early log keeping maxMemory bytes in memory
+func NewEarlyLog(maxMemory int, spillDir string) *EarlyLog {
+	return &EarlyLog{maxMemory: maxMemory, spillDir: spillDir}
+}
+
+// write must be called with the lock held
+func (l *EarlyLog) write(p []byte) error {
+	if l.out != nil {
+		_, err := l.out.Write(p)
+		return err
+	}
+	if l.spill == nil && l.buf.Len()+len(p) > l.maxMemory {
+		f, err := ioutil.TempFile(l.spillDir, "recovery-early-log-")
+		if err != nil {
+			l.dropped += len(p)
+			return nil
+		}
+		l.spill = f
+		if _, err := l.buf.WriteTo(f); err != nil {
+			return err
+		}
+	}
+	if l.spill != nil {
+		_, err := l.spill.Write(p)
+		return err
+	}
+	l.buf.Write(p)
+	return nil
+}
+
+func (l *EarlyLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(p), l.write(p)
+}
+
+// WriteEntry writes the entry as WriterSink in all levels
+func (l *EarlyLog) WriteEntry(e LogEntry) error {
+	return WriterSink{W: l, Level: LevelDebug}.WriteEntry(e)
+}
+
+// Flushed tells whether the early log is flushed to the persistent log
+func (l *EarlyLog) Flushed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out != nil
+}
+
+// CopyTo writes the early log kept so far to w, e.g. for the log bundle
+// when the persistent log is not available
+func (l *EarlyLog) CopyTo(w io.Writer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.spill != nil {
+		if _, err := io.Copy(w, io.NewSectionReader(l.spill, 0, 1<<62)); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(l.buf.Bytes())
+	return err
+}
+
+// FlushTo writes the early log to w, and the log after goes to w directly.
+// The spill file is removed.
+func (l *EarlyLog) FlushTo(w io.Writer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.spill != nil {
+		defer func() {
+			l.spill.Close()
+			os.Remove(l.spill.Name())
+			l.spill = nil
+		}()
+		if _, err := l.spill.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, l.spill); err != nil {
+			return err
+		}
+	}
+	if _, err := l.buf.WriteTo(w); err != nil {
+		return err
+	}
+	if l.dropped > 0 {
+		fmt.Fprintf(w, "... %d bytes of the early log are dropped\n", l.dropped)
+		l.dropped = 0
+	}
+	l.out = w
+	return nil
+}
@@ -0,0 +1,65 @@
+package rplib_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type EarlyLogSuite struct{}
+
+var _ = Suite(&EarlyLogSuite{})
+
+func (s *EarlyLogSuite) TestFlushTo(c *C) {
+	early := rplib.NewEarlyLog(1024, c.MkDir())
+	logger := rplib.NewLogger(early)
+	logger.Debug("config parsed")
+	logger.Info("partitions found")
+	c.Check(early.Flushed(), Equals, false)
+
+	var copied bytes.Buffer
+	c.Assert(early.CopyTo(&copied), IsNil)
+	c.Check(stripTime(copied.String()), Equals, "DEBUG config parsed\nINFO partitions found")
+
+	var out bytes.Buffer
+	c.Assert(early.FlushTo(&out), IsNil)
+	c.Check(early.Flushed(), Equals, true)
+	logger.Info("writable mounted")
+	c.Check(stripTime(out.String()), Equals, "DEBUG config parsed\nINFO partitions found\nINFO writable mounted")
+}
+
+func (s *EarlyLogSuite) TestSpill(c *C) {
+	dir := c.MkDir()
+	early := rplib.NewEarlyLog(100, dir)
+	line := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 5; i++ {
+		early.Write([]byte(line))
+	}
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Check(files, HasLen, 1)
+
+	var copied bytes.Buffer
+	c.Assert(early.CopyTo(&copied), IsNil)
+	c.Check(copied.String(), Equals, strings.Repeat(line, 5))
+
+	var out bytes.Buffer
+	c.Assert(early.FlushTo(&out), IsNil)
+	c.Check(out.String(), Equals, strings.Repeat(line, 5))
+	files, err = ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Check(files, HasLen, 0)
+}
+
+func (s *EarlyLogSuite) TestDropped(c *C) {
+	early := rplib.NewEarlyLog(10, "/nonexistent")
+	early.Write([]byte("12345\n"))
+	early.Write([]byte("1234567890\n"))
+
+	var out bytes.Buffer
+	c.Assert(early.FlushTo(&out), IsNil)
+	c.Check(out.String(), Equals, "12345\n... 11 bytes of the early log are dropped\n")
+}
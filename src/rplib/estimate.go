@@ -0,0 +1,80 @@
+package rplib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The throughput to estimate the restore duration without any previous restore
+const DEFAULT_RESTORE_BYTES_PER_SEC = 20 * 1024 * 1024
+
+// The previous restores used to estimate the duration
+const RESTORE_DURATIONS_KEEP = 5
+
+// RestoreDuration is a measured restore, stored one per line as
+// "<unix time> <payload bytes> <seconds>"
+type RestoreDuration struct {
+	Time         time.Time
+	PayloadBytes int64
+	Duration     time.Duration
+}
+
+// ReadRestoreDurations reads the measured restores, the broken lines are skipped
+func ReadRestoreDurations(path string) []RestoreDuration {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var durations []RestoreDuration
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		t, err1 := strconv.ParseInt(fields[0], 10, 64)
+		size, err2 := strconv.ParseInt(fields[1], 10, 64)
+		sec, err3 := strconv.ParseFloat(fields[2], 64)
+		if err1 != nil || err2 != nil || err3 != nil || sec <= 0 {
+			continue
+		}
+		durations = append(durations, RestoreDuration{time.Unix(t, 0), size, time.Duration(sec * float64(time.Second))})
+	}
+	return durations
+}
+
+// AppendRestoreDuration appends the measured restore, and keeps the last
+// RESTORE_DURATIONS_KEEP ones
+func AppendRestoreDuration(path string, d RestoreDuration) error {
+	durations := append(ReadRestoreDurations(path), d)
+	if len(durations) > RESTORE_DURATIONS_KEEP {
+		durations = durations[len(durations)-RESTORE_DURATIONS_KEEP:]
+	}
+	var lines []string
+	for _, d := range durations {
+		lines = append(lines, fmt.Sprintf("%d %d %.1f", d.Time.Unix(), d.PayloadBytes, d.Duration.Seconds()))
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// EstimateRestoreDuration estimates the duration to restore the payload by the
+// average throughput of previous restores
+func EstimateRestoreDuration(previous []RestoreDuration, payloadBytes int64) time.Duration {
+	var bytes int64
+	var elapsed time.Duration
+	for _, d := range previous {
+		bytes += d.PayloadBytes
+		elapsed += d.Duration
+	}
+	if bytes <= 0 || elapsed <= 0 {
+		return time.Duration(float64(payloadBytes) / DEFAULT_RESTORE_BYTES_PER_SEC * float64(time.Second))
+	}
+	return time.Duration(float64(payloadBytes) / float64(bytes) * float64(elapsed))
+}
@@ -0,0 +1,32 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type EstimateSuite struct{}
+
+var _ = Suite(&EstimateSuite{})
+
+func (s *EstimateSuite) TestRestoreDurations(c *C) {
+	path := filepath.Join(c.MkDir(), "restore-durations")
+	c.Assert(ioutil.WriteFile(path, []byte("broken line\n"), 0644), IsNil)
+	for i := 0; i < 7; i++ {
+		d := rplib.RestoreDuration{Time: time.Unix(int64(1000+i), 0), PayloadBytes: 1000, Duration: 10 * time.Second}
+		c.Assert(rplib.AppendRestoreDuration(path, d), IsNil)
+	}
+
+	durations := rplib.ReadRestoreDurations(path)
+	c.Assert(durations, HasLen, rplib.RESTORE_DURATIONS_KEEP)
+	c.Check(durations[0].Time.Unix(), Equals, int64(1002))
+	c.Check(durations[4].Duration, Equals, 10*time.Second)
+
+	// 100 bytes per second
+	c.Check(rplib.EstimateRestoreDuration(durations, 3000), Equals, 30*time.Second)
+	c.Check(rplib.EstimateRestoreDuration(nil, 40*1024*1024), Equals, 2*time.Second)
+}
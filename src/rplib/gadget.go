@@ -0,0 +1,427 @@
+package rplib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The gadget.yaml size/offset semantics follow snapd/gadget
+const (
+	GadgetSchemaGPT = "gpt"
+	GadgetSchemaMBR = "mbr"
+
+	GadgetRoleMBR        = "mbr"
+	GadgetRoleSystemBoot = "system-boot"
+	GadgetRoleSystemData = "system-data"
+
+	GadgetTypeBare = "bare"
+	GadgetTypeMBR  = "mbr"
+
+	// The MBR structure is always 440 bytes at offset 0
+	GadgetMBRSize = 440
+	// Structures without offset start at 1MiB at least, leaving space for partition table
+	GadgetNonMBRStartOffset = 1024 * 1024
+	// The offset-write value is in 512 bytes sector
+	GadgetSectorSize = 512
+)
+
+// ParseGadgetSize parses the gadget.yaml size/offset string.
+// It accepts plain bytes, or with "M"(MiB), "G"(GiB) suffix.
+func ParseGadgetSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	unit := int64(1)
+	switch s[len(s)-1] {
+	case 'M':
+		unit = 1024 * 1024
+		s = s[:len(s)-1]
+	case 'G':
+		unit = 1024 * 1024 * 1024
+		s = s[:len(s)-1]
+	}
+
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse size %q: %v", s, err)
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("negative size %q", s)
+	}
+	return size * unit, nil
+}
+
+// ParseGadgetOffsetWrite parses the offset-write string, which is
+// "[<structure name>+]<offset>". The returned name is empty if the offset
+// is absolute from the beginning of the volume.
+func ParseGadgetOffsetWrite(s string) (name string, offset int64, err error) {
+	off := strings.TrimSpace(s)
+	if idx := strings.LastIndex(off, "+"); idx != -1 {
+		name = off[:idx]
+		off = off[idx+1:]
+		if name == "" {
+			return "", 0, fmt.Errorf("invalid offset-write %q: missing structure name", s)
+		}
+	}
+	offset, err = ParseGadgetSize(off)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid offset-write: %v", err)
+	}
+	return name, offset, nil
+}
+
+// EffectiveRole returns the structure role, the legacy "type: mbr" and
+// "filesystem-label: system-boot" are treated as roles as snapd does.
+func (st *VolumeStructure) EffectiveRole() string {
+	if st.Role != "" {
+		return st.Role
+	}
+	if st.Type == GadgetTypeMBR {
+		return GadgetRoleMBR
+	}
+	if st.Label == GadgetRoleSystemBoot {
+		return GadgetRoleSystemBoot
+	}
+	return ""
+}
+
+// IsPartition returns true if the structure is an entry in partition table
+func (st *VolumeStructure) IsPartition() bool {
+	return st.Type != GadgetTypeBare && st.EffectiveRole() != GadgetRoleMBR
+}
+
+// GPTType returns the GPT partition type GUID of structure.
+// The type is either a GUID, or the hybrid "<MBR type>,<GUID>".
+func (st *VolumeStructure) GPTType() string {
+	if idx := strings.Index(st.Type, ","); idx != -1 {
+		return st.Type[idx+1:]
+	}
+	if len(st.Type) == 36 {
+		return st.Type
+	}
+	return ""
+}
+
+// MBRType returns the MBR partition type code of structure.
+func (st *VolumeStructure) MBRType() string {
+	if idx := strings.Index(st.Type, ","); idx != -1 {
+		return st.Type[:idx]
+	}
+	if len(st.Type) == 2 {
+		return st.Type
+	}
+	return ""
+}
+
+// LaidOutStructure is a VolumeStructure with resolved position in volume
+type LaidOutStructure struct {
+	VolumeStructure
+	// Index of the structure in gadget.yaml
+	Index int
+	// PartitionNumber is the number in partition table, 0 if not a partition
+	PartitionNumber int
+	// StartOffset and Size in bytes
+	StartOffset int64
+	Size        int64
+	// AbsoluteOffsetWrite is the location to write the structure offset to, -1 if not set
+	AbsoluteOffsetWrite int64
+}
+
+// End returns the first byte after the structure
+func (ls *LaidOutStructure) End() int64 {
+	return ls.StartOffset + ls.Size
+}
+
+// LaidOutContent is a raw image content with resolved position in volume
+type LaidOutContent struct {
+	VolumeContent
+	StartOffset         int64
+	Size                int64
+	AbsoluteOffsetWrite int64
+}
+
+type byStartOffset []*LaidOutStructure
+
+func (b byStartOffset) Len() int           { return len(b) }
+func (b byStartOffset) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byStartOffset) Less(i, j int) bool { return b[i].StartOffset < b[j].StartOffset }
+
+// EffectiveSchema returns the partition table schema of volume, "gpt" by default
+func (vol *GadgetVolume) EffectiveSchema() string {
+	if vol.Schema == "" {
+		return GadgetSchemaGPT
+	}
+	return vol.Schema
+}
+
+func resolveOffsetWrite(ow string, byName map[string]*LaidOutStructure) (int64, error) {
+	if ow == "" {
+		return -1, nil
+	}
+	name, offset, err := ParseGadgetOffsetWrite(ow)
+	if err != nil {
+		return -1, err
+	}
+	if name == "" {
+		return offset, nil
+	}
+	st, ok := byName[name]
+	if !ok {
+		return -1, fmt.Errorf("offset-write refers to unknown structure %q", name)
+	}
+	return st.StartOffset + offset, nil
+}
+
+// Layout resolves the order, offsets and sizes of the volume structures.
+// A structure without offset is placed right after the previous one, but
+// never earlier than 1MiB unless it is the MBR.
+func (vol *GadgetVolume) Layout() ([]LaidOutStructure, error) {
+	layout := make([]LaidOutStructure, 0, len(vol.Structure))
+	byName := make(map[string]*LaidOutStructure)
+	var previousEnd int64
+	partNr := 0
+
+	for i, st := range vol.Structure {
+		ls := LaidOutStructure{VolumeStructure: st, Index: i, AbsoluteOffsetWrite: -1}
+
+		if st.EffectiveRole() == GadgetRoleMBR {
+			if st.Offset != "" {
+				if off, err := ParseGadgetSize(st.Offset); err != nil || off != 0 {
+					return nil, fmt.Errorf("structure #%d (%q): mbr must be at offset 0", i, st.Name)
+				}
+			}
+			ls.StartOffset = 0
+			ls.Size = GadgetMBRSize
+		} else {
+			if st.Size == "" {
+				return nil, fmt.Errorf("structure #%d (%q): missing size", i, st.Name)
+			}
+			size, err := ParseGadgetSize(st.Size)
+			if err != nil {
+				return nil, fmt.Errorf("structure #%d (%q): %v", i, st.Name, err)
+			}
+			ls.Size = size
+
+			if st.Offset != "" {
+				if ls.StartOffset, err = ParseGadgetSize(st.Offset); err != nil {
+					return nil, fmt.Errorf("structure #%d (%q): invalid offset: %v", i, st.Name, err)
+				}
+			} else if previousEnd < GadgetNonMBRStartOffset {
+				ls.StartOffset = GadgetNonMBRStartOffset
+			} else {
+				ls.StartOffset = previousEnd
+			}
+		}
+
+		if ls.IsPartition() {
+			partNr++
+			ls.PartitionNumber = partNr
+		}
+		previousEnd = ls.End()
+		layout = append(layout, ls)
+	}
+
+	for i := range layout {
+		if layout[i].Name != "" {
+			byName[layout[i].Name] = &layout[i]
+		}
+	}
+
+	// offset-write may refer to any structure, resolve after all offsets known
+	for i := range layout {
+		ow, err := resolveOffsetWrite(layout[i].OffsetWrite, byName)
+		if err != nil {
+			return nil, fmt.Errorf("structure #%d (%q): %v", layout[i].Index, layout[i].Name, err)
+		}
+		layout[i].AbsoluteOffsetWrite = ow
+	}
+
+	// Check overlapping
+	sorted := make([]*LaidOutStructure, len(layout))
+	for i := range layout {
+		sorted[i] = &layout[i]
+	}
+	sort.Stable(byStartOffset(sorted))
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].StartOffset < sorted[i-1].End() {
+			return nil, fmt.Errorf("structure #%d (%q) overlaps with structure #%d (%q)",
+				sorted[i].Index, sorted[i].Name, sorted[i-1].Index, sorted[i-1].Name)
+		}
+	}
+
+	// system-data is created as the last partition and enlarged to the end
+	// of disk, the partition numbers after it would be taken by parted
+	for i := range layout {
+		if layout[i].EffectiveRole() != GadgetRoleSystemData {
+			continue
+		}
+		if last := sorted[len(sorted)-1]; last.Index != layout[i].Index || i != len(layout)-1 {
+			return nil, fmt.Errorf("structure #%d (%q): system-data must be the last structure", layout[i].Index, layout[i].Name)
+		}
+	}
+
+	return layout, nil
+}
+
+// BootVolume returns the volume which the system boots from.
+// It is the only volume with bootloader set, or the only volume.
+func (gadgetInfo *GadgetInfo) BootVolume() (string, *GadgetVolume, error) {
+	if gadgetInfo == nil {
+		return "", nil, fmt.Errorf("nil gadgetInfo")
+	}
+
+	var names []string
+	for name := range gadgetInfo.Volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 1 {
+		v := gadgetInfo.Volumes[names[0]]
+		return names[0], &v, nil
+	}
+
+	var boot []string
+	for _, name := range names {
+		if gadgetInfo.Volumes[name].Bootloader != "" {
+			boot = append(boot, name)
+		}
+	}
+	switch len(boot) {
+	case 0:
+		return "", nil, fmt.Errorf("no boot volume found in gadget")
+	case 1:
+		v := gadgetInfo.Volumes[boot[0]]
+		return boot[0], &v, nil
+	}
+	return "", nil, fmt.Errorf("more than one volume declares bootloader: %s", strings.Join(boot, ", "))
+}
+
+// FindStructureByLabel finds the structure by filesystem-label in laid out structures
+func FindStructureByLabel(layout []LaidOutStructure, label string) *LaidOutStructure {
+	for i := range layout {
+		if layout[i].Label == label {
+			return &layout[i]
+		}
+	}
+	return nil
+}
+
+// LayoutContent resolves the position of raw images in structure.
+// The image without size takes the size of image file in imageDir.
+func (ls *LaidOutStructure) LayoutContent(layout []LaidOutStructure, imageDir string) ([]LaidOutContent, error) {
+	byName := make(map[string]*LaidOutStructure)
+	for i := range layout {
+		if layout[i].Name != "" {
+			byName[layout[i].Name] = &layout[i]
+		}
+	}
+
+	var contents []LaidOutContent
+	previousEnd := ls.StartOffset
+	for _, c := range ls.Content {
+		if c.Image == "" {
+			continue
+		}
+		lc := LaidOutContent{VolumeContent: c, StartOffset: previousEnd}
+
+		var err error
+		if c.Offset != "" {
+			var off int64
+			if off, err = ParseGadgetSize(c.Offset); err != nil {
+				return nil, fmt.Errorf("image %q: invalid offset: %v", c.Image, err)
+			}
+			lc.StartOffset = ls.StartOffset + off
+		}
+
+		st, err := os.Stat(filepath.Join(imageDir, c.Image))
+		if err != nil {
+			return nil, err
+		}
+		lc.Size = st.Size()
+		if c.Size != "" {
+			var size int64
+			if size, err = ParseGadgetSize(c.Size); err != nil {
+				return nil, fmt.Errorf("image %q: invalid size: %v", c.Image, err)
+			}
+			if lc.Size > size {
+				return nil, fmt.Errorf("image %q is larger than its size %d", c.Image, size)
+			}
+			lc.Size = size
+		}
+		if lc.StartOffset+lc.Size > ls.End() {
+			return nil, fmt.Errorf("image %q does not fit in structure %q", c.Image, ls.Name)
+		}
+
+		if lc.AbsoluteOffsetWrite, err = resolveOffsetWrite(c.OffsetWrite, byName); err != nil {
+			return nil, fmt.Errorf("image %q: %v", c.Image, err)
+		}
+		previousEnd = lc.StartOffset + lc.Size
+		contents = append(contents, lc)
+	}
+	return contents, nil
+}
+
+// writeOffsetWrite writes the sector of offset as 32 bits little endian at location
+func writeOffsetWrite(dev *os.File, location int64, offset int64) error {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(offset/GadgetSectorSize))
+	_, err := dev.WriteAt(buf, location)
+	return err
+}
+
+// WriteRawContent writes the raw images and offset-write of structure into
+// device at the gadget.yaml offsets. The images are read from imageDir.
+func WriteRawContent(device string, layout []LaidOutStructure, ls *LaidOutStructure, imageDir string) error {
+	contents, err := ls.LayoutContent(layout, imageDir)
+	if err != nil {
+		return err
+	}
+	if len(contents) == 0 && ls.AbsoluteOffsetWrite == -1 {
+		return nil
+	}
+
+	dev, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	for _, c := range contents {
+		log.Printf("Write %s to %s at offset %d", c.Image, device, c.StartOffset)
+		img, err := os.Open(filepath.Join(imageDir, c.Image))
+		if err != nil {
+			return err
+		}
+		if _, err = dev.Seek(c.StartOffset, os.SEEK_SET); err == nil {
+			_, err = io.Copy(dev, img)
+		}
+		img.Close()
+		if err != nil {
+			return err
+		}
+
+		if c.AbsoluteOffsetWrite != -1 {
+			if err := writeOffsetWrite(dev, c.AbsoluteOffsetWrite, c.StartOffset); err != nil {
+				return err
+			}
+		}
+	}
+
+	if ls.AbsoluteOffsetWrite != -1 {
+		if err := writeOffsetWrite(dev, ls.AbsoluteOffsetWrite, ls.StartOffset); err != nil {
+			return err
+		}
+	}
+
+	return dev.Sync()
+}
@@ -0,0 +1,221 @@
+package rplib_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type GadgetSuite struct{}
+
+var _ = Suite(&GadgetSuite{})
+
+func (s *GadgetSuite) TestParseGadgetSize(c *C) {
+	for _, t := range []struct {
+		in   string
+		size int64
+	}{
+		{"440", 440},
+		{"1M", 1024 * 1024},
+		{"2G", 2 * 1024 * 1024 * 1024},
+	} {
+		size, err := rplib.ParseGadgetSize(t.in)
+		c.Assert(err, IsNil)
+		c.Check(size, Equals, t.size)
+	}
+
+	_, err := rplib.ParseGadgetSize("1K")
+	c.Check(err, NotNil)
+	_, err = rplib.ParseGadgetSize("")
+	c.Check(err, NotNil)
+}
+
+func (s *GadgetSuite) TestParseGadgetOffsetWrite(c *C) {
+	name, offset, err := rplib.ParseGadgetOffsetWrite("mbr+92")
+	c.Assert(err, IsNil)
+	c.Check(name, Equals, "mbr")
+	c.Check(offset, Equals, int64(92))
+
+	name, offset, err = rplib.ParseGadgetOffsetWrite("1M")
+	c.Assert(err, IsNil)
+	c.Check(name, Equals, "")
+	c.Check(offset, Equals, int64(1024*1024))
+
+	_, _, err = rplib.ParseGadgetOffsetWrite("+92")
+	c.Check(err, NotNil)
+}
+
+func (s *GadgetSuite) TestLayout(c *C) {
+	var gi rplib.GadgetInfo
+	err := gi.Load("test_data/gadget.yaml")
+	c.Assert(err, IsNil)
+
+	name, vol, err := gi.BootVolume()
+	c.Assert(err, IsNil)
+	c.Check(name, Equals, "pc")
+	c.Check(vol.EffectiveSchema(), Equals, rplib.GadgetSchemaGPT)
+
+	layout, err := vol.Layout()
+	c.Assert(err, IsNil)
+	c.Assert(layout, HasLen, 4)
+
+	// mbr
+	c.Check(layout[0].EffectiveRole(), Equals, rplib.GadgetRoleMBR)
+	c.Check(layout[0].PartitionNumber, Equals, 0)
+	c.Check(layout[0].StartOffset, Equals, int64(0))
+	c.Check(layout[0].Size, Equals, int64(440))
+
+	// BIOS Boot
+	c.Check(layout[1].PartitionNumber, Equals, 1)
+	c.Check(layout[1].StartOffset, Equals, int64(1024*1024))
+	c.Check(layout[1].AbsoluteOffsetWrite, Equals, int64(92))
+	c.Check(layout[1].GPTType(), Equals, "21686148-6449-6E6F-744E-656564454649")
+	c.Check(layout[1].MBRType(), Equals, "DA")
+
+	// recovery follows BIOS Boot
+	reco := rplib.FindStructureByLabel(layout, "ESP")
+	c.Assert(reco, NotNil)
+	c.Check(reco.PartitionNumber, Equals, 2)
+	c.Check(reco.StartOffset, Equals, int64(2*1024*1024))
+	c.Check(reco.Size, Equals, int64(768*1024*1024))
+
+	// system-boot
+	c.Check(layout[3].EffectiveRole(), Equals, rplib.GadgetRoleSystemBoot)
+	c.Check(layout[3].PartitionNumber, Equals, 3)
+	c.Check(layout[3].StartOffset, Equals, int64(770*1024*1024))
+}
+
+func (s *GadgetSuite) TestBootVolume(c *C) {
+	for _, t := range []struct {
+		volumes map[string]rplib.GadgetVolume
+		name    string
+		err     string
+	}{
+		{map[string]rplib.GadgetVolume{"pc": {}}, "pc", ""},
+		{map[string]rplib.GadgetVolume{"a": {}, "b": {Bootloader: "grub"}, "c": {}}, "b", ""},
+		{map[string]rplib.GadgetVolume{"a": {}, "b": {}}, "", "no boot volume found in gadget"},
+		{map[string]rplib.GadgetVolume{"c": {Bootloader: "u-boot"}, "a": {Bootloader: "grub"}, "b": {}}, "", "more than one volume declares bootloader: a, c"},
+	} {
+		gi := rplib.GadgetInfo{Volumes: t.volumes}
+		name, _, err := gi.BootVolume()
+		if t.err != "" {
+			c.Check(err, ErrorMatches, t.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(name, Equals, t.name)
+	}
+}
+
+func (s *GadgetSuite) TestLayoutOverlap(c *C) {
+	vol := rplib.GadgetVolume{
+		Structure: []rplib.VolumeStructure{
+			{Name: "a", Offset: "1M", Size: "2M", Type: "bare"},
+			{Name: "b", Offset: "2M", Size: "1M", Type: "bare"},
+		},
+	}
+	_, err := vol.Layout()
+	c.Check(err, ErrorMatches, `structure #1 \("b"\) overlaps with structure #0 \("a"\)`)
+}
+
+func (s *GadgetSuite) TestLayoutSystemDataNotLast(c *C) {
+	for _, structure := range [][]rplib.VolumeStructure{
+		// a partition after writable in gadget.yaml
+		{
+			{Name: "writable", Role: "system-data", Size: "1G"},
+			{Name: "extra", Size: "16M"},
+		},
+		// a partition after writable on disk
+		{
+			{Name: "writable", Role: "system-data", Offset: "1M", Size: "1G"},
+			{Name: "extra", Offset: "2G", Size: "16M"},
+		},
+		// a raw image after writable on disk
+		{
+			{Name: "writable", Role: "system-data", Offset: "1M", Size: "1G"},
+			{Name: "blob", Offset: "2G", Size: "1M", Type: "bare"},
+		},
+	} {
+		vol := rplib.GadgetVolume{Structure: structure}
+		_, err := vol.Layout()
+		c.Check(err, ErrorMatches, `structure #0 \("writable"\): system-data must be the last structure`)
+	}
+
+	vol := rplib.GadgetVolume{
+		Structure: []rplib.VolumeStructure{
+			{Name: "extra", Offset: "2G", Size: "16M"},
+			{Name: "writable", Role: "system-data", Offset: "1M", Size: "1G"},
+		},
+	}
+	_, err := vol.Layout()
+	c.Check(err, ErrorMatches, `structure #1 \("writable"\): system-data must be the last structure`)
+}
+
+func (s *GadgetSuite) TestLayoutUnknownOffsetWrite(c *C) {
+	vol := rplib.GadgetVolume{
+		Structure: []rplib.VolumeStructure{
+			{Name: "a", Size: "1M", Type: "bare", OffsetWrite: "foo+92"},
+		},
+	}
+	_, err := vol.Layout()
+	c.Check(err, ErrorMatches, `.*unknown structure "foo"`)
+}
+
+func (s *GadgetSuite) TestWriteRawContent(c *C) {
+	imageDir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(imageDir, "pc-boot.img"), []byte("boot"), 0644)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(imageDir, "pc-core.img"), []byte("core"), 0644)
+	c.Assert(err, IsNil)
+
+	device := filepath.Join(c.MkDir(), "disk.img")
+	err = ioutil.WriteFile(device, make([]byte, 3*1024*1024), 0644)
+	c.Assert(err, IsNil)
+
+	vol := rplib.GadgetVolume{
+		Structure: []rplib.VolumeStructure{
+			{Name: "mbr", Type: "mbr", Size: "440",
+				Content: []rplib.VolumeContent{{Image: "pc-boot.img"}}},
+			{Name: "BIOS Boot", Type: "DA,21686148-6449-6E6F-744E-656564454649", Size: "1M", Offset: "1M", OffsetWrite: "mbr+92",
+				Content: []rplib.VolumeContent{{Image: "pc-core.img", Offset: "512"}}},
+		},
+	}
+	layout, err := vol.Layout()
+	c.Assert(err, IsNil)
+	for i := range layout {
+		err = rplib.WriteRawContent(device, layout, &layout[i], imageDir)
+		c.Assert(err, IsNil)
+	}
+
+	data, err := ioutil.ReadFile(device)
+	c.Assert(err, IsNil)
+	c.Check(string(data[0:4]), Equals, "boot")
+	c.Check(string(data[1024*1024+512:1024*1024+516]), Equals, "core")
+	// the BIOS Boot start sector is written in mbr
+	c.Check(binary.LittleEndian.Uint32(data[92:96]), Equals, uint32(1024*1024/512))
+}
+
+func (s *GadgetSuite) TestWriteRawContentTooLarge(c *C) {
+	imageDir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(imageDir, "spl.img"), make([]byte, 1024), 0644)
+	c.Assert(err, IsNil)
+	device := filepath.Join(c.MkDir(), "disk.img")
+	f, err := os.Create(device)
+	c.Assert(err, IsNil)
+	f.Close()
+
+	vol := rplib.GadgetVolume{
+		Structure: []rplib.VolumeStructure{
+			{Name: "spl", Type: "bare", Size: "512",
+				Content: []rplib.VolumeContent{{Image: "spl.img"}}},
+		},
+	}
+	layout, err := vol.Layout()
+	c.Assert(err, IsNil)
+	err = rplib.WriteRawContent(device, layout, &layout[0], imageDir)
+	c.Check(err, ErrorMatches, `image "spl.img" does not fit in structure "spl"`)
+}
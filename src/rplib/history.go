@@ -0,0 +1,105 @@
+package rplib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The results of restore in history
+const (
+	HISTORY_SUCCESS = "success"
+	HISTORY_FAILURE = "failure"
+	HISTORY_PARTIAL = "partial" // only the steps selected by the run command
+)
+
+// HistoryEntry is a recovery run, stored one per line as
+// "<unix time> <recovery type> <result> <seconds> <image version>"
+type HistoryEntry struct {
+	Time     time.Time
+	Type     string
+	Result   string
+	Duration time.Duration
+	Image    string
+}
+
+func (e HistoryEntry) String() string {
+	image := strings.Join(strings.Fields(e.Image), " ")
+	if image == "" {
+		image = "unknown"
+	}
+	return fmt.Sprintf("%d %s %s %.0f %s", e.Time.Unix(), e.Type, e.Result, e.Duration.Seconds(), image)
+}
+
+// ReadHistory reads the history, the broken lines are skipped
+func ReadHistory(path string) ([]HistoryEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 5)
+		if len(fields) != 5 {
+			continue
+		}
+		t, err1 := strconv.ParseInt(fields[0], 10, 64)
+		sec, err2 := strconv.ParseFloat(fields[3], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		entries = append(entries, HistoryEntry{time.Unix(t, 0), fields[1], fields[2], time.Duration(sec * float64(time.Second)), fields[4]})
+	}
+	return entries, scanner.Err()
+}
+
+// AppendHistory appends the entry, the existing entries are never rewritten
+func AppendHistory(path string, e HistoryEntry) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, e); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HistoryCounts counts the entries by "<recovery type> <result>"
+func HistoryCounts(entries []HistoryEntry) map[string]int {
+	counts := make(map[string]int)
+	for _, e := range entries {
+		counts[e.Type+" "+e.Result]++
+	}
+	return counts
+}
+
+// WriteHistory prints the entries and the counters for human
+func WriteHistory(w io.Writer, entries []HistoryEntry) {
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s  %-18s  %-7s  %8v  %s\n", e.Time.UTC().Format("2006-01-02 15:04:05"), e.Type, e.Result, e.Duration, e.Image)
+	}
+	counts := HistoryCounts(entries)
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "\nTotal: %d\n", len(entries))
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s: %d\n", k, counts[k])
+	}
+}
@@ -0,0 +1,55 @@
+package rplib_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type HistorySuite struct{}
+
+var _ = Suite(&HistorySuite{})
+
+func (s *HistorySuite) TestHistory(c *C) {
+	path := filepath.Join(c.MkDir(), "restore-history")
+	c.Assert(ioutil.WriteFile(path, []byte("broken line\n"), 0644), IsNil)
+	entries := []rplib.HistoryEntry{
+		{Time: time.Unix(1000, 0), Type: "factory_install", Result: rplib.HISTORY_SUCCESS, Duration: 600 * time.Second, Image: "Ubuntu 20.04 \"Focal\"\tOEM"},
+		{Time: time.Unix(2000, 0), Type: "factory_restore", Result: rplib.HISTORY_FAILURE, Duration: 30 * time.Second},
+		{Time: time.Unix(3000, 0), Type: "factory_restore", Result: rplib.HISTORY_SUCCESS, Duration: 500 * time.Second, Image: "20210101"},
+	}
+	for _, e := range entries {
+		c.Assert(rplib.AppendHistory(path, e), IsNil)
+	}
+
+	read, err := rplib.ReadHistory(path)
+	c.Assert(err, IsNil)
+	c.Assert(read, HasLen, 3)
+	c.Check(read[0].Time.Unix(), Equals, int64(1000))
+	c.Check(read[0].Type, Equals, "factory_install")
+	c.Check(read[0].Duration, Equals, 600*time.Second)
+	c.Check(read[0].Image, Equals, "Ubuntu 20.04 \"Focal\" OEM")
+	c.Check(read[1].Result, Equals, rplib.HISTORY_FAILURE)
+	c.Check(read[1].Image, Equals, "unknown")
+
+	c.Check(rplib.HistoryCounts(read), DeepEquals, map[string]int{
+		"factory_install success": 1,
+		"factory_restore failure": 1,
+		"factory_restore success": 1,
+	})
+
+	var out bytes.Buffer
+	rplib.WriteHistory(&out, read)
+	c.Check(strings.Count(out.String(), "\n"), Equals, 3+2+3)
+	c.Check(out.String(), Matches, "(?s).*Total: 3\n  factory_install success: 1\n  factory_restore failure: 1\n  factory_restore success: 1\n")
+}
+
+func (s *HistorySuite) TestReadHistoryNotExist(c *C) {
+	_, err := rplib.ReadHistory(filepath.Join(c.MkDir(), "restore-history"))
+	c.Check(err, NotNil)
+}
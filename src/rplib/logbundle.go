@@ -0,0 +1,120 @@
+package rplib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LogBundle is a tar.gz of the log files and the output of commands
+type LogBundle struct {
+	// the name in bundle to the file or directory, the missing ones are skipped
+	Files map[string]string
+	// the name in bundle to the command, the output and exit status are stored
+	Commands map[string][]string
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, mode os.FileMode, modTime time.Time) error {
+	hdr := &tar.Header{Name: name, Mode: int64(mode.Perm()), Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func addTarPath(tw *tar.Writer, name string, path string) error {
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hdr := &tar.Header{Name: filepath.Join(name, rel), Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		// the log may grow while copying, write the size in header only
+		_, err = io.CopyN(tw, f, info.Size())
+		return err
+	})
+}
+
+// Write writes the bundle as tar.gz to w
+func (b *LogBundle) Write(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+
+	for _, name := range sortedKeys(b.Files) {
+		path := b.Files[name]
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := addTarPath(tw, name, path); err != nil {
+			return fmt.Errorf("add %s to log bundle: %v", path, err)
+		}
+	}
+
+	var names []string
+	for name := range b.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args := b.Commands[name]
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		header := fmt.Sprintf("$ %s\n", strings.Join(args, " "))
+		if err != nil {
+			out = append(out, fmt.Sprintf("\n[%v]\n", err)...)
+		}
+		if err := writeTarFile(tw, name, append([]byte(header), out...), 0644, now); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// WriteFile writes the bundle to path, the partial file is removed on error
+func (b *LogBundle) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := b.Write(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
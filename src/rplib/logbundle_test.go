@@ -0,0 +1,61 @@
+package rplib_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type LogBundleSuite struct{}
+
+var _ = Suite(&LogBundleSuite{})
+
+func (s *LogBundleSuite) TestWriteFile(c *C) {
+	logs := c.MkDir()
+	writeFiles(c, logs, map[string]string{
+		"recovery.bin.log":          "recovery log",
+		"hooks/post-restore-00.log": "hook log",
+	})
+	bundle := rplib.LogBundle{
+		Files: map[string]string{
+			"recovery.bin.log": filepath.Join(logs, "recovery.bin.log"),
+			"hooks":            filepath.Join(logs, "hooks"),
+			"missing.log":      filepath.Join(logs, "missing.log"),
+		},
+		Commands: map[string][]string{
+			"echo.txt":  {"echo", "hello"},
+			"false.txt": {"false"},
+		},
+	}
+	path := filepath.Join(c.MkDir(), "logs.tar.gz")
+	c.Assert(bundle.WriteFile(path), IsNil)
+
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	c.Assert(err, IsNil)
+	tr := tar.NewReader(gr)
+	contents := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		contents[hdr.Name] = string(data)
+	}
+
+	c.Check(contents["recovery.bin.log"], Equals, "recovery log")
+	c.Check(contents["hooks/post-restore-00.log"], Equals, "hook log")
+	c.Check(contents["echo.txt"], Equals, "$ echo hello\nhello\n")
+	c.Check(strings.Contains(contents["false.txt"], "exit status 1"), Equals, true)
+	c.Check(contents, HasLen, 4)
+}
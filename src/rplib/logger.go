@@ -0,0 +1,340 @@
+package rplib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The log levels, the sinks drop the entries below their level
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the level name, case insensitive
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// syslog priority of levels, for kmsg and journal
+func (l Level) priority() int {
+	switch l {
+	case LevelDebug:
+		return 7
+	case LevelInfo:
+		return 6
+	case LevelWarning:
+		return 4
+	}
+	return 3
+}
+
+// Field is a key and value attached to a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// LogEntry is a message logged
+type LogEntry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// fieldsText formats the fields as " key=value", the value with spaces is quoted
+func (e LogEntry) fieldsText() string {
+	var b strings.Builder
+	for _, f := range e.Fields {
+		v := fmt.Sprint(f.Value)
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %s=%s", f.Key, v)
+	}
+	return b.String()
+}
+
+// LogSink writes the log entries somewhere
+type LogSink interface {
+	WriteEntry(e LogEntry) error
+}
+
+// WriterSink writes the entries as text lines, in the same time format as
+// the standard log, e.g.
+//
+//	2017/01/02 15:04:05 INFO Restore partitions disk=/dev/sda
+type WriterSink struct {
+	W     io.Writer
+	Level Level
+}
+
+func (s WriterSink) WriteEntry(e LogEntry) error {
+	if e.Level < s.Level {
+		return nil
+	}
+	_, err := fmt.Fprintf(s.W, "%s %s %s%s\n", e.Time.Format("2006/01/02 15:04:05"), e.Level, e.Message, e.fieldsText())
+	return err
+}
+
+// The kernel log device, and the max length of a record
+const (
+	KMSG_PATH       = "/dev/kmsg"
+	KMSG_RECORD_MAX = 976
+)
+
+// KmsgSink writes the entries to the kernel log, so they are in dmesg even
+// without console. The kernel rate limits the writes, so the debug entries
+// are dropped by default.
+type KmsgSink struct {
+	f     io.WriteCloser
+	Level Level
+}
+
+// NewKmsgSink opens the kernel log device, KMSG_PATH usually
+func NewKmsgSink(path string) (*KmsgSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &KmsgSink{f: f, Level: LevelInfo}, nil
+}
+
+func (s *KmsgSink) WriteEntry(e LogEntry) error {
+	if e.Level < s.Level {
+		return nil
+	}
+	// one write is one record
+	record := fmt.Sprintf("<%d>recovery.bin: %s%s", e.Level.priority(), e.Message, e.fieldsText())
+	record = strings.Replace(record, "\n", " ", -1)
+	if len(record) > KMSG_RECORD_MAX {
+		record = record[:KMSG_RECORD_MAX]
+	}
+	_, err := s.f.Write([]byte(record + "\n"))
+	return err
+}
+
+// The native protocol socket of systemd-journald
+const JOURNAL_SOCKET = "/run/systemd/journal/socket"
+
+// JournalSink sends the entries to the journal, the fields are journal
+// fields in upper case, e.g. stream=stderr is STREAM=stderr
+type JournalSink struct {
+	conn  *net.UnixConn
+	Level Level
+}
+
+// NewJournalSink connects the journal socket, JOURNAL_SOCKET usually
+func NewJournalSink(socket string) (*JournalSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &JournalSink{conn: conn, Level: LevelDebug}, nil
+}
+
+// journalFieldName converts key to the valid journal field name
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	return strings.TrimLeft(name, "_0123456789")
+}
+
+// appendJournalField encodes the field, the value with newline is in the
+// binary form: name, newline, 64-bit little endian size and value
+func appendJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+func encodeJournalEntry(e LogEntry) []byte {
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", e.Message)
+	appendJournalField(&b, "PRIORITY", fmt.Sprint(e.Level.priority()))
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", "recovery.bin")
+	for _, f := range e.Fields {
+		if name := journalFieldName(f.Key); name != "" {
+			appendJournalField(&b, name, fmt.Sprint(f.Value))
+		}
+	}
+	return b.Bytes()
+}
+
+func (s *JournalSink) WriteEntry(e LogEntry) error {
+	if e.Level < s.Level {
+		return nil
+	}
+	_, err := s.conn.Write(encodeJournalEntry(e))
+	return err
+}
+
+type loggerCore struct {
+	mu    sync.Mutex
+	sinks []LogSink
+}
+
+// Logger writes the leveled entries with fields to all the sinks
+type Logger struct {
+	core   *loggerCore
+	fields []Field
+}
+
+// NewLogger returns the logger writing to sinks
+func NewLogger(sinks ...LogSink) *Logger {
+	return &Logger{core: &loggerCore{sinks: sinks}}
+}
+
+// The logger of recovery.bin, which writes to stderr until SetSinks
+var DefaultLogger = NewLogger(WriterSink{W: os.Stderr})
+
+// SetSinks replaces the sinks of logger and the loggers derived from it
+func (l *Logger) SetSinks(sinks ...LogSink) {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	l.core.sinks = sinks
+}
+
+// AddSink adds the sink to logger and the loggers derived from it
+func (l *Logger) AddSink(sink LogSink) {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	l.core.sinks = append(l.core.sinks, sink)
+}
+
+func pairsToFields(pairs []interface{}) []Field {
+	var fields []Field
+	for i := 0; i < len(pairs); i += 2 {
+		key := fmt.Sprint(pairs[i])
+		if i+1 == len(pairs) {
+			fields = append(fields, Field{"EXTRA", key})
+			break
+		}
+		fields = append(fields, Field{key, pairs[i+1]})
+	}
+	return fields
+}
+
+// With returns the logger which attaches the key and value pairs to all the
+// entries
+func (l *Logger) With(pairs ...interface{}) *Logger {
+	return &Logger{core: l.core, fields: append(append([]Field{}, l.fields...), pairsToFields(pairs)...)}
+}
+
+// Log writes the message with the key and value pairs, the failed sinks are
+// reported on stderr
+func (l *Logger) Log(level Level, msg string, pairs ...interface{}) {
+	e := LogEntry{Time: time.Now(), Level: level, Message: msg, Fields: append(append([]Field{}, l.fields...), pairsToFields(pairs)...)}
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	for _, s := range l.core.sinks {
+		if err := s.WriteEntry(e); err != nil {
+			fmt.Fprintf(os.Stderr, "log sink %T: %v\n", s, err)
+		}
+	}
+}
+
+func (l *Logger) Debug(msg string, pairs ...interface{})   { l.Log(LevelDebug, msg, pairs...) }
+func (l *Logger) Info(msg string, pairs ...interface{})    { l.Log(LevelInfo, msg, pairs...) }
+func (l *Logger) Warning(msg string, pairs ...interface{}) { l.Log(LevelWarning, msg, pairs...) }
+func (l *Logger) Error(msg string, pairs ...interface{})   { l.Log(LevelError, msg, pairs...) }
+
+// The shortcuts of DefaultLogger
+func LogDebug(msg string, pairs ...interface{})   { DefaultLogger.Log(LevelDebug, msg, pairs...) }
+func LogInfo(msg string, pairs ...interface{})    { DefaultLogger.Log(LevelInfo, msg, pairs...) }
+func LogWarning(msg string, pairs ...interface{}) { DefaultLogger.Log(LevelWarning, msg, pairs...) }
+func LogError(msg string, pairs ...interface{})   { DefaultLogger.Log(LevelError, msg, pairs...) }
+
+// LineWriter logs each line written as an entry, with the prefix. Close
+// logs the last line without newline.
+type LineWriter struct {
+	logger *Logger
+	level  Level
+	prefix string
+	mu     sync.Mutex
+	buf    []byte
+}
+
+// Writer returns the writer logging each line at level, e.g. for the output
+// of subprocess
+func (l *Logger) Writer(level Level, prefix string) *LineWriter {
+	return &LineWriter{logger: l, level: level, prefix: prefix}
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logger.Log(w.level, w.prefix+strings.TrimRight(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *LineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.logger.Log(w.level, w.prefix+string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
+
+// CommandOutput returns the writers logging the stdout and stderr of the
+// command name, in debug level with the prefix "name: "
+func CommandOutput(name string) (stdout *LineWriter, stderr *LineWriter) {
+	prefix := name + ": "
+	return DefaultLogger.With("stream", "stdout").Writer(LevelDebug, prefix),
+		DefaultLogger.With("stream", "stderr").Writer(LevelDebug, prefix)
+}
+
+// RedirectStdLog sends the standard log to DefaultLogger in info level, the
+// time is added by the sinks
+func RedirectStdLog() {
+	log.SetFlags(0)
+	log.SetOutput(DefaultLogger.Writer(LevelInfo, ""))
+}
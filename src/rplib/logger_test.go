@@ -0,0 +1,118 @@
+package rplib_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type LoggerSuite struct{}
+
+var _ = Suite(&LoggerSuite{})
+
+// stripTime removes the time of each log line
+func stripTime(out string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		lines = append(lines, strings.SplitN(line, " ", 3)[2])
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s *LoggerSuite) TestWriterSinkLevel(c *C) {
+	var all, warnings bytes.Buffer
+	logger := rplib.NewLogger(rplib.WriterSink{W: &all}, rplib.WriterSink{W: &warnings, Level: rplib.LevelWarning})
+	logger.Debug("debug message")
+	logger.With("disk", "/dev/sda").Info("Restore partitions", "label", "writable system")
+	logger.Warning("low space", "free", 10, "odd")
+	logger.Error("failed")
+
+	c.Check(stripTime(all.String()), Equals, `DEBUG debug message
+INFO Restore partitions disk=/dev/sda label="writable system"
+WARNING low space free=10 EXTRA=odd
+ERROR failed`)
+	c.Check(stripTime(warnings.String()), Equals, "WARNING low space free=10 EXTRA=odd\nERROR failed")
+}
+
+func (s *LoggerSuite) TestParseLevel(c *C) {
+	level, err := rplib.ParseLevel("warning")
+	c.Check(err, IsNil)
+	c.Check(level, Equals, rplib.LevelWarning)
+	_, err = rplib.ParseLevel("verbose")
+	c.Check(err, ErrorMatches, `unknown log level "verbose"`)
+}
+
+func (s *LoggerSuite) TestLineWriter(c *C) {
+	var out bytes.Buffer
+	w := rplib.NewLogger(rplib.WriterSink{W: &out}).Writer(rplib.LevelDebug, "parted: ")
+	w.Write([]byte("first\r\nsec"))
+	w.Write([]byte("ond\nlast"))
+	c.Check(stripTime(out.String()), Equals, "DEBUG parted: first\nDEBUG parted: second")
+	c.Check(w.Close(), IsNil)
+	c.Check(stripTime(out.String()), Equals, "DEBUG parted: first\nDEBUG parted: second\nDEBUG parted: last")
+}
+
+func (s *LoggerSuite) TestShellexecOutput(c *C) {
+	var out bytes.Buffer
+	rplib.DefaultLogger.SetSinks(rplib.WriterSink{W: &out})
+	defer rplib.DefaultLogger.SetSinks(rplib.WriterSink{W: os.Stderr})
+
+	rplib.Shellexec("echo", "out")
+	rplib.Shellcmd("echo err >&2")
+	c.Check(stripTime(out.String()), Equals, `INFO Run: echo out cmd=echo
+DEBUG echo: out stream=stdout
+INFO Run: sh -c echo err >&2 cmd=sh
+DEBUG sh: err stream=stderr`)
+}
+
+func (s *LoggerSuite) TestRedirectStdLog(c *C) {
+	var out bytes.Buffer
+	rplib.DefaultLogger.SetSinks(rplib.WriterSink{W: &out})
+	rplib.RedirectStdLog()
+	defer func() {
+		rplib.DefaultLogger.SetSinks(rplib.WriterSink{W: os.Stderr})
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	log.Printf("Loading %s", "config.yaml")
+	c.Check(stripTime(out.String()), Equals, "INFO Loading config.yaml")
+}
+
+func (s *LoggerSuite) TestKmsgSink(c *C) {
+	path := filepath.Join(c.MkDir(), "kmsg")
+	c.Assert(ioutil.WriteFile(path, nil, 0644), IsNil)
+	sink, err := rplib.NewKmsgSink(path)
+	c.Assert(err, IsNil)
+
+	logger := rplib.NewLogger(sink)
+	logger.Debug("dropped")
+	logger.Warning("two\nlines", "disk", "sda")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "<4>recovery.bin: two lines disk=sda\n")
+}
+
+func (s *LoggerSuite) TestJournalSink(c *C) {
+	socket := filepath.Join(c.MkDir(), "journal")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	sink, err := rplib.NewJournalSink(socket)
+	c.Assert(err, IsNil)
+	rplib.NewLogger(sink).Error("failed", "exit-code", 3, "output", "a\nb")
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	c.Assert(err, IsNil)
+	c.Check(string(buf[:n]), Equals, "MESSAGE=failed\nPRIORITY=3\nSYSLOG_IDENTIFIER=recovery.bin\nEXIT_CODE=3\n"+
+		"OUTPUT\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n")
+}
@@ -0,0 +1,143 @@
+package rplib
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The message IDs shown to the end users
+const (
+	MSG_CONFIRM_TITLE      = "confirm-title"
+	MSG_CONFIRM_PROMPT     = "confirm-prompt"
+	MSG_CONFIRM_HINT       = "confirm-hint"
+	MSG_CONFIRM_TIMEOUT    = "confirm-timeout"
+	MSG_PASSWORD_PROMPT    = "password-prompt"
+	MSG_PASSWORD_WRONG     = "password-wrong"
+	MSG_PASSWORD_FAILED    = "password-failed"
+	MSG_RESTORE_START      = "restore-start"
+	MSG_RESTORE_DONE       = "restore-done"
+	MSG_RESTORE_FAILED     = "restore-failed"
+	MSG_PROGRESS_PARTITION = "progress-partition"
+	MSG_PROGRESS_RESTORE   = "progress-restore"
+	MSG_PROGRESS_CONFIGURE = "progress-configure"
+	MSG_SUMMARY_DISK       = "summary-disk"
+	MSG_SUMMARY_ERASE      = "summary-erase"
+	MSG_SUMMARY_ERASE_USED = "summary-erase-used"
+	MSG_SUMMARY_IMAGE      = "summary-image"
+	MSG_SUMMARY_ESTIMATE   = "summary-estimate"
+	MSG_PRODUCT_DEFAULT    = "product-default"
+)
+
+// The default locale, also the last one of the fallback chain
+const DEFAULT_LOCALE = "en"
+
+// DefaultMessages are used if the message is not found in any catalog file.
+// {product} is replaced by the OEM product name, the other {name}s by the
+// values given to MessageCatalog.Get.
+var DefaultMessages = map[string]string{
+	MSG_CONFIRM_TITLE:      "{product} Factory Restore: ",
+	MSG_CONFIRM_PROMPT:     "Factory Restore will delete all user data on {product}, are you sure? [y/N] ",
+	MSG_CONFIRM_HINT:       "(press [y] + [enter] to confirm) ",
+	MSG_CONFIRM_TIMEOUT:    "Timeout: {timeout} sec. Reboot system!",
+	MSG_PASSWORD_PROMPT:    "Enter the restore password: ",
+	MSG_PASSWORD_WRONG:     "Wrong password, {retries} retries left",
+	MSG_PASSWORD_FAILED:    "Restore password not matched, reboot system!",
+	MSG_RESTORE_START:      "Restoring {product}, please do not power off ...",
+	MSG_RESTORE_DONE:       "{product} is restored successfully",
+	MSG_RESTORE_FAILED:     "Failed to restore {product}",
+	MSG_PROGRESS_PARTITION: "Preparing partitions ...",
+	MSG_PROGRESS_RESTORE:   "Restoring system files ...",
+	MSG_PROGRESS_CONFIGURE: "Configuring {product} ...",
+	MSG_SUMMARY_DISK:       "Disk: {model} {device} ({size})",
+	MSG_SUMMARY_ERASE:      "  Erase partition {number} {label} ({size})",
+	MSG_SUMMARY_ERASE_USED: "  Erase partition {number} {label} ({size}, {used} used)",
+	MSG_SUMMARY_IMAGE:      "Factory image: {version} ({date})",
+	MSG_SUMMARY_ESTIMATE:   "Estimated time: about {minutes} minutes",
+	MSG_PRODUCT_DEFAULT:    "the system",
+}
+
+// LocaleChain returns the fallback chain of locale, e.g. "zh_TW.UTF-8" is
+// zh_TW, zh and en
+func LocaleChain(locale string) []string {
+	var chain []string
+	add := func(l string) {
+		for _, c := range chain {
+			if c == l {
+				return
+			}
+		}
+		if l != "" {
+			chain = append(chain, l)
+		}
+	}
+	// strip the encoding and modifier, e.g. .UTF-8 and @euro
+	locale = strings.SplitN(strings.SplitN(locale, ".", 2)[0], "@", 2)[0]
+	if locale != "C" && locale != "POSIX" {
+		add(locale)
+		add(strings.SplitN(locale, "_", 2)[0])
+	}
+	add(DEFAULT_LOCALE)
+	return chain
+}
+
+// MessageCatalog looks up the messages in the per-locale files
+// <dir>/<locale>.yaml by the fallback chain, then DefaultMessages
+type MessageCatalog struct {
+	Locale  string
+	Product string
+	files   []map[string]string
+}
+
+// LoadMessageCatalog loads the catalog files of locale in dir, the missing or
+// broken files are skipped
+func LoadMessageCatalog(dir string, locale string, product string) *MessageCatalog {
+	m := &MessageCatalog{Locale: locale, Product: product}
+	for _, l := range LocaleChain(locale) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, l+".yaml"))
+		if err != nil {
+			continue
+		}
+		var messages map[string]string
+		if err := yaml.Unmarshal(data, &messages); err != nil {
+			log.Printf("Skip the broken message catalog %s.yaml: %v", l, err)
+			continue
+		}
+		m.files = append(m.files, messages)
+	}
+	return m
+}
+
+func (m *MessageCatalog) lookup(id string) string {
+	if m != nil {
+		for _, messages := range m.files {
+			if s, ok := messages[id]; ok {
+				return s
+			}
+		}
+	}
+	if s, ok := DefaultMessages[id]; ok {
+		return s
+	}
+	return id
+}
+
+// Get returns the message of id, with {product} and the {name}s of the
+// name, value pairs replaced. A nil catalog returns DefaultMessages.
+func (m *MessageCatalog) Get(id string, pairs ...string) string {
+	product := ""
+	if m != nil {
+		product = m.Product
+	}
+	if product == "" {
+		product = m.lookup(MSG_PRODUCT_DEFAULT)
+	}
+	replaces := []string{"{product}", product}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		replaces = append(replaces, "{"+pairs[i]+"}", pairs[i+1])
+	}
+	return strings.NewReplacer(replaces...).Replace(m.lookup(id))
+}
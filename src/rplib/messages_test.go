@@ -0,0 +1,36 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type MessagesSuite struct{}
+
+var _ = Suite(&MessagesSuite{})
+
+func (s *MessagesSuite) TestLocaleChain(c *C) {
+	c.Check(rplib.LocaleChain("zh_TW.UTF-8"), DeepEquals, []string{"zh_TW", "zh", "en"})
+	c.Check(rplib.LocaleChain("de_DE@euro"), DeepEquals, []string{"de_DE", "de", "en"})
+	c.Check(rplib.LocaleChain("fr"), DeepEquals, []string{"fr", "en"})
+	c.Check(rplib.LocaleChain("C.UTF-8"), DeepEquals, []string{"en"})
+	c.Check(rplib.LocaleChain(""), DeepEquals, []string{"en"})
+}
+
+func (s *MessagesSuite) TestMessageCatalog(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "zh.yaml"), []byte("confirm-hint: \"(按 [y] 確認)\"\nrestore-done: \"{product} 已還原\"\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "zh_TW.yaml"), []byte("restore-done: \"{product} 已成功還原\"\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "en.yaml"), []byte("confirm-timeout: [broken\n"), 0644), IsNil)
+
+	m := rplib.LoadMessageCatalog(dir, "zh_TW.UTF-8", "Kiosk 100")
+	c.Check(m.Get(rplib.MSG_RESTORE_DONE), Equals, "Kiosk 100 已成功還原")
+	c.Check(m.Get(rplib.MSG_CONFIRM_HINT), Equals, "(按 [y] 確認)")
+	c.Check(m.Get(rplib.MSG_CONFIRM_TIMEOUT, "timeout", "30"), Equals, "Timeout: 30 sec. Reboot system!")
+
+	var none *rplib.MessageCatalog
+	c.Check(none.Get(rplib.MSG_RESTORE_DONE), Equals, "the system is restored successfully")
+}
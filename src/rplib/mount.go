@@ -0,0 +1,164 @@
+package rplib
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Mounter mounts and unmounts the filesystems, faked in tests
+type Mounter interface {
+	Mount(source, target, fstype string, flags uintptr, data string) error
+	Unmount(target string, flags int) error
+}
+
+// SyscallMounter mounts by the mount syscalls
+type SyscallMounter struct{}
+
+func (SyscallMounter) Mount(source, target, fstype string, flags uintptr, data string) error {
+	return syscall.Mount(source, target, fstype, flags, data)
+}
+
+func (SyscallMounter) Unmount(target string, flags int) error {
+	return syscall.Unmount(target, flags)
+}
+
+// MountPoint is a mount recorded by MountRegistry
+type MountPoint struct {
+	Source string
+	Target string
+	FsType string
+}
+
+func (m MountPoint) String() string {
+	return fmt.Sprintf("%s on %s (%s)", m.Source, m.Target, m.FsType)
+}
+
+// MountRegistry records every mount, to unmount them in reverse order even
+// if the recovery fails or panics. The mount not unmounted normally is
+// detached lazily.
+type MountRegistry struct {
+	mounter Mounter
+	mu      sync.Mutex
+	mounts  []MountPoint
+}
+
+// NewMountRegistry returns the registry mounting by mounter
+func NewMountRegistry(mounter Mounter) *MountRegistry {
+	return &MountRegistry{mounter: mounter}
+}
+
+// Mount mounts source on target, and records it if mounted
+func (r *MountRegistry) Mount(source, target, fstype string, flags uintptr, data string) error {
+	target = filepath.Clean(target)
+	if err := r.mounter.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("mount %s on %s: %v", source, target, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mounts = append(r.mounts, MountPoint{Source: source, Target: target, FsType: fstype})
+	return nil
+}
+
+// unmount unmounts target, or detaches it lazily if busy. The target not
+// mounted is not an error.
+func (r *MountRegistry) unmount(target string) error {
+	err := r.mounter.Unmount(target, 0)
+	if err == nil || err == syscall.EINVAL {
+		return nil
+	}
+	log.Printf("Unmount %s failed: %v, detach it lazily", target, err)
+	if err := r.mounter.Unmount(target, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("unmount %s: %v", target, err)
+	}
+	return nil
+}
+
+// Unmount unmounts the last mount on target, the record is kept if it could
+// not be unmounted even lazily
+func (r *MountRegistry) Unmount(target string) error {
+	target = filepath.Clean(target)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.unmount(target); err != nil {
+		return err
+	}
+	for i := len(r.mounts) - 1; i >= 0; i-- {
+		if r.mounts[i].Target == target {
+			r.mounts = append(r.mounts[:i], r.mounts[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Keep drops the record of the last mount on target, so it is kept mounted
+// after recovery.bin exits, e.g. for the scripts run after it
+func (r *MountRegistry) Keep(target string) {
+	target = filepath.Clean(target)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.mounts) - 1; i >= 0; i-- {
+		if r.mounts[i].Target == target {
+			r.mounts = append(r.mounts[:i], r.mounts[i+1:]...)
+			return
+		}
+	}
+}
+
+// unmountFrom unmounts the mounts after the first n in reverse order, and
+// returns the ones left mounted
+func (r *MountRegistry) unmountFrom(n int) []MountPoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var left []MountPoint
+	for i := len(r.mounts) - 1; i >= n; i-- {
+		if err := r.unmount(r.mounts[i].Target); err != nil {
+			log.Println(err)
+			left = append([]MountPoint{r.mounts[i]}, left...)
+		}
+	}
+	r.mounts = append(r.mounts[:n], left...)
+	return left
+}
+
+func leftoverError(left []MountPoint) error {
+	if len(left) == 0 {
+		return nil
+	}
+	var list []string
+	for _, m := range left {
+		list = append(list, m.String())
+	}
+	return fmt.Errorf("left mounted: %s", strings.Join(list, ", "))
+}
+
+// UnmountAll unmounts all the mounts in reverse order, and returns the error
+// listing the ones left mounted
+func (r *MountRegistry) UnmountAll() error {
+	return leftoverError(r.unmountFrom(0))
+}
+
+// Scope runs fn, and unmounts the mounts made in fn in reverse order after
+// fn returns or panics
+func (r *MountRegistry) Scope(fn func() error) (err error) {
+	r.mu.Lock()
+	n := len(r.mounts)
+	r.mu.Unlock()
+	defer func() {
+		if left := leftoverError(r.unmountFrom(n)); left != nil && err == nil {
+			err = left
+		}
+	}()
+	return fn()
+}
+
+// Mounted returns the mounts recorded, in mount order
+func (r *MountRegistry) Mounted() []MountPoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]MountPoint{}, r.mounts...)
+}
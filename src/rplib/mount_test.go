@@ -0,0 +1,143 @@
+package rplib_test
+
+import (
+	"fmt"
+	"syscall"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type MountSuite struct {
+	fake   *fakeMounter
+	mounts *rplib.MountRegistry
+}
+
+var _ = Suite(&MountSuite{})
+
+func (s *MountSuite) SetUpTest(c *C) {
+	s.fake = &fakeMounter{}
+	s.mounts = rplib.NewMountRegistry(s.fake)
+}
+
+func (s *MountSuite) TestUnmountAllReverse(c *C) {
+	c.Assert(s.mounts.Mount("/dev/sda3", "/tmp/writableMnt/", "ext4", 0, ""), IsNil)
+	c.Assert(s.mounts.Mount("/dev/sda2", "/tmp/writableMnt/boot/efi", "vfat", 0, ""), IsNil)
+	c.Assert(s.mounts.Mount("/proc", "/tmp/writableMnt/proc", "proc", 0, ""), IsNil)
+	c.Check(s.mounts.Mounted(), HasLen, 3)
+
+	c.Assert(s.mounts.UnmountAll(), IsNil)
+	c.Check(s.fake.Calls[3:], DeepEquals, []string{
+		"umount /tmp/writableMnt/proc 0",
+		"umount /tmp/writableMnt/boot/efi 0",
+		"umount /tmp/writableMnt 0",
+	})
+	c.Check(s.mounts.Mounted(), HasLen, 0)
+}
+
+func (s *MountSuite) TestUnmountLazy(c *C) {
+	s.fake.Busy = map[string]bool{"/tmp/system-boot": true}
+	c.Assert(s.mounts.Mount("/dev/sda2", "/tmp/system-boot/", "vfat", 0, ""), IsNil)
+
+	c.Assert(s.mounts.Unmount("/tmp/system-boot/"), IsNil)
+	c.Check(s.fake.Calls[1:], DeepEquals, []string{"umount /tmp/system-boot 0", "umount /tmp/system-boot 2"})
+	c.Check(s.fake.IsMounted("/tmp/system-boot"), Equals, false)
+	c.Check(s.mounts.Mounted(), HasLen, 0)
+}
+
+func (s *MountSuite) TestUnmountNotMounted(c *C) {
+	c.Check(s.mounts.Unmount("/tmp/writableMnt"), IsNil)
+}
+
+func (s *MountSuite) TestLeftover(c *C) {
+	s.fake.Stuck = map[string]bool{"/tmp/writableMnt": true}
+	c.Assert(s.mounts.Mount("/dev/sda3", "/tmp/writableMnt", "ext4", 0, ""), IsNil)
+	c.Assert(s.mounts.Mount("/dev/sda2", "/tmp/system-boot", "vfat", 0, ""), IsNil)
+
+	c.Check(s.mounts.UnmountAll(), ErrorMatches, `left mounted: /dev/sda3 on /tmp/writableMnt \(ext4\)`)
+	c.Check(s.mounts.Mounted(), DeepEquals, []rplib.MountPoint{{Source: "/dev/sda3", Target: "/tmp/writableMnt", FsType: "ext4"}})
+	c.Check(s.fake.IsMounted("/tmp/system-boot"), Equals, false)
+}
+
+func (s *MountSuite) TestKeep(c *C) {
+	c.Assert(s.mounts.Mount("/cdrom", "/run/recovery/", "", 0, ""), IsNil)
+	c.Assert(s.mounts.Mount("/dev/sda3", "/tmp/writableMnt", "ext4", 0, ""), IsNil)
+	s.mounts.Keep("/run/recovery")
+
+	c.Assert(s.mounts.UnmountAll(), IsNil)
+	c.Check(s.fake.IsMounted("/run/recovery"), Equals, true)
+	c.Check(s.fake.IsMounted("/tmp/writableMnt"), Equals, false)
+}
+
+func (s *MountSuite) TestMountError(c *C) {
+	s.fake.MountErr = fmt.Errorf("no such device")
+	c.Check(s.mounts.Mount("/dev/sda3", "/tmp/writableMnt", "ext4", 0, ""), ErrorMatches, "mount /dev/sda3 on /tmp/writableMnt: no such device")
+	c.Check(s.mounts.Mounted(), HasLen, 0)
+}
+
+func (s *MountSuite) TestScope(c *C) {
+	c.Assert(s.mounts.Mount("/dev/sda3", "/tmp/writableMnt", "ext4", 0, ""), IsNil)
+	err := s.mounts.Scope(func() error {
+		c.Assert(s.mounts.Mount("/dev/sda2", "/tmp/system-boot", "vfat", 0, ""), IsNil)
+		return fmt.Errorf("failed")
+	})
+	c.Check(err, ErrorMatches, "failed")
+	c.Check(s.fake.IsMounted("/tmp/system-boot"), Equals, false)
+	c.Check(s.fake.IsMounted("/tmp/writableMnt"), Equals, true)
+}
+
+func (s *MountSuite) TestScopePanic(c *C) {
+	func() {
+		defer func() { c.Check(recover(), Equals, "failed") }()
+		s.mounts.Scope(func() error {
+			s.mounts.Mount("/dev/sda3", "/tmp/writableMnt", "ext4", 0, "")
+			s.mounts.Mount("/proc", "/tmp/writableMnt/proc", "proc", 0, "")
+			panic("failed")
+		})
+	}()
+	c.Check(s.fake.Calls[2:], DeepEquals, []string{"umount /tmp/writableMnt/proc 0", "umount /tmp/writableMnt 0"})
+	c.Check(s.mounts.Mounted(), HasLen, 0)
+}
+
+// fakeMounter records the mounts without mounting
+type fakeMounter struct {
+	// Calls are the calls in order, e.g. "mount /dev/sda1 /mnt" and
+	// "umount /mnt 0"
+	Calls []string
+	// Busy are the targets only detached lazily
+	Busy map[string]bool
+	// Stuck are the targets could not be unmounted
+	Stuck map[string]bool
+	// MountErr is returned by Mount if set
+	MountErr error
+	mounted  map[string]int
+}
+
+func (f *fakeMounter) Mount(source, target, fstype string, flags uintptr, data string) error {
+	f.Calls = append(f.Calls, fmt.Sprintf("mount %s %s", source, target))
+	if f.MountErr != nil {
+		return f.MountErr
+	}
+	if f.mounted == nil {
+		f.mounted = make(map[string]int)
+	}
+	f.mounted[target]++
+	return nil
+}
+
+func (f *fakeMounter) Unmount(target string, flags int) error {
+	f.Calls = append(f.Calls, fmt.Sprintf("umount %s %d", target, flags))
+	switch {
+	case f.mounted[target] == 0:
+		return syscall.EINVAL
+	case f.Stuck[target], f.Busy[target] && flags&syscall.MNT_DETACH == 0:
+		return syscall.EBUSY
+	}
+	f.mounted[target]--
+	return nil
+}
+
+// IsMounted tells whether target is mounted
+func (f *fakeMounter) IsMounted(target string) bool {
+	return f.mounted[target] > 0
+}
@@ -0,0 +1,236 @@
+package rplib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// The whiteouts in overlay payloads, as OCI image layers:
+//
+//	.wh.<name>    deletes <name> in the same directory
+//	.wh..wh..opq  hides all the existing entries of the directory
+//
+// The overlayfs whiteout (char device 0/0) deletes the entry of same name.
+const (
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = ".wh..wh..opq"
+)
+
+// IsOverlayPayload tells whether the file is a supported overlay payload
+func IsOverlayPayload(name string) bool {
+	for _, ext := range []string{".tar", ".tar.xz", ".tar.gz", ".tgz", ".squashfs"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOverlayfsWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// removeWhiteouts removes the whiteouts left in the directory moved as a
+// whole, there is nothing under it to delete
+func removeWhiteouts(dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), WhiteoutPrefix) || isOverlayfsWhiteout(info) {
+			return os.Remove(p)
+		}
+		return nil
+	})
+}
+
+// clearDir removes all the entries of dir, except keep
+func clearDir(dir string, keep string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if p == filepath.Clean(keep) {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The max symlinks followed in a path, as the kernel
+const maxSymlinks = 40
+
+// resolveInRoot resolves rel inside root as in a chroot: the symlinks are
+// followed with root as "/", and never lead out of root. The missing
+// components are kept as is.
+func resolveInRoot(root, rel string) (string, error) {
+	comps := strings.Split(rel, "/")
+	cur := "/"
+	links := 0
+	for len(comps) > 0 {
+		c := comps[0]
+		comps = comps[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			continue
+		}
+
+		next := filepath.Join(cur, c)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) || (err == nil && info.Mode()&os.ModeSymlink == 0) {
+			cur = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", rel)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			cur = "/"
+		}
+		comps = append(strings.Split(link, "/"), comps...)
+	}
+	return filepath.Join(root, cur), nil
+}
+
+// MergeOverlayDir moves the content of layer onto target, the whiteouts in
+// layer delete the entries in target. The layer must be on the same
+// filesystem as target, and is consumed. The symlinks in target are followed
+// inside target, e.g. lib/ in layer is merged into usr/lib/ of target with
+// lib -> usr/lib, and the symlink is kept.
+func MergeOverlayDir(layer, target string) error {
+	return filepath.Walk(layer, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layer, p)
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+
+		if rel == "." {
+			if _, err := os.Stat(filepath.Join(p, WhiteoutOpaque)); err == nil {
+				// the layer may be extracted in target
+				return clearDir(target, layer)
+			}
+			return nil
+		}
+
+		parent, err := resolveInRoot(target, filepath.Dir(rel))
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(parent, name)
+
+		switch {
+		case name == WhiteoutOpaque:
+			return nil
+		case strings.HasPrefix(name, WhiteoutPrefix):
+			return os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(name, WhiteoutPrefix)))
+		case isOverlayfsWhiteout(info):
+			return os.RemoveAll(dst)
+		}
+
+		dstInfo, err := os.Lstat(dst)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		viaSymlink := false
+		if info.IsDir() && dstInfo != nil && dstInfo.Mode()&os.ModeSymlink != 0 {
+			// merge into the directory the symlink points to
+			resolved, err := resolveInRoot(target, rel)
+			if err != nil {
+				return err
+			}
+			if resolvedInfo, err := os.Stat(resolved); err == nil && resolvedInfo.IsDir() {
+				dst, dstInfo, viaSymlink = resolved, resolvedInfo, true
+			}
+		}
+
+		if info.IsDir() && dstInfo != nil && dstInfo.IsDir() {
+			// merge into the existing directory, the layer wins the owner and mode
+			if _, err := os.Stat(filepath.Join(p, WhiteoutOpaque)); err == nil {
+				if err := clearDir(dst, layer); err != nil {
+					return err
+				}
+			}
+			if viaSymlink {
+				// the directory is owned by the target
+				return nil
+			}
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+					return err
+				}
+			}
+			return os.Chmod(dst, info.Mode().Perm()|info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		}
+
+		if dstInfo != nil {
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+		}
+		// rename keeps the owner, mode and xattrs
+		if err := os.Rename(p, dst); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if err := removeWhiteouts(dst); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// ApplyOverlay extracts the overlay payload (tar or squashfs) and merges it
+// onto target, the whiteouts in payload delete the entries in target.
+func ApplyOverlay(payload string, target string) error {
+	if !IsOverlayPayload(payload) {
+		return fmt.Errorf("unsupported overlay payload %s", payload)
+	}
+
+	// extract in target, so the files are moved instead of copied
+	layer, err := ioutil.TempDir(target, ".recovery-overlay-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layer)
+
+	log.Printf("Apply overlay %s onto %s", payload, target)
+	if strings.HasSuffix(payload, ".squashfs") {
+		Shellexec("unsquashfs", "-d", layer, "-f", payload)
+	} else {
+		Shellexec("tar", "--xattrs", "-xpf", payload, "-C", layer)
+	}
+
+	return MergeOverlayDir(layer, target)
+}
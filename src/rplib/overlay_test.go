@@ -0,0 +1,157 @@
+package rplib_test
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type OverlaySuite struct{}
+
+var _ = Suite(&OverlaySuite{})
+
+func writeFiles(c *C, root string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		c.Assert(os.MkdirAll(filepath.Dir(p), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(p, []byte(content), 0644), IsNil)
+	}
+}
+
+func (s *OverlaySuite) TestIsOverlayPayload(c *C) {
+	c.Check(rplib.IsOverlayPayload("10-drivers.tar.xz"), Equals, true)
+	c.Check(rplib.IsOverlayPayload("20-branding.squashfs"), Equals, true)
+	c.Check(rplib.IsOverlayPayload("README"), Equals, false)
+}
+
+func (s *OverlaySuite) TestMergeOverlayDir(c *C) {
+	target := c.MkDir()
+	writeFiles(c, target, map[string]string{
+		"etc/hostname":          "base",
+		"etc/removed.conf":      "base",
+		"usr/share/logo/a.png":  "base",
+		"usr/share/logo/b.png":  "base",
+		"lib/firmware/old.bin":  "base",
+		"lib/firmware/keep.bin": "base",
+	})
+
+	layer, err := ioutil.TempDir(target, ".layer")
+	c.Assert(err, IsNil)
+	writeFiles(c, layer, map[string]string{
+		"etc/hostname":                   "overlay",
+		"etc/.wh.removed.conf":           "",
+		"usr/share/logo/.wh..wh..opq":    "",
+		"usr/share/logo/c.png":           "overlay",
+		"lib/firmware/.wh.old.bin":       "",
+		"opt/vendor/bin/tool":            "overlay",
+		"opt/vendor/.wh.nothing-to-hide": "",
+	})
+
+	err = rplib.MergeOverlayDir(layer, target)
+	c.Assert(err, IsNil)
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	c.Check(read("etc/hostname"), Equals, "overlay")
+	c.Check(read("etc/removed.conf"), Equals, "")
+	c.Check(read("usr/share/logo/a.png"), Equals, "")
+	c.Check(read("usr/share/logo/c.png"), Equals, "overlay")
+	c.Check(read("lib/firmware/old.bin"), Equals, "")
+	c.Check(read("lib/firmware/keep.bin"), Equals, "base")
+	c.Check(read("opt/vendor/bin/tool"), Equals, "overlay")
+
+	// no whiteout left
+	_, err = os.Stat(filepath.Join(target, "usr/share/logo/.wh..wh..opq"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(filepath.Join(target, "opt/vendor/.wh.nothing-to-hide"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *OverlaySuite) TestMergeOverlayDirMergedUsr(c *C) {
+	target := c.MkDir()
+	writeFiles(c, target, map[string]string{
+		"usr/lib/libc.so":   "base",
+		"usr/lib/libold.so": "base",
+		"usr/bin/sh":        "base",
+		"opt/keep":          "base",
+	})
+	c.Assert(os.Symlink("usr/lib", filepath.Join(target, "lib")), IsNil)
+	// the absolute symlink is resolved in target, not the host
+	c.Assert(os.Symlink("/usr/bin", filepath.Join(target, "bin")), IsNil)
+	// and never leads out of target
+	c.Assert(os.Symlink("../../../../../opt", filepath.Join(target, "escape")), IsNil)
+
+	layer, err := ioutil.TempDir(target, ".layer")
+	c.Assert(err, IsNil)
+	writeFiles(c, layer, map[string]string{
+		"lib/firmware/new.bin": "overlay",
+		"lib/.wh.libold.so":    "",
+		"bin/tool":             "overlay",
+		"escape/vendor/file":   "overlay",
+	})
+
+	err = rplib.MergeOverlayDir(layer, target)
+	c.Assert(err, IsNil)
+
+	for _, link := range []string{"lib", "bin", "escape"} {
+		info, err := os.Lstat(filepath.Join(target, link))
+		c.Assert(err, IsNil)
+		c.Check(info.Mode()&os.ModeSymlink, Not(Equals), os.FileMode(0), Commentf("%s is replaced", link))
+	}
+	for name, content := range map[string]string{
+		"usr/lib/firmware/new.bin": "overlay",
+		"usr/lib/libc.so":          "base",
+		"usr/bin/sh":               "base",
+		"usr/bin/tool":             "overlay",
+		"opt/vendor/file":          "overlay",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(target, name))
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, content)
+	}
+	_, err = os.Lstat(filepath.Join(target, "usr/lib/libold.so"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *OverlaySuite) TestApplyOverlayTar(c *C) {
+	target := c.MkDir()
+	writeFiles(c, target, map[string]string{"etc/hostname": "base", "etc/motd": "base"})
+
+	payload := filepath.Join(c.MkDir(), "10-branding.tar")
+	f, err := os.Create(payload)
+	c.Assert(err, IsNil)
+	tw := tar.NewWriter(f)
+	for _, e := range []struct{ name, content string }{
+		{"./etc/motd", "branded"},
+		{"./etc/.wh.hostname", ""},
+	} {
+		c.Assert(tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}), IsNil)
+		_, err = tw.Write([]byte(e.content))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	err = rplib.ApplyOverlay(payload, target)
+	c.Assert(err, IsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(target, "etc/motd"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "branded")
+	_, err = os.Stat(filepath.Join(target, "etc/hostname"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// the extracted layer is removed
+	entries, err := ioutil.ReadDir(target)
+	c.Assert(err, IsNil)
+	c.Check(entries, HasLen, 1)
+}
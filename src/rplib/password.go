@@ -0,0 +1,101 @@
+package rplib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The restore password hash is in the format of grub-mkpasswd-pbkdf2, so the
+// same hash could protect the grub menuentry:
+//
+//	grub.pbkdf2.sha512.<iterations>.<salt in hex>.<hash in hex>
+const (
+	GRUB_PBKDF2_PREFIX     = "grub.pbkdf2.sha512."
+	GRUB_PBKDF2_ITERATIONS = 10000 // the default of grub-mkpasswd-pbkdf2
+	GRUB_PBKDF2_SALT_LEN   = 64
+	GRUB_PBKDF2_HASH_LEN   = 64
+)
+
+// pbkdf2SHA512 is PBKDF2 (RFC 2898) with HMAC-SHA512
+func pbkdf2SHA512(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha512.New, password)
+	var dk []byte
+	for block := uint32(1); len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], block)
+		prf.Write(b[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
+
+// PasswordHash is a parsed grub pbkdf2 password hash
+type PasswordHash struct {
+	Iterations int
+	Salt       []byte
+	Hash       []byte
+}
+
+func (h PasswordHash) String() string {
+	return fmt.Sprintf("%s%d.%s.%s", GRUB_PBKDF2_PREFIX, h.Iterations,
+		strings.ToUpper(hex.EncodeToString(h.Salt)), strings.ToUpper(hex.EncodeToString(h.Hash)))
+}
+
+// ParsePasswordHash parses the hash generated by grub-mkpasswd-pbkdf2
+func ParsePasswordHash(s string) (PasswordHash, error) {
+	var h PasswordHash
+	fields := strings.Split(strings.TrimPrefix(strings.TrimSpace(s), GRUB_PBKDF2_PREFIX), ".")
+	if !strings.HasPrefix(strings.TrimSpace(s), GRUB_PBKDF2_PREFIX) || len(fields) != 3 {
+		return h, fmt.Errorf("password hash must be %s<iterations>.<salt>.<hash>", GRUB_PBKDF2_PREFIX)
+	}
+	var err error
+	if h.Iterations, err = strconv.Atoi(fields[0]); err != nil || h.Iterations < 1 {
+		return h, fmt.Errorf("invalid iterations %q in password hash", fields[0])
+	}
+	if h.Salt, err = hex.DecodeString(fields[1]); err != nil {
+		return h, fmt.Errorf("invalid salt in password hash: %v", err)
+	}
+	if h.Hash, err = hex.DecodeString(fields[2]); err != nil || len(h.Hash) == 0 {
+		return h, fmt.Errorf("invalid hash in password hash")
+	}
+	return h, nil
+}
+
+// HashPassword returns the grub pbkdf2 hash of password, with a random salt
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, GRUB_PBKDF2_SALT_LEN)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	h := PasswordHash{Iterations: GRUB_PBKDF2_ITERATIONS, Salt: salt}
+	h.Hash = pbkdf2SHA512([]byte(password), salt, h.Iterations, GRUB_PBKDF2_HASH_LEN)
+	return h.String(), nil
+}
+
+// VerifyPassword tells whether password matches the hash
+func VerifyPassword(hash string, password string) (bool, error) {
+	h, err := ParsePasswordHash(hash)
+	if err != nil {
+		return false, err
+	}
+	dk := pbkdf2SHA512([]byte(password), h.Salt, h.Iterations, len(h.Hash))
+	return hmac.Equal(dk, h.Hash), nil
+}
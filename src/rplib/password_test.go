@@ -0,0 +1,57 @@
+package rplib_test
+
+import (
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type PasswordSuite struct{}
+
+var _ = Suite(&PasswordSuite{})
+
+// generated by PBKDF2-HMAC-SHA512 of "kiosk", salt 0102030405060708, 1000 iterations
+const kioskHash = "grub.pbkdf2.sha512.1000.0102030405060708.B193581247C6C1E0D76B0DE349A99A83B1CD1355C0A2A2726EAAF2FD2DB8A7ED3221B2FFDB8D75B551FBA9746B474FC1F64215F74812FF13566753EA8AE01098"
+
+func (s *PasswordSuite) TestVerifyPassword(c *C) {
+	ok, err := rplib.VerifyPassword(kioskHash, "kiosk")
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	ok, err = rplib.VerifyPassword(kioskHash, "kiosk1")
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+
+	_, err = rplib.VerifyPassword("sha512.1000.01.02", "kiosk")
+	c.Check(err, NotNil)
+}
+
+func (s *PasswordSuite) TestHashPassword(c *C) {
+	hash, err := rplib.HashPassword("secret")
+	c.Assert(err, IsNil)
+	c.Check(strings.HasPrefix(hash, "grub.pbkdf2.sha512.10000."), Equals, true)
+
+	h, err := rplib.ParsePasswordHash(hash)
+	c.Assert(err, IsNil)
+	c.Check(h.Salt, HasLen, 64)
+	c.Check(h.String(), Equals, hash)
+
+	ok, err := rplib.VerifyPassword(hash, "secret")
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+}
+
+func (s *PasswordSuite) TestValidateRestorePassword(c *C) {
+	problems := rplib.ValidateConfig([]byte("recovery:\n  restore-password: secret\n  restore-password-retries: -1\n"), 0)
+	var found []string
+	for _, p := range problems {
+		if p.Key == "recovery.restore-password" || p.Key == "recovery.restore-password-retries" {
+			found = append(found, p.String())
+		}
+	}
+	c.Check(found, DeepEquals, []string{
+		"line 2: error: 'recovery -> restore-password' password hash must be grub.pbkdf2.sha512.<iterations>.<salt>.<hash>, see grub-mkpasswd-pbkdf2",
+		"line 3: error: 'recovery -> restore-password-retries' must not be negative",
+	})
+}
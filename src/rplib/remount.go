@@ -0,0 +1,98 @@
+package rplib
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The mount table to read the mount options, changed in tests
+var ProcMounts = "/proc/self/mounts"
+
+// Remount remounts the mount point dir with the options, e.g. "rw"
+var Remount = func(dir string, options string) error {
+	out, err := exec.Command("mount", "-o", options+",remount", dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("remount %s %s: %v: %s", dir, options, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// mountOptions returns the options of the last mount on dir
+func mountOptions(dir string) ([]string, error) {
+	f, err := os.Open(ProcMounts)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var options []string
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 3 && filepath.Clean(fields[1]) == dir {
+			options, found = strings.Split(fields[3], ","), true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not mounted", dir)
+	}
+	return options, scanner.Err()
+}
+
+func isReadOnly(options []string) bool {
+	for _, o := range options {
+		if o == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+var writableLock sync.Mutex
+var writableRefs = make(map[string]int)
+var remountedRW = make(map[string]bool)
+
+// WithWritable runs fn with the mount point dir writable. The read-only
+// mount is remounted rw, and back to ro after fn, even if fn panics. The
+// nested calls share the rw mount, and the mount already rw is kept as is.
+func WithWritable(dir string, fn func() error) error {
+	dir = filepath.Clean(dir)
+
+	writableLock.Lock()
+	if writableRefs[dir] == 0 {
+		options, err := mountOptions(dir)
+		if err == nil && isReadOnly(options) {
+			err = Remount(dir, "rw")
+			remountedRW[dir] = err == nil
+		}
+		if err != nil {
+			writableLock.Unlock()
+			return err
+		}
+	}
+	writableRefs[dir]++
+	writableLock.Unlock()
+
+	defer func() {
+		writableLock.Lock()
+		defer writableLock.Unlock()
+		writableRefs[dir]--
+		if writableRefs[dir] > 0 || !remountedRW[dir] {
+			return
+		}
+		delete(remountedRW, dir)
+		syscall.Sync()
+		if err := Remount(dir, "ro"); err != nil {
+			log.Println(err)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,77 @@
+package rplib_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type RemountSuite struct {
+	remounts  []string
+	origProc  string
+	origMount func(string, string) error
+}
+
+var _ = Suite(&RemountSuite{})
+
+func (s *RemountSuite) SetUpTest(c *C) {
+	s.remounts = nil
+	s.origProc, s.origMount = rplib.ProcMounts, rplib.Remount
+	rplib.Remount = func(dir, options string) error {
+		s.remounts = append(s.remounts, options+" "+dir)
+		return nil
+	}
+}
+
+func (s *RemountSuite) TearDownTest(c *C) {
+	rplib.ProcMounts, rplib.Remount = s.origProc, s.origMount
+}
+
+func (s *RemountSuite) writeMounts(c *C, mounts string) {
+	rplib.ProcMounts = filepath.Join(c.MkDir(), "mounts")
+	c.Assert(ioutil.WriteFile(rplib.ProcMounts, []byte(mounts), 0644), IsNil)
+}
+
+func (s *RemountSuite) TestWithWritableReadOnly(c *C) {
+	s.writeMounts(c, "/dev/sda1 /tmp/RECOVERY vfat ro,relatime 0 0\n")
+	err := rplib.WithWritable("/tmp/RECOVERY/", func() error {
+		// nested calls share the rw mount
+		return rplib.WithWritable("/tmp/RECOVERY", func() error { return nil })
+	})
+	c.Check(err, IsNil)
+	c.Check(s.remounts, DeepEquals, []string{"rw /tmp/RECOVERY", "ro /tmp/RECOVERY"})
+}
+
+func (s *RemountSuite) TestWithWritableError(c *C) {
+	s.writeMounts(c, "/dev/sda1 /tmp/RECOVERY vfat ro,relatime 0 0\n")
+	err := rplib.WithWritable("/tmp/RECOVERY", func() error { return fmt.Errorf("failed") })
+	c.Check(err, ErrorMatches, "failed")
+	c.Check(s.remounts, DeepEquals, []string{"rw /tmp/RECOVERY", "ro /tmp/RECOVERY"})
+}
+
+func (s *RemountSuite) TestWithWritablePanic(c *C) {
+	s.writeMounts(c, "/dev/sda1 /tmp/RECOVERY vfat ro,relatime 0 0\n")
+	c.Check(func() {
+		rplib.WithWritable("/tmp/RECOVERY", func() error { panic("boom") })
+	}, PanicMatches, "boom")
+	c.Check(s.remounts, DeepEquals, []string{"rw /tmp/RECOVERY", "ro /tmp/RECOVERY"})
+}
+
+func (s *RemountSuite) TestWithWritableAlreadyRW(c *C) {
+	s.writeMounts(c, "/dev/sda1 /tmp/RECOVERY vfat rw,relatime 0 0\n")
+	called := false
+	err := rplib.WithWritable("/tmp/RECOVERY", func() error { called = true; return nil })
+	c.Check(err, IsNil)
+	c.Check(called, Equals, true)
+	c.Check(s.remounts, HasLen, 0)
+}
+
+func (s *RemountSuite) TestWithWritableNotMounted(c *C) {
+	s.writeMounts(c, "")
+	err := rplib.WithWritable("/tmp/RECOVERY", func() error { return nil })
+	c.Check(err, ErrorMatches, "/tmp/RECOVERY is not mounted")
+	c.Check(s.remounts, HasLen, 0)
+}
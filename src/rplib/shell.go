@@ -1,44 +1,76 @@
 package rplib
 
 import (
-	"log"
-	"os"
+	"bytes"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
+// CommandRecord is an external command run by the Shell functions
+type CommandRecord struct {
+	Command     string    `json:"command"`
+	Start       time.Time `json:"start"`
+	DurationSec float64   `json:"duration-sec"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// RecordCommand is called after each command run by the Shell functions if
+// set, e.g. for the recovery report
+var RecordCommand func(CommandRecord)
+
+func recordRun(cmd *exec.Cmd, run func() error) error {
+	start := time.Now()
+	err := run()
+	if RecordCommand != nil {
+		record := CommandRecord{Command: strings.Join(cmd.Args, " "), Start: start, DurationSec: time.Since(start).Seconds()}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		RecordCommand(record)
+	}
+	return err
+}
+
+// runCommand logs the command and its output, the stdout is returned instead
+// of logged if output
+func runCommand(cmd *exec.Cmd, output bool) ([]byte, error) {
+	LogInfo("Run: "+strings.Join(cmd.Args, " "), "cmd", filepath.Base(cmd.Args[0]))
+	stdout, stderr := CommandOutput(filepath.Base(cmd.Args[0]))
+	defer stdout.Close()
+	defer stderr.Close()
+
+	var out bytes.Buffer
+	cmd.Stdout = stdout
+	if output {
+		cmd.Stdout = &out
+	}
+	cmd.Stderr = stderr
+	err := recordRun(cmd, cmd.Run)
+	return out.Bytes(), err
+}
+
 func Shellexec(name string, args ...string) {
-	log.Printf(name, args)
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	_, err := runCommand(exec.Command(name, args...), false)
 	Checkerr(err)
 }
 
 func Shellexecoutput(name string, args ...string) string {
-	log.Printf(name, args)
-	cmd := exec.Command(name, args...)
-	out, err := cmd.Output()
+	out, err := runCommand(exec.Command(name, args...), true)
 	Checkerr(err)
 
-	return strings.TrimSpace(string(out[:]))
+	return strings.TrimSpace(string(out))
 }
 
 func Shellcmd(command string) {
-	cmd := exec.Command("sh", "-c", command)
-	log.Printf(strings.Join(cmd.Args, " "))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	_, err := runCommand(exec.Command("sh", "-c", command), false)
 	Checkerr(err)
 }
 
 func Shellcmdoutput(command string) string {
-	cmd := exec.Command("sh", "-c", command)
-	log.Printf(strings.Join(cmd.Args, " "))
-	out, err := cmd.Output()
+	out, err := runCommand(exec.Command("sh", "-c", command), true)
 	Checkerr(err)
 
-	return strings.TrimSpace(string(out[:]))
+	return strings.TrimSpace(string(out))
 }
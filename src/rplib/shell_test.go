@@ -0,0 +1,28 @@
+package rplib_test
+
+import (
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type ShellSuite struct{}
+
+var _ = Suite(&ShellSuite{})
+
+func (s *ShellSuite) TestRecordCommand(c *C) {
+	var records []rplib.CommandRecord
+	rplib.RecordCommand = func(r rplib.CommandRecord) { records = append(records, r) }
+	defer func() { rplib.RecordCommand = nil }()
+
+	rplib.Shellexec("true")
+	c.Check(rplib.Shellcmdoutput("echo recorded"), Equals, "recorded")
+	c.Check(func() { rplib.Shellexec("false") }, PanicMatches, ".*exit status 1.*")
+
+	c.Assert(records, HasLen, 3)
+	c.Check(records[0].Command, Equals, "true")
+	c.Check(records[0].Error, Equals, "")
+	c.Check(records[1].Command, Equals, "sh -c echo recorded")
+	c.Check(records[2].Command, Equals, "false")
+	c.Check(records[2].Error, Equals, "exit status 1")
+	c.Check(records[2].DurationSec >= 0, Equals, true)
+}
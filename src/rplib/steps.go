@@ -0,0 +1,234 @@
+package rplib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Step is a named step of the recovery
+type Step struct {
+	Name string
+	Run  func() error
+	// Skip tells whether the step does not apply, e.g. to the recovery OS
+	Skip func() bool
+	// Always runs the step when resuming after it, e.g. mounting partitions
+	Always bool
+	// Destructive marks the first step which destroys the target system,
+	// the recovery is resumed only if it has started
+	Destructive bool
+	// ResumeFrom is the step to resume from if this step is interrupted,
+	// when this step could not run twice on the same target
+	ResumeFrom string
+}
+
+// RestoreState is the progress of recovery checkpointed before and after
+// each step, to resume after the power is lost
+type RestoreState struct {
+	RecoveryType string    `json:"recovery-type"`
+	RecoveryOS   string    `json:"recovery-os"`
+	Started      time.Time `json:"started"`
+	Attempts     int       `json:"attempts"`
+	Destructive  bool      `json:"destructive"` // a destructive step has started
+	Running      string    `json:"running,omitempty"`
+	Done         []string  `json:"done"`
+}
+
+// ReadRestoreState reads the state file
+func ReadRestoreState(path string) (*RestoreState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &RestoreState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid restore state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// Write writes the state file atomically
+func (s *RestoreState) Write(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// IsDone tells whether the step is done
+func (s *RestoreState) IsDone(name string) bool {
+	for _, done := range s.Done {
+		if done == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ResumeStep returns the step to resume the interrupted recovery from, it
+// returns "" if nothing was destroyed and the recovery should start over.
+func ResumeStep(steps []Step, state *RestoreState) string {
+	if !state.Destructive {
+		return ""
+	}
+	from := state.Running
+	if from == "" {
+		// interrupted between steps, resume from the first step not done
+		for _, step := range steps {
+			if !state.IsDone(step.Name) && (step.Skip == nil || !step.Skip()) {
+				from = step.Name
+				break
+			}
+		}
+	}
+	for _, step := range steps {
+		if step.Name == from && step.ResumeFrom != "" {
+			return step.ResumeFrom
+		}
+	}
+	return from
+}
+
+// StepRunner runs the steps in order, and checkpoints the state before and
+// after each step
+type StepRunner struct {
+	Steps []Step
+	State *RestoreState
+	// Checkpoint stores the state, the failure is logged only
+	Checkpoint func(state *RestoreState) error
+	// OnStep is called when a step starts, and returns the function called
+	// when it finishes
+	OnStep func(name string) func()
+	// Only runs the named steps only, with the Always steps before them
+	Only []string
+	// Excluded are the named steps not to run, even the Always ones
+	Excluded []string
+}
+
+func (r *StepRunner) checkpoint() {
+	if r.Checkpoint == nil {
+		return
+	}
+	if err := r.Checkpoint(r.State); err != nil {
+		log.Println("Checkpoint the restore state failed:", err)
+	}
+}
+
+func (r *StepRunner) find(name string) bool {
+	for _, step := range r.Steps {
+		if step.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, name string) bool {
+	for _, s := range list {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// selected returns whether each step is selected to run by from and Only.
+// The Always steps are selected if any step after them is selected.
+func (r *StepRunner) selected(from string) []bool {
+	sel := make([]bool, len(r.Steps))
+	started := from == ""
+	for i, step := range r.Steps {
+		if step.Name == from {
+			started = true
+		}
+		sel[i] = started && (len(r.Only) == 0 || contains(r.Only, step.Name))
+	}
+	later := false
+	for i := len(r.Steps) - 1; i >= 0; i-- {
+		if r.Steps[i].Always && later {
+			sel[i] = true
+		}
+		later = later || sel[i]
+	}
+	return sel
+}
+
+// Run runs the steps from the step named from, or all the steps if from is
+// "". The steps before from are skipped except the Always ones. The Only and
+// Excluded steps are applied after.
+func (r *StepRunner) Run(from string) error {
+	for _, name := range append(append([]string{from}, r.Only...), r.Excluded...) {
+		if name != "" && !r.find(name) {
+			return fmt.Errorf("unknown step %q", name)
+		}
+	}
+	if from != "" && len(r.Only) > 0 {
+		return fmt.Errorf("from step %s and only steps %s could not be used together", from, strings.Join(r.Only, ","))
+	}
+
+	sel := r.selected(from)
+	for i, step := range r.Steps {
+		if !sel[i] {
+			if len(r.Only) > 0 {
+				log.Printf("[step %s] skipped, not selected", step.Name)
+			} else {
+				log.Printf("[step %s] skipped, done before", step.Name)
+			}
+			continue
+		}
+		if contains(r.Excluded, step.Name) {
+			log.Printf("[step %s] skipped by request", step.Name)
+			continue
+		}
+		if step.Skip != nil && step.Skip() {
+			continue
+		}
+
+		log.Printf("[step %s]", step.Name)
+		r.State.Running = step.Name
+		if step.Destructive {
+			r.State.Destructive = true
+		}
+		r.checkpoint()
+
+		var end func()
+		if r.OnStep != nil {
+			end = r.OnStep(step.Name)
+		}
+		if err := step.Run(); err != nil {
+			return fmt.Errorf("step %s failed: %v", step.Name, err)
+		}
+		if end != nil {
+			end()
+		}
+
+		if !r.State.IsDone(step.Name) {
+			r.State.Done = append(r.State.Done, step.Name)
+		}
+		r.State.Running = ""
+		r.checkpoint()
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package rplib_test
+
+import (
+	"fmt"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+type StepsSuite struct {
+	ran   []string
+	steps []rplib.Step
+}
+
+var _ = Suite(&StepsSuite{})
+
+func (s *StepsSuite) step(name string) func() error {
+	return func() error {
+		s.ran = append(s.ran, name)
+		return nil
+	}
+}
+
+func (s *StepsSuite) SetUpTest(c *C) {
+	s.ran = nil
+	s.steps = []rplib.Step{
+		{Name: "confirm", Run: s.step("confirm")},
+		{Name: "partition", Destructive: true, Run: s.step("partition")},
+		{Name: "mount", Always: true, Run: s.step("mount")},
+		{Name: "snaps", Skip: func() bool { return true }, Run: s.step("snaps")},
+		{Name: "fstab", Run: s.step("fstab")},
+		{Name: "bootloader", ResumeFrom: "partition", Run: s.step("bootloader")},
+		{Name: "hooks", Run: s.step("hooks")},
+	}
+}
+
+func (s *StepsSuite) TestRunCheckpoint(c *C) {
+	path := filepath.Join(c.MkDir(), "restore-state")
+	var checkpoints []string
+	runner := rplib.StepRunner{
+		Steps: s.steps,
+		State: &rplib.RestoreState{RecoveryType: "factory_restore"},
+		Checkpoint: func(state *rplib.RestoreState) error {
+			checkpoints = append(checkpoints, fmt.Sprintf("%s %v", state.Running, state.Destructive))
+			return state.Write(path)
+		},
+	}
+	c.Assert(runner.Run(""), IsNil)
+	c.Check(s.ran, DeepEquals, []string{"confirm", "partition", "mount", "fstab", "bootloader", "hooks"})
+	c.Check(checkpoints[:4], DeepEquals, []string{"confirm false", " false", "partition true", " true"})
+
+	state, err := rplib.ReadRestoreState(path)
+	c.Assert(err, IsNil)
+	c.Check(state.RecoveryType, Equals, "factory_restore")
+	c.Check(state.Running, Equals, "")
+	c.Check(state.Done, DeepEquals, []string{"confirm", "partition", "mount", "fstab", "bootloader", "hooks"})
+}
+
+func (s *StepsSuite) TestRunFrom(c *C) {
+	runner := rplib.StepRunner{Steps: s.steps, State: &rplib.RestoreState{}}
+	c.Assert(runner.Run("fstab"), IsNil)
+	c.Check(s.ran, DeepEquals, []string{"mount", "fstab", "bootloader", "hooks"})
+
+	c.Check(runner.Run("format"), ErrorMatches, `unknown step "format"`)
+}
+
+func (s *StepsSuite) TestRunOnly(c *C) {
+	runner := rplib.StepRunner{Steps: s.steps, State: &rplib.RestoreState{}, Only: []string{"fstab"}}
+	c.Assert(runner.Run(""), IsNil)
+	c.Check(s.ran, DeepEquals, []string{"mount", "fstab"})
+
+	s.ran = nil
+	runner.Only = []string{"partition"}
+	c.Assert(runner.Run(""), IsNil)
+	c.Check(s.ran, DeepEquals, []string{"partition"})
+
+	c.Check(runner.Run("fstab"), ErrorMatches, "from step fstab and only steps partition could not be used together")
+	runner.Only = []string{"grub"}
+	c.Check(runner.Run(""), ErrorMatches, `unknown step "grub"`)
+}
+
+func (s *StepsSuite) TestRunExcluded(c *C) {
+	runner := rplib.StepRunner{Steps: s.steps, State: &rplib.RestoreState{}, Excluded: []string{"confirm", "mount"}}
+	c.Assert(runner.Run(""), IsNil)
+	c.Check(s.ran, DeepEquals, []string{"partition", "fstab", "bootloader", "hooks"})
+
+	s.ran = nil
+	runner.Excluded = []string{"hooks"}
+	c.Assert(runner.Run("bootloader"), IsNil)
+	c.Check(s.ran, DeepEquals, []string{"mount", "bootloader"})
+
+	runner.Excluded = []string{"grub"}
+	c.Check(runner.Run(""), ErrorMatches, `unknown step "grub"`)
+}
+
+func (s *StepsSuite) TestRunError(c *C) {
+	s.steps[4].Run = func() error { return fmt.Errorf("no uuid") }
+	state := &rplib.RestoreState{}
+	runner := rplib.StepRunner{Steps: s.steps, State: state}
+	c.Check(runner.Run(""), ErrorMatches, "step fstab failed: no uuid")
+	c.Check(state.Running, Equals, "fstab")
+	c.Check(state.Done, DeepEquals, []string{"confirm", "partition", "mount"})
+}
+
+func (s *StepsSuite) TestResumeStep(c *C) {
+	// nothing destroyed
+	c.Check(rplib.ResumeStep(s.steps, &rplib.RestoreState{Running: "confirm"}), Equals, "")
+	// the interrupted step
+	c.Check(rplib.ResumeStep(s.steps, &rplib.RestoreState{Destructive: true, Running: "fstab"}), Equals, "fstab")
+	// could not run twice
+	c.Check(rplib.ResumeStep(s.steps, &rplib.RestoreState{Destructive: true, Running: "bootloader"}), Equals, "partition")
+	// between steps, the skipped step is not resumed
+	c.Check(rplib.ResumeStep(s.steps, &rplib.RestoreState{Destructive: true, Done: []string{"confirm", "partition", "mount"}}), Equals, "fstab")
+}
+
+func (s *StepsSuite) TestReadRestoreStateInvalid(c *C) {
+	path := filepath.Join(c.MkDir(), "restore-state")
+	writeFiles(c, filepath.Dir(path), map[string]string{"restore-state": "{"})
+	_, err := rplib.ReadRestoreState(path)
+	c.Check(err, ErrorMatches, "invalid restore state .*")
+}
@@ -74,7 +74,7 @@ func BlockSize(block string) (size int64) {
 func GetPartitionSize(device string, nr int) (size int64) {
 	var err error
 	line := Shellcmdoutput(fmt.Sprintf("parted -ms %s unit B print | grep \"^%d:\"", device, nr))
-	log.Printf("line:", line)
+	LogDebug("parted partition", "line", line)
 	fields := strings.Split(line, ":")
 	size, err = strconv.ParseInt(strings.TrimRight(fields[3], "B"), 10, 64)
 	Checkerr(err)
@@ -84,7 +84,7 @@ func GetPartitionSize(device string, nr int) (size int64) {
 func GetPartitionBeginEnd(device string, nr int) (begin, end int) {
 	var err error
 	line := Shellcmdoutput(fmt.Sprintf("parted -ms %s unit B print | grep \"^%d:\"", device, nr))
-	log.Printf("line:", line)
+	LogDebug("parted partition", "line", line)
 	fields := strings.Split(line, ":")
 	begin, err = strconv.Atoi(strings.TrimRight(fields[1], "B"))
 	Checkerr(err)
@@ -96,7 +96,7 @@ func GetPartitionBeginEnd(device string, nr int) (begin, end int) {
 func GetPartitionBeginEnd64(device string, nr int) (begin, end int64) {
 	var err error
 	line := Shellcmdoutput(fmt.Sprintf("parted -ms %s unit B print | grep \"^%d:\"", device, nr))
-	log.Printf("line:", line)
+	LogDebug("parted partition", "line", line)
 	fields := strings.Split(line, ":")
 	begin, err = strconv.ParseInt(strings.TrimRight(fields[1], "B"), 10, 64)
 	Checkerr(err)
@@ -107,13 +107,13 @@ func GetPartitionBeginEnd64(device string, nr int) (begin, end int64) {
 
 func GetBootEntries(keyword string) (entries []string) {
 	entryStr := Shellcmdoutput(fmt.Sprintf("efibootmgr -v | grep \"%s\" | cut -f 1 | sed 's/[^0-9]*//g'", keyword))
-	log.Printf("entryStr: [%s]\n", entryStr)
+	LogDebug("efibootmgr entries", "output", entryStr)
 	if "" == entryStr {
 		entries = []string{}
 	} else {
 		entries = strings.Split(entryStr, "\n")
 	}
-	log.Printf("entries:", entries)
+	LogDebug("boot entries", "entries", strings.Join(entries, ","))
 	return
 }
 
@@ -0,0 +1,341 @@
+package rplib
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The max length of FAT filesystem label
+const FAT_LABEL_MAX_LEN = 11
+
+// ConfigProblem is an error or warning found in config.yaml
+type ConfigProblem struct {
+	Line    int    // 0 if unknown
+	Key     string // e.g. "recovery.type"
+	Message string
+	Warning bool
+	// Strict is the warning at runtime which is an error in validation,
+	// e.g. the configs worked in the older versions
+	Strict bool
+}
+
+func (p ConfigProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	if p.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", p.Line, level, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", level, p.Message)
+}
+
+type byLine []ConfigProblem
+
+func (b byLine) Len() int           { return len(b) }
+func (b byLine) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLine) Less(i, j int) bool { return b[i].Line < b[j].Line }
+
+func configKeyDisplay(key string) string {
+	return strings.Replace(key, ".", " -> ", -1)
+}
+
+var configKeyRegexp = regexp.MustCompile(`^(\s*)([^\s#:-][^:#]*?)\s*:(\s|$)`)
+var configListKeyRegexp = regexp.MustCompile(`^(\s*)-(\s+)([^\s#:-][^:#]*?)\s*:(\s|$)`)
+
+// configKeyLines maps the key path (e.g. "recovery.type") to its line number.
+// It only understands the block mappings which config.yaml is written in,
+// the list items of mappings are indexed as "profiles.0.name".
+func configKeyLines(data []byte) (lines map[string]int, dups []ConfigProblem) {
+	type level struct {
+		indent int
+		key    string
+		item   bool
+	}
+	var stack []level
+	lines = make(map[string]int)
+	items := make(map[string]int)
+
+	path := func() string {
+		var keys []string
+		for _, l := range stack {
+			keys = append(keys, l.key)
+		}
+		return strings.Join(keys, ".")
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		var indent int
+		var name string
+		if m := configListKeyRegexp.FindStringSubmatch(line); m != nil {
+			// a new item of list, its keys are indented after "- "
+			dash := len(m[1])
+			for len(stack) > 0 && (stack[len(stack)-1].indent > dash || stack[len(stack)-1].item) {
+				stack = stack[:len(stack)-1]
+			}
+			parent := path()
+			stack = append(stack, level{dash, strconv.Itoa(items[parent]), true})
+			items[parent]++
+			indent, name = dash+1+len(m[2]), m[3]
+		} else if m := configKeyRegexp.FindStringSubmatch(line); m != nil {
+			indent, name = len(m[1]), m[2]
+			for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+				stack = stack[:len(stack)-1]
+			}
+		} else {
+			continue
+		}
+		stack = append(stack, level{indent, name, false})
+
+		key := path()
+		if first, ok := lines[key]; ok {
+			dups = append(dups, ConfigProblem{
+				Line:    i + 1,
+				Key:     key,
+				Message: fmt.Sprintf("'%s' is duplicated, first defined at line %d", configKeyDisplay(key), first),
+			})
+			continue
+		}
+		lines[key] = i + 1
+	}
+	return lines, dups
+}
+
+// knownConfigKeys collects the key paths accepted by the type, the same way
+// as yaml.v2 names the fields.
+func knownConfigKeys(t reflect.Type, prefix string, known map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		key := prefix + name
+		known[key] = true
+		if f.Type.Kind() == reflect.Struct {
+			knownConfigKeys(f.Type, key+".", known)
+		}
+	}
+}
+
+// unknownConfigKeys reports the keys not known, at is the prefix of the
+// reported key, e.g. "profiles.0." for the keys in a profile
+func unknownConfigKeys(raw map[interface{}]interface{}, prefix string, at string, known map[string]bool) (problems []ConfigProblem) {
+	for k, v := range raw {
+		key := prefix + fmt.Sprint(k)
+		if !known[key] {
+			problems = append(problems, ConfigProblem{Key: at + key, Message: fmt.Sprintf("unknown key '%s'", configKeyDisplay(at+key))})
+			continue
+		}
+		if sub, ok := v.(map[interface{}]interface{}); ok {
+			problems = append(problems, unknownConfigKeys(sub, key+".", at, known)...)
+		}
+	}
+	return problems
+}
+
+// validateConfigProfiles checks the keys of each profile, and the base config
+// merged with each profile
+func validateConfigProfiles(raw map[interface{}]interface{}, known map[string]bool) (problems []ConfigProblem) {
+	profiles, ok := raw["profiles"].([]interface{})
+	if !ok {
+		if _, ok := raw["profiles"]; ok {
+			problems = append(problems, ConfigProblem{Key: "profiles", Message: "'profiles' must be a list"})
+		}
+		return problems
+	}
+
+	matchKeys := make(map[string]bool)
+	knownConfigKeys(reflect.TypeOf(ConfigProfile{}), "", matchKeys)
+	base, err := yaml.Marshal(raw)
+	if err != nil {
+		return append(problems, ConfigProblem{Message: err.Error()})
+	}
+	// the problems of base config are reported once
+	var baseConfig ConfigRecovery
+	yaml.Unmarshal(base, &baseConfig)
+	baseProblems := make(map[string]bool)
+	for _, p := range baseConfig.checkConfigs() {
+		baseProblems[p.Message] = true
+	}
+
+	for i, item := range profiles {
+		at := fmt.Sprintf("profiles.%d.", i)
+		m, profile, err := decodeConfigProfile(item)
+		if err != nil {
+			problems = append(problems, ConfigProblem{Key: at[:len(at)-1], Message: fmt.Sprintf("invalid profile: %v", err)})
+			continue
+		}
+		if profile.Match == (ProfileMatch{}) {
+			problems = append(problems, ConfigProblem{Key: at + "match", Message: fmt.Sprintf("'%smatch' has no rules, the profile never matches", configKeyDisplay(at))})
+		}
+
+		sections := make(map[interface{}]interface{})
+		for k, v := range m {
+			switch k {
+			case "name":
+			case "match":
+				if match, ok := v.(map[interface{}]interface{}); ok {
+					problems = append(problems, unknownConfigKeys(match, "match.", at, matchKeys)...)
+				}
+			case "profiles", "schema-version":
+				problems = append(problems, ConfigProblem{Key: at + fmt.Sprint(k), Message: fmt.Sprintf("'%s' is not allowed in profile", k)})
+			default:
+				sections[k] = v
+			}
+		}
+		problems = append(problems, unknownConfigKeys(sections, "", at, known)...)
+
+		// the cross-field checks of base config merged with profile
+		var merged map[interface{}]interface{}
+		var config ConfigRecovery
+		yaml.Unmarshal(base, &merged)
+		mergeConfigProfile(merged, sections)
+		if data, err := yaml.Marshal(merged); err == nil {
+			yaml.Unmarshal(data, &config)
+		}
+		name := profile.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		for _, p := range config.checkConfigs() {
+			if baseProblems[p.Message] {
+				continue
+			}
+			p.Key = at + p.Key
+			p.Message = fmt.Sprintf("profile %q: %s", name, p.Message)
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+var yamlLineRegexp = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// yamlProblem converts the yaml.v2 error message "line N: ..." to problem
+func yamlProblem(msg string) ConfigProblem {
+	if m := yamlLineRegexp.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return ConfigProblem{Line: line, Message: m[2]}
+	}
+	return ConfigProblem{Message: msg}
+}
+
+// ValidateConfig checks the content of config.yaml and reports all the
+// errors and warnings, sorted by line number. The older schema is upgraded
+// with warnings, and the unknown keys after upgrade are errors.
+// If diskSizeMB is larger than 0, the partition sizes are checked against it.
+func ValidateConfig(data []byte, diskSizeMB int) (problems []ConfigProblem) {
+	var raw map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return []ConfigProblem{yamlProblem(strings.TrimPrefix(err.Error(), "yaml: "))}
+	}
+
+	lines, dups := configKeyLines(data)
+	problems = append(problems, dups...)
+
+	// the type errors are reported with the line numbers of original data
+	if err := yaml.Unmarshal(data, &ConfigRecovery{}); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, msg := range typeErr.Errors {
+				problems = append(problems, yamlProblem(msg))
+			}
+		} else {
+			problems = append(problems, yamlProblem(strings.TrimPrefix(err.Error(), "yaml: ")))
+		}
+	}
+
+	if raw == nil {
+		raw = make(map[interface{}]interface{})
+	}
+	migrated, err := migrateConfig(raw)
+	if err != nil {
+		problems = append(problems, ConfigProblem{Key: "schema-version", Message: err.Error()})
+		return fixConfigProblems(problems, lines)
+	}
+	problems = append(problems, migrated...)
+
+	known := make(map[string]bool)
+	knownConfigKeys(reflect.TypeOf(ConfigRecovery{}), "", known)
+	problems = append(problems, unknownConfigKeys(raw, "", "", known)...)
+	problems = append(problems, validateConfigProfiles(raw, known)...)
+
+	var config ConfigRecovery
+	if data, err := yaml.Marshal(raw); err == nil {
+		yaml.Unmarshal(data, &config)
+	}
+
+	problems = append(problems, config.checkConfigs()...)
+
+	if _, ok := lines["configs.swap"]; !ok {
+		problems = append(problems, ConfigProblem{Key: "configs", Message: "'configs -> swap' field not presented, swap is off", Warning: true})
+	}
+
+	if diskSizeMB > 0 {
+		total := config.Recovery.RecoverySize
+		if config.Configs.BootSize >= 50 {
+			total += config.Configs.BootSize
+		}
+		if config.Configs.Swap && !config.Configs.SwapFile && config.Configs.SwapSize > 0 {
+			total += config.Configs.SwapSize
+		}
+		if config.Configs.RootfsSize > 0 {
+			total += config.Configs.RootfsSize
+		}
+		if total > diskSizeMB {
+			problems = append(problems, ConfigProblem{
+				Key:     "recovery.recoverysize",
+				Message: fmt.Sprintf("the partitions need %d MB, larger than the disk size %d MB", total, diskSizeMB),
+			})
+		}
+	}
+
+	for i := range problems {
+		if problems[i].Strict {
+			problems[i].Warning = false
+		}
+	}
+	return fixConfigProblems(problems, lines)
+}
+
+// fixConfigProblems finds the line of key, or the line of its parent if
+// the key is not presented, and sorts the problems by line
+func fixConfigProblems(problems []ConfigProblem, lines map[string]int) []ConfigProblem {
+	for i := range problems {
+		for key := problems[i].Key; problems[i].Line == 0 && key != ""; {
+			problems[i].Line = lines[key]
+			if n := strings.LastIndex(key, "."); n >= 0 {
+				key = key[:n]
+			} else {
+				key = ""
+			}
+		}
+	}
+
+	SortConfigProblems(problems)
+	return problems
+}
+
+// SortConfigProblems sorts problems by line, the ones without a line first
+func SortConfigProblems(problems []ConfigProblem) {
+	sort.Stable(byLine(problems))
+}
+
+// ConfigHasErrors tells whether there is any error (not warning) in problems
+func ConfigHasErrors(problems []ConfigProblem) bool {
+	for _, p := range problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
@@ -1,19 +1,20 @@
 package rplib
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"strconv"
+	"path/filepath"
 	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
 type ConfigRecovery struct {
-	Project string
-	Snaps   struct {
+	SchemaVersion int `yaml:"schema-version"`
+	Project       string
+	Snaps         struct {
 		Kernel string
 		Os     string
 		Gadget string
@@ -37,85 +38,164 @@ type ConfigRecovery struct {
 		FsLabel                    string `yaml:"filesystem-label"`
 		RecoveryDevice             string `yaml:"recovery-device"`
 		SystemDevice               string `yaml:"system-device"`
-		InstallerFsLabel           string
+		InstallerFsLabel           string `yaml:"installer-filesystem-label"`
 		OemPreinstHookDir          string `yaml:"oem-preinst-hook-dir"`
 		OemPostinstHookDir         string `yaml:"oem-postinst-hook-dir"`
-		OemLogDir                  string
+		OemPrerebootHookDir        string `yaml:"oem-prereboot-hook-dir"`
+		OemPostPartitionHookDir    string `yaml:"oem-post-partition-hook-dir"`
+		OemInTargetHookDir         string `yaml:"oem-in-target-hook-dir"`
+		OemHiPreinstHookDir        string `yaml:"oem-headless-installer-preinst-hook-dir"`
+		OemLogDir                  string `yaml:"oem-log-dir"`
 		SkipFactoryDiagResult      string `yaml:"skip-factory-diag-result"`
 		RestoreConfirmPrehookFile  string `yaml:"restore-confirm-prehook-file"`
 		RestoreConfirmPosthookFile string `yaml:"restore-confirm-posthook-file"`
 		RestoreConfirmTimeoutSec   int64  `yaml:"restore-confirm-timeout"`
+		SerialConsole              string `yaml:"serial-console"`
+		Locale                     string `yaml:"locale"`              // of the messages in recovery/messages/, e.g. zh_TW
+		ProductName                string `yaml:"product-name"`        // shown in the messages, the DMI product name if not set
+		HookFailurePolicy          string `yaml:"hook-failure-policy"` // one of "ignore", "abort", "debug-shell"
+		HookTimeoutSec             int64  `yaml:"hook-timeout"`
+		// The grub pbkdf2 hash of the password asked before factory restore,
+		// the hash in RestorePasswordFile on recovery partition wins
+		RestorePassword        string `yaml:"restore-password"`
+		RestorePasswordFile    string `yaml:"restore-password-file"`
+		RestorePasswordRetries int    `yaml:"restore-password-retries"` // 3 if not set
+		RestorePasswordGrub    bool   `yaml:"restore-password-grub"`    // also protect the Factory Restore menuentry
+		// The payloads in recovery/factory/overlays/ applied in order,
+		// all of them in lexical order if not set
+		Overlays []string `yaml:"overlays,omitempty"`
 	}
+	Profiles []ConfigProfile `yaml:"profiles,omitempty"`
+
+	// The name of profile merged, not in config.yaml
+	Profile string `yaml:"-"`
 }
 
-func (config *ConfigRecovery) checkConfigs() (err error) {
-	log.Printf("check configs ... ")
+func (config *ConfigRecovery) checkConfigs() (problems []ConfigProblem) {
+	errorf := func(key string, format string, a ...interface{}) {
+		problems = append(problems, ConfigProblem{Key: key, Message: fmt.Sprintf(format, a...)})
+	}
+	warnf := func(key string, format string, a ...interface{}) {
+		problems = append(problems, ConfigProblem{Key: key, Message: fmt.Sprintf(format, a...), Warning: true})
+	}
+	// the warning at runtime for the configs in the field, error in
+	// validation. The checks added after the older versions are strict,
+	// which are handled at runtime as the comments below.
+	strictf := func(key string, format string, a ...interface{}) {
+		problems = append(problems, ConfigProblem{Key: key, Message: fmt.Sprintf(format, a...), Warning: true, Strict: true})
+	}
 
 	if config.Project == "" {
-		err = errors.New("'project' field not presented")
-		log.Printf(err.Error())
+		errorf("project", "'project' field not presented")
 	}
 
 	if config.Configs.Arch == "" {
-		err = errors.New("'configs -> arch' field not presented")
-		log.Printf(err.Error())
+		errorf("configs.arch", "'configs -> arch' field not presented")
 	} else if config.Configs.Arch != "amd64" && config.Configs.Arch != "arm" && config.Configs.Arch != "arm64" && config.Configs.Arch != "armhf" {
-		err = errors.New("'recovery -> arch' only accept \"amd64\" or \"arm\" or \"arm64\" or \"amdhf\"")
-		log.Printf(err.Error())
+		errorf("configs.arch", "'configs -> arch' only accept \"amd64\" or \"arm\" or \"arm64\" or \"armhf\", got %q", config.Configs.Arch)
 	}
 
 	if config.Configs.Release == "" {
-		err = errors.New("'configs -> release' field not presented")
-		log.Printf(err.Error())
+		errorf("configs.release", "'configs -> release' field not presented")
 	}
 
 	if config.Configs.PartitionType == "" {
-		err = errors.New("'recovery -> PartitionType' field not presented")
-		log.Printf(err.Error())
+		errorf("configs.partition-type", "'configs -> partition-type' field not presented")
 	} else if config.Configs.PartitionType != "gpt" && config.Configs.PartitionType != "mbr" {
-		err = errors.New("'recovery -> PartitionType' only accept \"gpt\" or \"mbr\"")
-		log.Printf(err.Error())
+		errorf("configs.partition-type", "'configs -> partition-type' only accept \"gpt\" or \"mbr\", got %q", config.Configs.PartitionType)
 	}
 
 	if config.Configs.Bootloader == "" {
-		err = errors.New("'recovery -> Bootloader' field not presented")
-		log.Printf(err.Error())
+		errorf("configs.bootloader", "'configs -> bootloader' field not presented")
 	} else if config.Configs.Bootloader != "grub" && config.Configs.Bootloader != "u-boot" {
-		err = errors.New("'recovery -> Bootloader' only accept \"grub\" or \"u-boot\"")
-		log.Printf(err.Error())
+		errorf("configs.bootloader", "'configs -> bootloader' only accept \"grub\" or \"u-boot\", got %q", config.Configs.Bootloader)
 	}
 
-	if config.Configs.Swap != true && config.Configs.Swap != false {
-		err = errors.New("'configs -> swap' field not presented")
-		log.Printf(err.Error())
+	if config.Configs.Swap {
+		if !config.Configs.SwapFile && config.Configs.SwapSize <= 0 {
+			// no swap partition is created at runtime
+			strictf("configs.swap", "'configs -> swapsize' must larger than 0 when 'configs -> swap' is on")
+		}
+	} else if config.Configs.SwapFile || config.Configs.SwapSize > 0 {
+		key := "configs.swapsize"
+		if config.Configs.SwapFile {
+			key = "configs.swapfile"
+		}
+		warnf(key, "'configs -> swapfile' and 'configs -> swapsize' are ignored when 'configs -> swap' is off")
 	}
 
-	if config.Configs.Swap == true {
-		if config.Configs.SwapFile != true && config.Configs.SwapFile != false && config.Configs.SwapSize <= 0 {
-			err = errors.New("'configs -> swapsize' or 'configs -> swapfile' not presented")
-			log.Printf(err.Error())
-		}
+	if config.Configs.BootSize != 0 && config.Configs.BootSize < 50 {
+		warnf("configs.bootsize", "'configs -> bootsize' must be at least 50, %d is ignored", config.Configs.BootSize)
 	}
 
 	if config.Recovery.Type == "" {
-		err = errors.New("'recovery -> type' field not presented")
-		log.Printf(err.Error())
+		errorf("recovery.type", "'recovery -> type' field not presented")
 	} else if config.Recovery.Type != FACTORY_RESTORE && config.Recovery.Type != HEADLESS_INSTALLER && config.Recovery.Type != FACTORY_INSTALL {
-		err = errors.New(fmt.Sprintf("'recovery -> type' only accept", FACTORY_RESTORE, HEADLESS_INSTALLER, FACTORY_INSTALL))
-		log.Printf(err.Error())
+		errorf("recovery.type", "'recovery -> type' only accept %q or %q or %q, got %q", FACTORY_RESTORE, HEADLESS_INSTALLER, FACTORY_INSTALL, config.Recovery.Type)
 	}
 
 	if config.Recovery.RecoverySize <= 0 {
-		err = errors.New("'recovery -> recoverysize' must larger than 0")
-		log.Printf(err.Error())
+		errorf("recovery.recoverysize", "'recovery -> recoverysize' must larger than 0")
 	}
 
 	if config.Recovery.FsLabel == "" {
-		err = errors.New("'recovery -> filesystem-label' field not presented")
-		log.Printf(err.Error())
+		errorf("recovery.filesystem-label", "'recovery -> filesystem-label' field not presented")
+	} else if len(config.Recovery.FsLabel) > FAT_LABEL_MAX_LEN {
+		// the recovery partition is always vfat
+		strictf("recovery.filesystem-label", "'recovery -> filesystem-label' %q is longer than %d characters of FAT label", config.Recovery.FsLabel, FAT_LABEL_MAX_LEN)
+	}
+
+	if len(config.Recovery.InstallerFsLabel) > FAT_LABEL_MAX_LEN {
+		warnf("recovery.installer-filesystem-label", "'recovery -> installer-filesystem-label' %q is longer than %d characters of FAT label", config.Recovery.InstallerFsLabel, FAT_LABEL_MAX_LEN)
+	}
+
+	for _, overlay := range config.Recovery.Overlays {
+		if filepath.Base(overlay) != overlay || !IsOverlayPayload(overlay) {
+			// skipped at runtime
+			strictf("recovery.overlays", "'recovery -> overlays' only accept the .tar, .tar.xz, .tar.gz, .tgz or .squashfs file names, got %q", overlay)
+		}
+	}
+
+	switch config.Recovery.HookFailurePolicy {
+	case "", "ignore", "abort", "debug-shell":
+	default:
+		// ignore at runtime
+		strictf("recovery.hook-failure-policy", "'recovery -> hook-failure-policy' only accept \"ignore\" or \"abort\" or \"debug-shell\", got %q", config.Recovery.HookFailurePolicy)
 	}
 
-	return err
+	if config.Recovery.HookTimeoutSec < 0 {
+		// no timeout at runtime
+		strictf("recovery.hook-timeout", "'recovery -> hook-timeout' must not be negative")
+	}
+
+	if config.Recovery.RestoreConfirmTimeoutSec < 0 {
+		// 300 seconds at runtime
+		strictf("recovery.restore-confirm-timeout", "'recovery -> restore-confirm-timeout' must not be negative")
+	}
+
+	if config.Recovery.RestorePassword != "" {
+		if _, err := ParsePasswordHash(config.Recovery.RestorePassword); err != nil {
+			// the restore is refused at runtime
+			strictf("recovery.restore-password", "'recovery -> restore-password' %v, see grub-mkpasswd-pbkdf2", err)
+		}
+	}
+	if config.Recovery.RestorePasswordRetries < 0 {
+		// the default retries at runtime
+		strictf("recovery.restore-password-retries", "'recovery -> restore-password-retries' must not be negative")
+	}
+	if config.Recovery.RestorePasswordGrub && config.Recovery.RestorePassword == "" && config.Recovery.RestorePasswordFile == "" {
+		warnf("recovery.restore-password-grub", "'recovery -> restore-password-grub' is ignored without restore-password or restore-password-file")
+	}
+
+	if consoles := splitConsoles(config.Recovery.SerialConsole); !(len(consoles) == 1 && consoles[0] == CONSOLE_NULL) {
+		for _, name := range consoles {
+			if !IsConsoleName(name) {
+				warnf("recovery.serial-console", "'recovery -> serial-console' %q is not a VT or ttyS/ttyAMA/ttyUSB serial port, ignored", name)
+			}
+		}
+	}
+
+	return problems
 }
 
 func (config *ConfigRecovery) Load(configFile string) error {
@@ -126,15 +206,63 @@ func (config *ConfigRecovery) Load(configFile string) error {
 		return err
 	}
 
-	// Parse config file and store in configs
-	err = yaml.Unmarshal(yamlFile, &config)
+	// Parse config file and store in configs, the older schema is upgraded
+	migrated, err := parseConfig(yamlFile, config)
 	if err != nil {
 		return err
 	}
+	for _, p := range migrated {
+		log.Println(p)
+	}
 
 	// Check if there is any config missing
-	err = config.checkConfigs()
-	return err
+	log.Printf("check configs ... ")
+	var errs []string
+	for _, p := range config.checkConfigs() {
+		log.Println(p)
+		if !p.Warning {
+			errs = append(errs, p.Message)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config %s: %s", configFile, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// LoadHookConfig loads only the hook settings of configFile into config: the
+// hook directories, timeout and failure policy, with the overrides of cmdline
+// and environ. The problems of the other settings do not stop the hooks, and
+// the invalid hook settings are logged and fall back as at runtime.
+func (config *ConfigRecovery) LoadHookConfig(configFile string, cmdline string, environ []string) error {
+	log.Printf("Loading the hook settings of %s ...", configFile)
+	yamlFile, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	var loaded ConfigRecovery
+	if _, err := parseConfig(yamlFile, &loaded); err != nil {
+		return err
+	}
+	_, errs := loaded.ApplyOverrides(cmdline, environ)
+	for _, err := range errs {
+		log.Println("Ignore the config override:", err)
+	}
+	for _, p := range loaded.checkConfigs() {
+		if strings.HasPrefix(p.Key, "recovery.hook-") || strings.HasPrefix(p.Key, "recovery.oem-") {
+			log.Println(p)
+		}
+	}
+
+	config.Recovery.OemPreinstHookDir = loaded.Recovery.OemPreinstHookDir
+	config.Recovery.OemPostinstHookDir = loaded.Recovery.OemPostinstHookDir
+	config.Recovery.OemPrerebootHookDir = loaded.Recovery.OemPrerebootHookDir
+	config.Recovery.OemPostPartitionHookDir = loaded.Recovery.OemPostPartitionHookDir
+	config.Recovery.OemInTargetHookDir = loaded.Recovery.OemInTargetHookDir
+	config.Recovery.HookFailurePolicy = loaded.Recovery.HookFailurePolicy
+	config.Recovery.HookTimeoutSec = loaded.Recovery.HookTimeoutSec
+	return nil
 }
 
 func (config *ConfigRecovery) String() string {
@@ -145,6 +273,36 @@ func (config *ConfigRecovery) String() string {
 	return string(io)
 }
 
+// jsonValue converts the maps decoded by yaml.v2 to the maps encoding/json accepts
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+// MarshalJSON encodes config with the same key names as config.yaml
+func (config *ConfigRecovery) MarshalJSON() ([]byte, error) {
+	data, err := yaml.Marshal(*config)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(raw))
+}
+
 // The Gadget yaml parsing from snapd/snap/gadget.go
 type GadgetInfo struct {
 	Volumes map[string]GadgetVolume `yaml:"volumes,omitempty"`
@@ -163,6 +321,7 @@ type GadgetVolume struct {
 type VolumeStructure struct {
 	Name        string          `yaml:"name"`
 	Label       string          `yaml:"filesystem-label"`
+	Role        string          `yaml:"role"`
 	Offset      string          `yaml:"offset"`
 	OffsetWrite string          `yaml:"offset-write"`
 	Size        string          `yaml:"size"`
@@ -201,32 +360,20 @@ func (gadgetInfo *GadgetInfo) Load(gadgetYaml string) error {
 }
 
 func (gadgetInfo *GadgetInfo) GetVolumeSizebyLabel(FsLabel string) (sizeMB int, err error) {
-	sizeMB = 0
-	err = nil
-
 	if gadgetInfo == nil {
-		sizeMB = 0
-		err = fmt.Errorf("nil gadgetInfo")
-		return
+		return 0, fmt.Errorf("nil gadgetInfo")
 	}
 
-	// find system-boot and make copy
 	for _, v := range gadgetInfo.Volumes {
 		for _, st := range v.Structure {
 			if st.Label == FsLabel {
-				if strings.Contains(st.Size, "M") {
-					sizeMB, err = strconv.Atoi(strings.Trim(st.Size, "M"))
-				} else if strings.Contains(st.Size, "G") {
-					if size, err := strconv.Atoi(strings.Trim(st.Size, "G")); err == nil {
-						sizeMB = size * 1024
-					}
-				} else {
-					if size, err := strconv.Atoi(string(st.Size)); err == nil {
-						sizeMB = size / 1024
-					}
+				size, err := ParseGadgetSize(st.Size)
+				if err != nil {
+					return 0, err
 				}
+				return int(size / (1024 * 1024)), nil
 			}
 		}
 	}
-	return
+	return 0, fmt.Errorf("structure with filesystem-label %q not found", FsLabel)
 }
@@ -1,6 +1,12 @@
 package rplib_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
@@ -28,3 +34,397 @@ func (s *YamlSuite) TestGetVolumeSizebyLabel(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(sizeMB, Equals, 50)
 }
+
+func (s *YamlSuite) TestLoadReportsAllErrors(c *C) {
+	config := filepath.Join(c.MkDir(), "config.yaml")
+	err := ioutil.WriteFile(config, []byte("project: pi3\nconfigs:\n  arch: x86\n"), 0644)
+	c.Assert(err, IsNil)
+
+	var configs rplib.ConfigRecovery
+	err = configs.Load(config)
+	c.Assert(err, NotNil)
+	c.Check(err, ErrorMatches, `.*'configs -> arch' only accept.*"x86".*`)
+	c.Check(err, ErrorMatches, `.*'recovery -> type' field not presented.*`)
+	c.Check(err, ErrorMatches, `.*'recovery -> filesystem-label' field not presented.*`)
+}
+
+func (s *YamlSuite) TestLoadLongFsLabel(c *C) {
+	// the long label worked in the older versions, an error in validation only
+	data, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	data = bytes.Replace(data, []byte("filesystem-label: ESP"), []byte("filesystem-label: RECOVERY-PART"), 1)
+	config := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(ioutil.WriteFile(config, data, 0644), IsNil)
+
+	var configs rplib.ConfigRecovery
+	c.Assert(configs.Load(config), IsNil)
+	c.Check(configs.Recovery.FsLabel, Equals, "RECOVERY-PART")
+
+	c.Check(rplib.ConfigHasErrors(rplib.ValidateConfig(data, 0)), Equals, true)
+}
+
+func (s *YamlSuite) TestLoadNewChecksWarning(c *C) {
+	// the checks added after the older versions warn at runtime
+	data, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	data = bytes.Replace(data, []byte("swapsize: 1024"), []byte("swapsize: 0\n  swapfile: off"), 1)
+	data = append(data, []byte("  hook-failure-policy: retry\n  hook-timeout: -1\n  restore-password-retries: -1\n  overlays: [../escape.tar]\n")...)
+	config := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(ioutil.WriteFile(config, data, 0644), IsNil)
+
+	var configs rplib.ConfigRecovery
+	c.Assert(configs.Load(config), IsNil)
+
+	problems := rplib.ValidateConfig(data, 0)
+	var errs []string
+	for _, p := range problems {
+		if !p.Warning {
+			errs = append(errs, p.Key)
+		}
+	}
+	c.Check(errs, DeepEquals, []string{"configs.swap", "recovery.hook-failure-policy", "recovery.hook-timeout", "recovery.restore-password-retries", "recovery.overlays"})
+}
+
+func (s *YamlSuite) TestLoadHookConfig(c *C) {
+	// the other invalid settings do not stop the hooks
+	data, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	data = bytes.Replace(data, []byte("partition-type: "), []byte("partition-type: x"), 1)
+	data = append(data, []byte("  oem-preinst-hook-dir: my-prehook\n  hook-failure-policy: abort\n  hook-timeout: 60\n")...)
+	config := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(ioutil.WriteFile(config, data, 0644), IsNil)
+
+	var configs rplib.ConfigRecovery
+	c.Check(configs.Load(config), NotNil)
+
+	configs = rplib.ConfigRecovery{}
+	c.Assert(configs.LoadHookConfig(config, "recovery.cfg.recovery.hook-timeout=30", nil), IsNil)
+	c.Check(configs.Recovery.OemPreinstHookDir, Equals, "my-prehook")
+	c.Check(configs.Recovery.HookFailurePolicy, Equals, "abort")
+	c.Check(configs.Recovery.HookTimeoutSec, Equals, int64(30))
+	c.Check(configs.Configs.PartitionType, Equals, "")
+
+	c.Check(configs.LoadHookConfig(filepath.Join(c.MkDir(), "missing.yaml"), "", nil), NotNil)
+}
+
+func (s *YamlSuite) TestValidateConfig(c *C) {
+	data, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	problems := rplib.ValidateConfig(data, 0)
+	c.Check(rplib.ConfigHasErrors(problems), Equals, false)
+
+	data = []byte(`project: pi3
+configs:
+  arch: armhf
+  swap: on
+  release: 16
+  partition-type: mbr
+  bootloader: u-boot
+  serial: ttyS0
+recovery:
+  type: factory_restor
+  recoverysize: 768
+  filesystem-label: RECOVERY-PART
+  recoverysize: 1024
+`)
+	problems = rplib.ValidateConfig(data, 0)
+	c.Assert(problems, HasLen, 5)
+	c.Check(problems[0].Line, Equals, 4)
+	c.Check(problems[0].Message, Matches, `'configs -> swapsize' must larger than 0.*`)
+	c.Check(problems[1].Line, Equals, 8)
+	c.Check(problems[1].Message, Equals, `unknown key 'configs -> serial'`)
+	c.Check(problems[2].Line, Equals, 10)
+	c.Check(problems[2].Message, Matches, `'recovery -> type' only accept.*"factory_restor"`)
+	c.Check(problems[3].Line, Equals, 12)
+	c.Check(problems[3].Message, Matches, `.*longer than 11 characters of FAT label`)
+	c.Check(problems[4].Line, Equals, 13)
+	c.Check(problems[4].Message, Matches, `'recovery -> recoverysize' is duplicated, first defined at line 11`)
+	c.Check(rplib.ConfigHasErrors(problems), Equals, true)
+}
+
+func (s *YamlSuite) TestValidateConfigTypeError(c *C) {
+	data, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	data = bytes.Replace(data, []byte("recoverysize: 768"), []byte("recoverysize: 768M"), 1)
+
+	problems := rplib.ValidateConfig(data, 0)
+	var errs []rplib.ConfigProblem
+	for _, p := range problems {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	c.Assert(errs, Not(HasLen), 0)
+	c.Check(errs[0].Line, Equals, 17)
+	c.Check(errs[0].Message, Matches, "cannot unmarshal !!str `768M` into int")
+}
+
+func (s *YamlSuite) TestValidateConfigDiskSize(c *C) {
+	data, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+
+	problems := rplib.ValidateConfig(data, 1024)
+	c.Assert(problems, HasLen, 3)
+	c.Check(problems[1].Line, Equals, 17)
+	c.Check(problems[1].Message, Equals, "the partitions need 1792 MB, larger than the disk size 1024 MB")
+
+	problems = rplib.ValidateConfig(data, 4096)
+	c.Check(rplib.ConfigHasErrors(problems), Equals, false)
+}
+
+func (s *YamlSuite) TestValidateConfigSwapOff(c *C) {
+	problems := rplib.ValidateConfig([]byte("project: pi3\nconfigs:\n  swapsize: 512\n"), 0)
+	var warnings []string
+	for _, p := range problems {
+		if p.Warning {
+			warnings = append(warnings, p.String())
+		}
+	}
+	c.Check(warnings, DeepEquals, []string{
+		"line 2: warning: 'configs -> swap' field not presented, swap is off",
+		"line 3: warning: 'configs -> swapfile' and 'configs -> swapsize' are ignored when 'configs -> swap' is off",
+	})
+}
+
+func (s *YamlSuite) TestLoadMigratesSchema(c *C) {
+	// test_data/config.yaml is schema-version 1
+	var configs rplib.ConfigRecovery
+	err := configs.Load("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	c.Check(configs.SchemaVersion, Equals, rplib.CONFIG_SCHEMA_VERSION)
+	c.Check(configs.Recovery.InstallerFsLabel, Equals, "INSTALLER")
+	c.Check(configs.Recovery.OemLogDir, Equals, "MFGMEDIA")
+}
+
+func (s *YamlSuite) TestLoadRejectsNewerSchema(c *C) {
+	data, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	config := filepath.Join(c.MkDir(), "config.yaml")
+	err = ioutil.WriteFile(config, append([]byte("schema-version: 99\n"), data...), 0644)
+	c.Assert(err, IsNil)
+
+	var configs rplib.ConfigRecovery
+	err = configs.Load(config)
+	c.Check(err, ErrorMatches, `'schema-version' 99 is newer than the supported version 2, .*`)
+
+	problems := rplib.ValidateConfig(append([]byte("schema-version: 99\n"), data...), 0)
+	c.Assert(problems, HasLen, 1)
+	c.Check(problems[0].Line, Equals, 1)
+}
+
+func (s *YamlSuite) TestValidateConfigMigration(c *C) {
+	data, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+
+	problems := rplib.ValidateConfig(data, 0)
+	c.Assert(problems, HasLen, 2)
+	c.Check(problems[0].String(), Equals, "line 16: warning: 'recovery -> installerfslabel' is renamed to 'recovery -> installer-filesystem-label' in schema-version 2")
+	c.Check(problems[1].String(), Equals, "line 22: warning: 'recovery -> oemlogdir' is renamed to 'recovery -> oem-log-dir' in schema-version 2")
+
+	// both the old and new keys
+	data = append(data, []byte("  oem-log-dir: LOGS\n")...)
+	problems = rplib.ValidateConfig(data, 0)
+	c.Assert(problems, HasLen, 2)
+	c.Check(problems[1].Message, Equals, "'recovery -> oemlogdir' is ignored, 'recovery -> oem-log-dir' is set")
+}
+
+func (s *YamlSuite) TestApplyOverrides(c *C) {
+	var configs rplib.ConfigRecovery
+	err := configs.Load("test_data/config.yaml")
+	c.Assert(err, IsNil)
+
+	cmdline := "BOOT_IMAGE=/vmlinuz recovery.cfg.configs.swapsize=2G recovery.cfg.recovery.restore-confirm-timeout=60 quiet"
+	environ := []string{"PATH=/bin", "RECOVERY_CFG_CONFIGS_SWAPSIZE=512", "RECOVERY_CFG_RECOVERY_OEM_LOG_DIR=LOGS", "RECOVERY_CFG_CONFIGS_SWAPFILE=on"}
+	overrides, errs := configs.ApplyOverrides(cmdline, environ)
+	c.Assert(errs, HasLen, 0)
+	c.Assert(overrides, HasLen, 5)
+	c.Check(overrides[0].String(), Equals, `'configs -> swapsize' is overridden to "512" by environment RECOVERY_CFG_CONFIGS_SWAPSIZE`)
+	c.Check(overrides[3].String(), Equals, `'configs -> swapsize' is overridden to "2G" by kernel cmdline`)
+
+	// kernel cmdline wins
+	c.Check(configs.Configs.SwapSize, Equals, 2048)
+	c.Check(configs.Configs.SwapFile, Equals, true)
+	c.Check(configs.Recovery.OemLogDir, Equals, "LOGS")
+	c.Check(configs.Recovery.RestoreConfirmTimeoutSec, Equals, int64(60))
+}
+
+func (s *YamlSuite) TestMarshalJSON(c *C) {
+	var configs rplib.ConfigRecovery
+	err := configs.Load("test_data/config.yaml")
+	c.Assert(err, IsNil)
+
+	data, err := json.Marshal(&configs)
+	c.Assert(err, IsNil)
+	var m struct {
+		Configs  map[string]interface{} `json:"configs"`
+		Recovery map[string]interface{} `json:"recovery"`
+	}
+	c.Assert(json.Unmarshal(data, &m), IsNil)
+	c.Check(m.Recovery["filesystem-label"], Equals, configs.Recovery.FsLabel)
+	c.Check(m.Configs["swapsize"], Equals, float64(configs.Configs.SwapSize))
+}
+
+func (s *YamlSuite) TestApplyOverridesInvalid(c *C) {
+	var configs rplib.ConfigRecovery
+	err := configs.Load("test_data/config.yaml")
+	c.Assert(err, IsNil)
+
+	// the invalid ones are ignored, the valid ones applied
+	cmdline := "recovery.cfg.configs.foo=1 recovery.cfg.configs.swapsize=big recovery.cfg.swap recovery.cfg.recovery.oem-log-dir=LOGS"
+	environ := []string{"RECOVERY_CFG_CONFIGS_ARCH=x86", "RECOVERY_CFG_FOO=1"}
+	overrides, errs := configs.ApplyOverrides(cmdline, environ)
+	c.Assert(overrides, HasLen, 1)
+	c.Check(overrides[0].Key, Equals, "recovery.oem-log-dir")
+	c.Check(configs.Recovery.OemLogDir, Equals, "LOGS")
+
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	c.Assert(msgs, HasLen, 5)
+	c.Check(msgs[0], Equals, "unknown config key in environment RECOVERY_CFG_FOO")
+	c.Check(msgs[1], Equals, `unknown config key in kernel cmdline "recovery.cfg.configs.foo=1"`)
+	c.Check(msgs[2], Equals, `invalid config override "recovery.cfg.swap" in kernel cmdline, should be recovery.cfg.<key>=<value>`)
+	c.Check(msgs[3], Matches, `invalid config after override by environment RECOVERY_CFG_CONFIGS_ARCH: 'configs -> arch' only accept .*`)
+	c.Check(msgs[4], Equals, `'configs -> swapsize' expects an integer, got "big" by kernel cmdline`)
+	// reverted
+	c.Check(configs.Configs.Arch, Equals, "armhf")
+
+	data, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	c.Check(rplib.ConfigHasErrors(rplib.ValidateOverrides(data, cmdline, nil)), Equals, true)
+	c.Check(rplib.ValidateOverrides(data, "recovery.cfg.configs.swapsize=2G", nil), HasLen, 0)
+}
+
+const profilesConfig = `schema-version: 2
+project: gateway
+configs:
+  arch: amd64
+  swap: on
+  swapsize: 512
+  release: 18
+  partition-type: gpt
+  bootloader: grub
+recovery:
+  type: factory_install
+  recoverysize: 768
+  filesystem-label: ESP
+profiles:
+  - name: gateway-5000
+    match:
+      product-name: "Gateway 5000*"
+      sys-vendor: ACME
+    configs:
+      swapsize: 2048
+      kernelpackage: linux-oem
+  - name: pi3
+    match:
+      compatible: "raspberrypi,3-model-b"
+    configs:
+      arch: armhf
+      bootloader: u-boot
+`
+
+func writeSysfs(c *C, files map[string]string) string {
+	root := c.MkDir()
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		c.Assert(os.MkdirAll(filepath.Dir(p), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(p, []byte(content), 0644), IsNil)
+	}
+	return root
+}
+
+func (s *YamlSuite) loadProfilesConfig(c *C, sysfs string) rplib.ConfigRecovery {
+	oldSysfsRoot := rplib.SysfsRoot
+	rplib.SysfsRoot = sysfs
+	defer func() { rplib.SysfsRoot = oldSysfsRoot }()
+
+	config := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(ioutil.WriteFile(config, []byte(profilesConfig), 0644), IsNil)
+	var configs rplib.ConfigRecovery
+	c.Assert(configs.Load(config), IsNil)
+	return configs
+}
+
+func (s *YamlSuite) TestLoadProfileDMI(c *C) {
+	sysfs := writeSysfs(c, map[string]string{
+		"class/dmi/id/product_name": "Gateway 5000 Pro\n",
+		"class/dmi/id/sys_vendor":   "ACME\n",
+	})
+	configs := s.loadProfilesConfig(c, sysfs)
+	c.Check(configs.Profile, Equals, "gateway-5000")
+	c.Check(configs.Configs.SwapSize, Equals, 2048)
+	c.Check(configs.Configs.KernelPackage, Equals, "linux-oem")
+	// not in profile
+	c.Check(configs.Configs.Arch, Equals, "amd64")
+	c.Check(configs.Recovery.FsLabel, Equals, "ESP")
+}
+
+func (s *YamlSuite) TestLoadProfileDeviceTree(c *C) {
+	sysfs := writeSysfs(c, map[string]string{
+		"firmware/devicetree/base/compatible": "raspberrypi,3-model-b\x00brcm,bcm2837\x00",
+	})
+	configs := s.loadProfilesConfig(c, sysfs)
+	c.Check(configs.Profile, Equals, "pi3")
+	c.Check(configs.Configs.Arch, Equals, "armhf")
+	c.Check(configs.Configs.Bootloader, Equals, "u-boot")
+	c.Check(configs.Configs.SwapSize, Equals, 512)
+}
+
+func (s *YamlSuite) TestLoadProfileNoMatch(c *C) {
+	sysfs := writeSysfs(c, map[string]string{
+		"class/dmi/id/product_name": "Gateway 5000\n",
+		"class/dmi/id/sys_vendor":   "Other\n",
+	})
+	configs := s.loadProfilesConfig(c, sysfs)
+	c.Check(configs.Profile, Equals, "")
+	c.Check(configs.Configs.SwapSize, Equals, 512)
+}
+
+func (s *YamlSuite) TestValidateConfigProfiles(c *C) {
+	problems := rplib.ValidateConfig([]byte(profilesConfig), 0)
+	c.Check(problems, HasLen, 0)
+
+	data := profilesConfig + `  - name: broken
+    match:
+      product: foo
+    configs:
+      arch: x86
+      swapsize-mb: 1
+`
+	problems = rplib.ValidateConfig([]byte(data), 0)
+	var msgs []string
+	for _, p := range problems {
+		msgs = append(msgs, p.String())
+	}
+	c.Check(msgs, DeepEquals, []string{
+		"line 29: error: 'profiles -> 2 -> match' has no rules, the profile never matches",
+		"line 30: error: unknown key 'profiles -> 2 -> match -> product'",
+		`line 32: error: profile "broken": 'configs -> arch' only accept "amd64" or "arm" or "arm64" or "armhf", got "x86"`,
+		"line 33: error: unknown key 'profiles -> 2 -> configs -> swapsize-mb'",
+	})
+}
+
+func (s *YamlSuite) TestLoadProfileMigratesSchema(c *C) {
+	// schema-version 1, the renamed keys in profile are upgraded too
+	data := strings.Replace(profilesConfig, "schema-version: 2\n", "", 1) + `    recovery:
+      oemlogdir: PI3LOG
+`
+	oldSysfsRoot := rplib.SysfsRoot
+	rplib.SysfsRoot = writeSysfs(c, map[string]string{
+		"firmware/devicetree/base/compatible": "raspberrypi,3-model-b\x00",
+	})
+	defer func() { rplib.SysfsRoot = oldSysfsRoot }()
+
+	config := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(ioutil.WriteFile(config, []byte(data), 0644), IsNil)
+	var configs rplib.ConfigRecovery
+	c.Assert(configs.Load(config), IsNil)
+	c.Check(configs.Profile, Equals, "pi3")
+	c.Check(configs.Recovery.OemLogDir, Equals, "PI3LOG")
+
+	problems := rplib.ValidateConfig([]byte(data), 0)
+	c.Assert(problems, HasLen, 1)
+	c.Check(problems[0].String(), Equals, "line 28: warning: 'profiles -> 1 -> recovery -> oemlogdir' is renamed to 'profiles -> 1 -> recovery -> oem-log-dir' in schema-version 2")
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	uenv "github.com/mvo5/uboot-go/uenv"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+// The steps of recovery, in order
+const (
+	STEP_CONFIRM            = "confirm"
+	STEP_BACKUP_ASSERTIONS  = "backup-assertions"
+	STEP_PARTITION          = "partition"
+	STEP_MOUNT              = "mount"
+	STEP_SNAPS              = "snaps"
+	STEP_FSTAB              = "fstab"
+	STEP_RESTORE_ASSERTIONS = "restore-assertions"
+	STEP_BOOTLOADER         = "bootloader"
+	STEP_IN_TARGET_HOOKS    = "in-target-hooks"
+)
+
+var stepNames = []string{STEP_CONFIRM, STEP_BACKUP_ASSERTIONS, STEP_PARTITION, STEP_MOUNT, STEP_SNAPS, STEP_FSTAB, STEP_RESTORE_ASSERTIONS, STEP_BOOTLOADER, STEP_IN_TARGET_HOOKS}
+
+const (
+	// The progress of recovery on recovery partition, to resume after the
+	// power is lost
+	RESTORE_STATE = RECO_ROOT_DIR + "recovery/restore-state"
+	// The interrupted recovery is resumed at most the times, then starts over
+	RESTORE_RESUME_ATTEMPTS = 3
+)
+
+var restoreState *rplib.RestoreState
+
+// confirmRestore asks the user to confirm the factory restore, and exits to
+// reboot if not confirmed
+func confirmRestore(recoveryos string) error {
+	timeout := configs.Recovery.RestoreConfirmTimeoutSec
+	if timeout <= 0 {
+		timeout = 300
+	}
+	if ConfirmRecovery(timeout, recoveryos) == false {
+		os.Exit(0x55) //ERESTART
+	}
+	return nil
+}
+
+// mountPartitions mounts writable and system-boot to restore data, and
+// streams the log to writable
+func mountPartitions(parts *Partitions, recoveryos string) error {
+	for _, dir := range []string{WRITABLE_MNT_DIR, SYSBOOT_MNT_DIR} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := mounts.Mount(fmtPartPath(parts.TargetDevPath, parts.Writable_nr), WRITABLE_MNT_DIR, "ext4", 0, ""); err != nil {
+		return err
+	}
+	if err := enableLogger(recoveryLogPath(recoveryos)); err != nil {
+		return err
+	}
+	if err := mounts.Mount(fmtPartPath(parts.TargetDevPath, parts.Sysboot_nr), SYSBOOT_MNT_DIR, "vfat", 0, ""); err != nil {
+		return err
+	}
+
+	// Ubuntu core default is using EFI directory for boot partition
+	// Here to support both efi/EFI direcroty for classic and core
+	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CORE {
+		if err := find_efi_dir(); err != nil {
+			return err
+		}
+	}
+	showProgress(70, msg(rplib.MSG_PROGRESS_CONFIGURE))
+	return nil
+}
+
+// installBootloader updates the bootloader config and boot entries of the
+// restored system
+func installBootloader(parts *Partitions, recoveryos string) error {
+	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC_CURTIN {
+		// Update grub menu configs if using curtin
+		writable_uuid := rplib.Shellcmdoutput(fmt.Sprintf("blkid -s UUID -o value %s", fmtPartPath(parts.TargetDevPath, parts.Writable_nr)))
+		err := grubInstall(WRITABLE_MNT_DIR, SYSBOOT_MNT_DIR, recoveryos, false, configs.Configs.Swap, configs.Configs.SwapFile, fmt.Sprintf("UUID=%s", writable_uuid))
+		if err != nil {
+			log.Println(err)
+		}
+		return nil
+	}
+
+	if configs.Configs.Bootloader == "u-boot" {
+		// update uboot env
+		log.Println("[Update uboot env]")
+		return updateUbootEnv(RecoveryLabel)
+	} else if configs.Configs.Bootloader != "grub" {
+		return nil
+	}
+
+	log.Println("[Update grub cfg/env]")
+	var grub_cfg string
+	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CORE {
+		grub_cfg = SYSBOOT_GRUB_CFG
+	} else if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC {
+		grub_cfg = WRITABLE_GRUB_40_CUSTOM
+	}
+	// mount as writable before editing
+	err := rplib.WithWritable(RECO_ROOT_DIR, func() error {
+		return updateGrubCfg(RecoveryLabel, grub_cfg, RECO_PART_GRUB_ENV, recoveryos)
+	})
+	if err != nil {
+		return err
+	}
+
+	// update efi Boot Entries
+	log.Println("[Update boot entries]")
+	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CORE {
+		updateBootEntries(parts, getBootEntryName(RecoveryOS))
+	} else if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC {
+		// grub install also updates the boot entries
+		if configs.Configs.Swap {
+			grubInstall(WRITABLE_MNT_DIR, SYSBOOT_MNT_DIR, recoveryos, true, true, configs.Configs.SwapFile, fmtPartPath(parts.TargetDevPath, parts.Writable_nr))
+		} else {
+			grubInstall(WRITABLE_MNT_DIR, SYSBOOT_MNT_DIR, recoveryos, true, false, configs.Configs.SwapFile, "")
+		}
+	}
+	return nil
+}
+
+// restoreSteps returns the steps of recovery, the step names are shown in
+// the log and progress. If arm, the recovery boot is armed before
+// repartitioning and after the partitions are mounted, which is at every
+// resume.
+func restoreSteps(parts *Partitions, recoveryos string, arm bool) []rplib.Step {
+	notRestore := func() bool { return RecoveryType != rplib.FACTORY_RESTORE }
+	notOS := func(os string) func() bool {
+		return func() bool { return recoveryos != os }
+	}
+
+	return []rplib.Step{
+		{Name: STEP_CONFIRM, Skip: notRestore, Run: func() error {
+			return confirmRestore(recoveryos)
+		}},
+		{Name: STEP_BACKUP_ASSERTIONS, Skip: notRestore, Run: func() error {
+			BackupAssertions(parts)
+			return nil
+		}},
+		{Name: STEP_PARTITION, Destructive: true, Run: func() error {
+			showProgress(10, msg(rplib.MSG_PROGRESS_PARTITION))
+			restoreStart = time.Now()
+			if arm {
+				armRecoveryBoot(parts, recoveryos)
+			}
+			log.Println("[rebuild the partitions]")
+			return restoreParts(parts, configs.Configs.Bootloader, configs.Configs.PartitionType, recoveryos)
+		}},
+		{Name: STEP_MOUNT, Always: true, Run: func() error {
+			if err := mountPartitions(parts, recoveryos); err != nil {
+				return err
+			}
+			if arm {
+				// the sysboot is created again by the partition step
+				armRecoveryBoot(parts, recoveryos)
+			}
+			return nil
+		}},
+		{Name: STEP_SNAPS, Skip: notOS(rplib.RECOVERY_OS_UBUNTU_CORE), Run: func() error {
+			log.Println("[Add additional snaps/asserts]")
+			return copySnapsAsserts()
+		}},
+		{Name: STEP_FSTAB, Skip: notOS(rplib.RECOVERY_OS_UBUNTU_CLASSIC), Run: func() error {
+			log.Println("[Update fstab]")
+			return updateFstab(parts, recoveryos)
+		}},
+		{Name: STEP_RESTORE_ASSERTIONS, Skip: func() bool {
+			return notRestore() || recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC_CURTIN
+		}, Run: func() error {
+			// restore assertion if ever signed
+			log.Println("[User restores system]")
+			return restoreAsserions()
+		}},
+		// the grub menuentry is appended, so it could not run twice
+		{Name: STEP_BOOTLOADER, ResumeFrom: STEP_PARTITION, Run: func() error {
+			if err := installBootloader(parts, recoveryos); err != nil {
+				return err
+			}
+			if arm {
+				// the bootloader env is set for the restored system
+				armRecoveryBoot(parts, recoveryos)
+			}
+			return nil
+		}},
+		{Name: STEP_IN_TARGET_HOOKS, Run: func() error {
+			log.Println("[Run in-target hooks]")
+			return runInTargetHooks(recoveryos)
+		}},
+	}
+}
+
+// checkpointRestoreState stores the state on recovery partition
+func checkpointRestoreState(state *rplib.RestoreState) error {
+	return rplib.WithWritable(RECO_ROOT_DIR, func() error {
+		if err := os.MkdirAll(filepath.Dir(RESTORE_STATE), 0755); err != nil {
+			return err
+		}
+		return state.Write(RESTORE_STATE)
+	})
+}
+
+// resumeRestore returns the step to resume the interrupted recovery from, or
+// "" to start over. The recovery type of the interrupted one is kept.
+func resumeRestore(steps []rplib.Step, recoveryos string) string {
+	restoreState = &rplib.RestoreState{RecoveryType: RecoveryType, RecoveryOS: recoveryos, Started: time.Now()}
+	state, err := rplib.ReadRestoreState(RESTORE_STATE)
+	if os.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		log.Println(err)
+		return ""
+	}
+
+	from := rplib.ResumeStep(steps, state)
+	switch {
+	case from == "":
+		log.Println("The previous recovery was interrupted before the system was changed, start over")
+		return ""
+	case state.RecoveryOS != recoveryos:
+		log.Printf("The previous recovery of %s was interrupted, start over for %s", state.RecoveryOS, recoveryos)
+		return ""
+	case state.Attempts >= RESTORE_RESUME_ATTEMPTS:
+		log.Printf("The recovery was resumed %d times, start over", state.Attempts)
+		return ""
+	}
+
+	log.Printf("Resume the interrupted %s from step %s, started at %v", state.RecoveryType, from, state.Started)
+	state.Attempts++
+	restoreState = state
+	RecoveryType = state.RecoveryType
+	return from
+}
+
+// setBootNextRecovery boots the recovery next time once, in case the power
+// is lost before the system is restored
+func setBootNextRecovery() {
+	if configs.Configs.Arch != "amd64" {
+		return
+	}
+	entries := rplib.GetBootEntries(rplib.BOOT_ENTRY_RECOVERY)
+	if len(entries) == 0 {
+		log.Println("No recovery boot entry to boot next")
+		return
+	}
+	if out, err := exec.Command(EFIBOOTMGR, "-n", entries[0]).CombinedOutput(); err != nil {
+		log.Printf("Set BootNext to recovery failed: %v: %s", err, out)
+	}
+}
+
+// recoveryGrubEnv returns the grubenv of recovery partition, the recovery
+// type in it is run when the recovery partition boots
+func recoveryGrubEnv(recoveryos string) string {
+	if recoveryos == rplib.RECOVERY_OS_UBUNTU_CLASSIC_CURTIN {
+		return RECO_ROOT_DIR + "boot/grub/grubenv"
+	}
+	return RECO_PART_GRUB_ENV
+}
+
+// withSysboot runs fn with the sysboot partition mounted on SYSBOOT_MNT_DIR,
+// it is mounted for fn only if not mounted yet
+func withSysboot(parts *Partitions, fn func() error) error {
+	for _, m := range mounts.Mounted() {
+		if m.Target == filepath.Clean(SYSBOOT_MNT_DIR) {
+			return fn()
+		}
+	}
+	return mounts.Scope(func() error {
+		if err := os.MkdirAll(SYSBOOT_MNT_DIR, 0755); err != nil {
+			return err
+		}
+		if err := mounts.Mount(fmtPartPath(parts.TargetDevPath, parts.Sysboot_nr), SYSBOOT_MNT_DIR, "vfat", 0, ""); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// setRecoveryBootEnv sets the recovery type of this recovery in the uboot
+// env or the grubenv of recovery partition if arm, otherwise factory_restore
+// as after the recovery is done. The headless installer is not changed.
+var setRecoveryBootEnv = func(parts *Partitions, recoveryos string, arm bool) error {
+	if RecoveryType == rplib.HEADLESS_INSTALLER {
+		return nil
+	}
+	recoveryType := rplib.FACTORY_RESTORE
+	if arm {
+		recoveryType = RecoveryType
+	}
+
+	if configs.Configs.Bootloader == "u-boot" {
+		return withSysboot(parts, func() error {
+			env, err := uenv.Open(SYSBOOT_UBOOT_ENV)
+			if err != nil {
+				return err
+			}
+			snapMode := ""
+			if arm {
+				snapMode = "recovery"
+			}
+			env.Set("snap_mode", snapMode)
+			env.Set("recovery_type", recoveryType)
+			return env.Save()
+		})
+	} else if configs.Configs.Bootloader != "grub" && recoveryos != rplib.RECOVERY_OS_UBUNTU_CLASSIC_CURTIN {
+		return nil
+	}
+
+	return rplib.WithWritable(RECO_ROOT_DIR, func() error {
+		out, err := exec.Command("grub-editenv", recoveryGrubEnv(recoveryos), "set", "recovery_type="+recoveryType).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("grub-editenv: %v: %s", err, out)
+		}
+		return nil
+	})
+}
+
+// armRecoveryBoot boots the recovery next time, in case the power is lost
+// before the system is restored: by BootNext on amd64, and by the recovery
+// type in the bootloader env on all devices
+func armRecoveryBoot(parts *Partitions, recoveryos string) {
+	setBootNextRecovery()
+	if err := setRecoveryBootEnv(parts, recoveryos, true); err != nil {
+		log.Println("Set the recovery type to boot failed:", err)
+	}
+}
+
+// stepList is the step names of a flag, repeated or comma separated
+type stepList []string
+
+func (l *stepList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stepList) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*l = append(*l, name)
+		}
+	}
+	return nil
+}
+
+// stepOptions selects the steps to run by the run command, for debugging
+type stepOptions struct {
+	from string
+	only stepList
+	skip stepList
+}
+
+func (o stepOptions) selected() bool {
+	return o.from != "" || len(o.only) > 0 || len(o.skip) > 0
+}
+
+func (o stepOptions) String() string {
+	var opts []string
+	if o.from != "" {
+		opts = append(opts, "--from-step="+o.from)
+	}
+	if len(o.only) > 0 {
+		opts = append(opts, "--only-step="+o.only.String())
+	}
+	if len(o.skip) > 0 {
+		opts = append(opts, "--skip-step="+o.skip.String())
+	}
+	return strings.Join(opts, " ")
+}
+
+// parseRunArgs parses the arguments of run command, and returns the step
+// options and the recovery arguments
+func parseRunArgs(args []string, out io.Writer) (stepOptions, []string, error) {
+	var opts stepOptions
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.StringVar(&opts.from, "from-step", "", "Run from the step, with the steps needed before it, e.g. mount")
+	fs.Var(&opts.only, "only-step", "Run the steps only, repeated or comma separated")
+	fs.Var(&opts.skip, "skip-step", "Do not run the steps, repeated or comma separated")
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: recovery.bin run [options] RECOVERY_TYPE RECOVERY_LABEL RECOVERY_OS")
+		fs.PrintDefaults()
+		fmt.Fprintln(out, "Steps:", strings.Join(stepNames, " "))
+	}
+	if err := fs.Parse(args); err != nil {
+		return opts, nil, err
+	}
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return opts, nil, fmt.Errorf("need three arguments, current arguments: %v", fs.Args())
+	}
+	return opts, fs.Args(), nil
+}
+
+// runRestoreSteps runs the steps of recovery, or resumes the interrupted one.
+// The steps selected by opts run without resuming, and the state of the
+// interrupted recovery is kept until the recovery is done.
+func runRestoreSteps(parts *Partitions, recoveryos string, opts stepOptions) {
+	// the selected steps don't arm the recovery boot, which is cleared only
+	// when the whole recovery is done
+	steps := restoreSteps(parts, recoveryos, !opts.selected())
+	runner := rplib.StepRunner{
+		Steps:    steps,
+		OnStep:   reportStep,
+		Only:     opts.only,
+		Excluded: opts.skip,
+	}
+	var from string
+	if opts.selected() {
+		log.Println("Run the steps selected:", opts)
+		restoreState = &rplib.RestoreState{RecoveryType: RecoveryType, RecoveryOS: recoveryos, Started: time.Now()}
+		from = opts.from
+	} else {
+		runner.Checkpoint = checkpointRestoreState
+		from = resumeRestore(steps, recoveryos)
+	}
+	runner.State = restoreState
+	err := runner.Run(from)
+	rplib.Checkerr(err)
+}
+
+// finishRestoreState removes the state after the recovery is done, and
+// disarms the recovery boot
+func finishRestoreState(parts *Partitions, recoveryos string) {
+	if configs.Configs.Arch == "amd64" {
+		// fails if BootNext is not set
+		exec.Command(EFIBOOTMGR, "-N").Run()
+	}
+	if err := setRecoveryBootEnv(parts, recoveryos, false); err != nil {
+		log.Println("Reset the recovery type to boot failed:", err)
+	}
+	err := rplib.WithWritable(RECO_ROOT_DIR, func() error {
+		if err := os.Remove(RESTORE_STATE); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Remove the restore state failed:", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+const (
+	// The image information of recovery partition, the same as installer ISO
+	IMAGE_INFO = RECO_ROOT_DIR + ".disk/info"
+	// The measured durations of previous restores
+	RESTORE_DURATIONS = RECO_ROOT_DIR + "recovery/restore-durations"
+	SUMMARY_MNT_DIR   = "/tmp/summaryMnt/"
+)
+
+// formatSize formats bytes in the binary units
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// restorePayloads returns the payloads restored to the target
+func restorePayloads() []string {
+	payloads := []string{SYSBOOT_TARBALL, WRITABLE_TARBALL, ROOTFS_SQUASHFS}
+	if entries, err := ioutil.ReadDir(OVERLAYS_DIR); err == nil {
+		for _, e := range entries {
+			payloads = append(payloads, OVERLAYS_DIR+e.Name())
+		}
+	}
+	return payloads
+}
+
+// restorePayloadBytes returns the total size of the existing payloads
+func restorePayloadBytes() int64 {
+	var total int64
+	for _, p := range restorePayloads() {
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// imageVersion returns the factory image version and date
+func imageVersion() (version string, date string) {
+	version = "unknown"
+	if data, err := ioutil.ReadFile(IMAGE_INFO); err == nil {
+		if line := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0]); line != "" {
+			version = line
+		}
+	}
+	date = "unknown"
+	for _, p := range []string{WRITABLE_TARBALL, ROOTFS_SQUASHFS} {
+		if info, err := os.Stat(p); err == nil {
+			date = info.ModTime().UTC().Format("2006-01-02")
+			break
+		}
+	}
+	return version, date
+}
+
+// usedBytes mounts the partition read-only to measure the used space, it
+// returns false if not mountable
+var usedBytes = func(device string) (int64, bool) {
+	if err := mountReadOnly(device, SUMMARY_MNT_DIR); err != nil {
+		log.Println(err)
+		return 0, false
+	}
+	defer mounts.Unmount(SUMMARY_MNT_DIR)
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(SUMMARY_MNT_DIR, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Blocks-st.Bfree) * int64(st.Bsize), true
+}
+
+// restoreSummary returns the lines to show before confirmation: the target
+// disk, the partitions to be erased, the factory image and the estimated time
+func restoreSummary(parts *Partitions) []string {
+	disk := rplib.ReadDiskInfo(parts.TargetDevNode)
+	lines := []string{msg(rplib.MSG_SUMMARY_DISK, "model", disk.Model, "device", parts.TargetDevPath, "size", formatSize(disk.SizeBytes))}
+
+	for _, p := range disk.Partitions {
+		// the recovery partition is kept
+		if parts.SourceDevPath == parts.TargetDevPath && p.Number == parts.Recovery_nr {
+			continue
+		}
+		device := fmtPartPath(parts.TargetDevPath, p.Number)
+		label := blkidValue("LABEL", device)
+		number, size := fmt.Sprint(p.Number), formatSize(p.SizeBytes)
+		if used, ok := usedBytes(device); ok {
+			lines = append(lines, msg(rplib.MSG_SUMMARY_ERASE_USED, "number", number, "label", label, "size", size, "used", formatSize(used)))
+		} else {
+			lines = append(lines, msg(rplib.MSG_SUMMARY_ERASE, "number", number, "label", label, "size", size))
+		}
+	}
+
+	version, date := imageVersion()
+	lines = append(lines, msg(rplib.MSG_SUMMARY_IMAGE, "version", version, "date", date))
+
+	estimate := rplib.EstimateRestoreDuration(rplib.ReadRestoreDurations(RESTORE_DURATIONS), restorePayloadBytes())
+	minutes := int(estimate.Minutes() + 0.5)
+	if minutes < 1 {
+		minutes = 1
+	}
+	lines = append(lines, msg(rplib.MSG_SUMMARY_ESTIMATE, "minutes", fmt.Sprint(minutes)))
+	return lines
+}
+
+// The start time of restore, after the user confirmed
+var restoreStart time.Time
+
+// recordRestoreDuration stores the duration of this restore on recovery
+// partition for the estimation of next restores
+func recordRestoreDuration() {
+	if restoreStart.IsZero() {
+		return
+	}
+	d := rplib.RestoreDuration{Time: time.Now(), PayloadBytes: restorePayloadBytes(), Duration: time.Since(restoreStart)}
+	log.Printf("Restored %s in %v", formatSize(d.PayloadBytes), d.Duration)
+
+	err := rplib.WithWritable(RECO_ROOT_DIR, func() error {
+		if err := os.MkdirAll(filepath.Dir(RESTORE_DURATIONS), 0755); err != nil {
+			return err
+		}
+		return rplib.AppendRestoreDuration(RESTORE_DURATIONS, d)
+	})
+	if err != nil {
+		log.Println("Store the restore duration failed:", err)
+	}
+}
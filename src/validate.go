@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+)
+
+// easier for function mocking
+var blockSize = rplib.BlockSize
+
+// validateConfig implements `recovery.bin validate [-disk-size MB | -disk DEVICE] [-cmdline CMDLINE] <config.yaml>`.
+// It prints all the errors and warnings, and returns the exit code:
+// 0 valid, 1 errors found, 2 usage or read error. The config overrides in
+// CMDLINE and the RECOVERY_CFG_* environment variables are checked too.
+func validateConfig(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	diskSizeMB := fs.Int("disk-size", 0, "The target disk size in MB to check the partition sizes")
+	disk := fs.String("disk", "", "The target disk device to check the partition sizes")
+	cmdline := fs.String("cmdline", "", "The kernel command line to check the recovery.cfg.* overrides")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(out, "Usage: recovery.bin validate [-disk-size MB | -disk DEVICE] [-cmdline CMDLINE] <config.yaml>")
+		return 2
+	}
+	configPath := fs.Arg(0)
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+
+	if *disk != "" {
+		*diskSizeMB = int(blockSize(*disk) / (1024 * 1024))
+	}
+
+	problems := rplib.ValidateConfig(data, *diskSizeMB)
+	problems = append(problems, rplib.ValidateOverrides(data, *cmdline, os.Environ())...)
+	rplib.SortConfigProblems(problems)
+	nerr := 0
+	for _, p := range problems {
+		if !p.Warning {
+			nerr++
+		}
+		level := "error"
+		if p.Warning {
+			level = "warning"
+		}
+		// the compiler style location, easier for editors and CI to parse
+		if p.Line == 0 {
+			fmt.Fprintf(out, "%s: %s: %s\n", configPath, level, p.Message)
+		} else {
+			fmt.Fprintf(out, "%s:%d: %s: %s\n", configPath, p.Line, level, p.Message)
+		}
+	}
+	fmt.Fprintf(out, "%s: %d error(s), %d warning(s)\n", configPath, nerr, len(problems)-nerr)
+
+	if nerr > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,127 +1,373 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	rplib "github.com/Lyoncore/ubuntu-recovery-rplib"
-
-	yaml "gopkg.in/yaml.v2"
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
 )
 
-type GadgetInfo struct {
-	Volumes map[string]GadgetVolume `yaml:"volumes,omitempty"`
+// The make_bootfs populates the content of gadget.yaml structures, and writes
+// a tarball with a manifest for each structure with content:
+//   <output_dir>/<volume>-<index>.tar
+//   <output_dir>/<volume>-<index>.manifest
+// The index is of the structure in the volume. The structures with filesystem
+// get their content at the target path, and the raw structures get their
+// images at the image path.
+// The first line of manifest tells the structure name, label, role and
+// filesystem.
+// The tarballs are deterministic, all entries are sorted and owned by root
+// with the mtime from SOURCE_DATE_EPOCH (or 0).
+
+// entry is a file, directory or symlink to be written in tarball
+type entry struct {
+	mode     os.FileMode
+	source   string // file on disk, empty if data is set
+	data     []byte // file content which is unpacked
+	linkname string
+}
+
+type bootfs struct {
+	entries map[string]*entry
+}
+
+func newBootfs() *bootfs {
+	return &bootfs{entries: make(map[string]*entry)}
+}
+
+func (fs *bootfs) addDir(name string) {
+	name = path.Clean(name)
+	for name != "." && name != "/" {
+		if _, ok := fs.entries[name]; !ok {
+			fs.entries[name] = &entry{mode: os.ModeDir | 0755}
+		}
+		name = path.Dir(name)
+	}
+}
+
+func (fs *bootfs) add(name string, e *entry) {
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	fs.addDir(path.Dir(name))
+	fs.entries[name] = e
+}
+
+// addPath adds the file or the directory tree of src at dst
+func (fs *bootfs) addPath(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(dst, filepath.ToSlash(rel))
+
+		switch {
+		case info.IsDir():
+			fs.addDir(strings.TrimPrefix(name, "/"))
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fs.add(name, &entry{mode: os.ModeSymlink | 0777, linkname: link})
+		default:
+			fs.add(name, &entry{mode: info.Mode().Perm(), source: p})
+		}
+		return nil
+	})
+}
+
+// unpack adds the entries of tar or tar.gz archive src under dst
+func (fs *bootfs) unpack(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot unpack %s: %v", src, err)
+		}
+
+		name := path.Join(dst, path.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			fs.addDir(strings.TrimPrefix(name, "/"))
+		case tar.TypeSymlink:
+			fs.add(name, &entry{mode: os.ModeSymlink | 0777, linkname: hdr.Linkname})
+		case tar.TypeReg, tar.TypeRegA:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			fs.add(name, &entry{mode: os.FileMode(hdr.Mode).Perm(), data: data})
+		default:
+			return fmt.Errorf("cannot unpack %s: unsupported entry %q", src, hdr.Name)
+		}
+	}
+}
+
+// resolveCase follows the case of existing top directory, e.g. efi/EFI. The
+// exact case is preferred, then the first one in sorted order.
+func (fs *bootfs) resolveCase(name string) string {
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	elems := strings.SplitN(name, "/", 2)
+	if len(elems) < 2 {
+		return name
+	}
+	if e, ok := fs.entries[elems[0]]; ok && e.mode.IsDir() {
+		return name
+	}
+	for _, existing := range fs.sortedNames() {
+		e := fs.entries[existing]
+		if e.mode.IsDir() && !strings.Contains(existing, "/") && strings.EqualFold(existing, elems[0]) {
+			return existing + "/" + elems[1]
+		}
+	}
+	return name
+}
+
+func (fs *bootfs) populate(st *rplib.VolumeStructure, gadgetDir string) error {
+	for _, c := range st.Content {
+		if c.Image != "" {
+			src := filepath.Join(gadgetDir, c.Image)
+			if c.Unpack {
+				if err := fs.unpack(src, "/"); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fs.addPath(src, c.Image); err != nil {
+				return err
+			}
+			continue
+		}
+
+		src := filepath.Join(gadgetDir, c.Source)
+		if c.Unpack {
+			if err := fs.unpack(src, c.Target); err != nil {
+				return err
+			}
+			continue
+		}
+		srcStat, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		dst := c.Target
+		// As cp, the source file (or directory without trailing slash) is
+		// copied into the target directory
+		if strings.HasSuffix(c.Target, "/") && (!srcStat.IsDir() || !strings.HasSuffix(c.Source, "/")) {
+			dst = path.Join(c.Target, filepath.Base(src))
+		}
+		if err := fs.addPath(src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Default configuration for snaps (snap-id => key => value).
-	Defaults map[string]map[string]interface{} `yaml:"defaults,omitempty"`
+func (fs *bootfs) sortedNames() []string {
+	names := make([]string, 0, len(fs.entries))
+	for name := range fs.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-type GadgetVolume struct {
-	Schema     string            `yaml:"schema"`
-	Bootloader string            `yaml:"bootloader"`
-	ID         string            `yaml:"id"`
-	Structure  []VolumeStructure `yaml:"structure"`
+func (fs *bootfs) content(e *entry) ([]byte, error) {
+	if e.source != "" {
+		return ioutil.ReadFile(e.source)
+	}
+	return e.data, nil
 }
 
-// TODO Offsets and sizes are strings to support unit suffixes.
-// Is that a good idea? *2^N or *10^N? We'll probably want a richer
-// type when we actually handle these.
-
-type VolumeStructure struct {
-	Label       string          `yaml:"filesystem-label"`
-	Offset      string          `yaml:"offset"`
-	OffsetWrite string          `yaml:"offset-write"`
-	Size        string          `yaml:"size"`
-	Type        string          `yaml:"type"`
-	ID          string          `yaml:"id"`
-	Filesystem  string          `yaml:"filesystem"`
-	Content     []VolumeContent `yaml:"content"`
+func (fs *bootfs) writeTar(st *rplib.VolumeStructure, tarPath string, manifestPath string, mtime time.Time) error {
+	f, err := os.Create(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var manifest bytes.Buffer
+	filesystem := st.Filesystem
+	if filesystem == "" {
+		filesystem = "none"
+	}
+	fmt.Fprintf(&manifest, "# name: %s label: %s role: %s filesystem: %s\n", st.Name, st.Label, st.EffectiveRole(), filesystem)
+
+	tw := tar.NewWriter(f)
+	for _, name := range fs.sortedNames() {
+		e := fs.entries[name]
+		hdr := &tar.Header{
+			Name:    "./" + name,
+			Mode:    int64(e.mode.Perm()),
+			ModTime: mtime,
+			Uname:   "root",
+			Gname:   "root",
+		}
+
+		var data []byte
+		switch {
+		case e.mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			fmt.Fprintf(&manifest, "%s %04o dir\n", hdr.Name, hdr.Mode)
+		case e.mode&os.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.linkname
+			fmt.Fprintf(&manifest, "%s %04o link %s\n", hdr.Name, hdr.Mode, e.linkname)
+		default:
+			if data, err = fs.content(e); err != nil {
+				return err
+			}
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(data))
+			fmt.Fprintf(&manifest, "%s %04o %d %x\n", hdr.Name, hdr.Mode, hdr.Size, sha256.Sum256(data))
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(manifestPath, manifest.Bytes(), 0644)
 }
 
-type VolumeContent struct {
-	Source string `yaml:"source"`
-	Target string `yaml:"target"`
+// stringList is a repeatable flag
+type stringList []string
 
-	Image       string `yaml:"image"`
-	Offset      string `yaml:"offset"`
-	OffsetWrite string `yaml:"offset-write"`
-	Size        string `yaml:"size"`
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
 
-	Unpack bool `yaml:"unpack"`
+// outputName returns the file name of the structure at index of volume, the
+// names and labels could be empty or the same in volumes
+func outputName(volume string, index int) string {
+	return fmt.Sprintf("%s-%d", strings.Replace(volume, " ", "-", -1), index)
+}
+
+func sourceDateEpoch() time.Time {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC()
+	}
+	return time.Unix(0, 0).UTC()
 }
 
 func main() {
+	var excludes, extras stringList
 	gadget_yaml_path := flag.String("gadget_yaml_path", "./gadget.yaml", "The gadget yaml path")
 	gadget_unpack_path := flag.String("gadget_unpack_path", "", "The gadget unpack path")
-	tmp_bootfs_path := flag.String("tmp_bootfs_path", "", "The bootfs tmp directory path")
+	output_dir := flag.String("output_dir", "", "The directory to write the structure tarballs")
+	flag.Var(&excludes, "exclude", "The structure name or label to skip, can be repeated")
+	flag.Var(&extras, "extra", "Add a file to structure tarball, <structure>:<target>=<source>, can be repeated")
 	flag.Parse()
-	var gi GadgetInfo
 
 	if *gadget_unpack_path == "" {
 		fmt.Fprintf(os.Stderr, "Error! Need gadget unpack path\n")
 		os.Exit(1)
 	}
 
-	if *tmp_bootfs_path == "" {
-		fmt.Fprintf(os.Stderr, "Error! Need tmp bootfs path\n")
+	if *output_dir == "" {
+		fmt.Fprintf(os.Stderr, "Error! Need output directory\n")
 		os.Exit(1)
 	}
 
-	gmeta, err := ioutil.ReadFile(*gadget_yaml_path)
-	if os.IsNotExist(err) {
-		fmt.Fprintf(os.Stderr, "gadget.yaml not found:%s\n", *gadget_yaml_path)
+	var gi rplib.GadgetInfo
+	if err := gi.Load(*gadget_yaml_path); err != nil {
+		fmt.Fprintf(os.Stderr, "Load gadget.yaml failed:%v\n", err)
 		os.Exit(1)
 	}
 
-	if err := yaml.Unmarshal(gmeta, &gi); err != nil {
-		os.Exit(1)
+	if err := os.MkdirAll(*output_dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	skip := make(map[string]bool)
+	for _, e := range excludes {
+		skip[e] = true
 	}
 
-	// find system-boot and make copy
-	for _, v := range gi.Volumes {
-		for _, st := range v.Structure {
-			if st.Label == "system-boot" {
-				for _, content := range st.Content {
-					src := path.Join(*gadget_unpack_path, content.Source)
-					dst := path.Join(*tmp_bootfs_path, content.Target)
-
-					srcStat, err := os.Stat(src)
-					if err != nil {
-						log.Fatal(err)
-						os.Exit(1)
-					}
-
-					if strings.Contains(dst, "/") == true {
-						dstdir := path.Dir(dst)
-						dstdirStat, err := os.Stat(dstdir)
-						if err != nil {
-							if err := os.MkdirAll(dstdir, 0777); err != nil {
-								log.Fatal(err)
-								os.Exit(1)
-							}
-						} else if dstdirStat.IsDir() == false {
-							fmt.Fprintf(os.Stderr, "The target in bootfs should be a directory but not:%s\n", dstdir)
-						}
-					}
-
-					if srcStat.IsDir() == true {
-						if err := rplib.CopyTree(src, dst); err != nil {
-							log.Fatal(err)
-							os.Exit(1)
-						}
-					} else {
-						if err := rplib.FileCopy(src, dst); err != nil {
-							log.Fatal(err)
-							os.Exit(1)
-						}
-					}
+	// sort volumes for the deterministic output
+	var volumes []string
+	for name := range gi.Volumes {
+		volumes = append(volumes, name)
+	}
+	sort.Strings(volumes)
+
+	mtime := sourceDateEpoch()
+	for _, v := range volumes {
+		for i, st := range gi.Volumes[v].Structure {
+			if (st.Name != "" && skip[st.Name]) || (st.Label != "" && skip[st.Label]) || len(st.Content) == 0 {
+				continue
+			}
+
+			name := outputName(v, i)
+			fs := newBootfs()
+			if err := fs.populate(&st, *gadget_unpack_path); err != nil {
+				log.Fatalf("Populate structure #%d (%q) of volume %s failed: %v", i, st.Name, v, err)
+			}
+
+			for _, extra := range extras {
+				target := strings.SplitN(extra, ":", 2)
+				if len(target) != 2 || (target[0] != st.Name && target[0] != st.Label) {
+					continue
+				}
+				src := strings.SplitN(target[1], "=", 2)
+				if len(src) != 2 {
+					log.Fatalf("Invalid extra %q, should be <structure>:<target>=<source>", extra)
+				}
+				if err := fs.addPath(src[1], fs.resolveCase(src[0])); err != nil {
+					log.Fatal(err)
 				}
 			}
+
+			tarPath := filepath.Join(*output_dir, name+".tar")
+			manifestPath := filepath.Join(*output_dir, name+".manifest")
+			if err := fs.writeTar(&st, tarPath, manifestPath, mtime); err != nil {
+				log.Fatalf("Write %s failed: %v", tarPath, err)
+			}
+			fmt.Println(tarPath)
 		}
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-custom-recovery/src/rplib"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type BootfsSuite struct{}
+
+var _ = Suite(&BootfsSuite{})
+
+func (s *BootfsSuite) TestResolveCase(c *C) {
+	for _, t := range []struct {
+		dirs []string
+		in   string
+		out  string
+	}{
+		{nil, "EFI/boot/grubx64.efi", "EFI/boot/grubx64.efi"},
+		{[]string{"efi"}, "EFI/boot/grubx64.efi", "efi/boot/grubx64.efi"},
+		{[]string{"EFI"}, "/efi/boot/grubx64.efi", "EFI/boot/grubx64.efi"},
+		// the exact case is preferred
+		{[]string{"EFI", "efi"}, "efi/boot/grubx64.efi", "efi/boot/grubx64.efi"},
+		{[]string{"efi", "EFI"}, "EFI/boot/grubx64.efi", "EFI/boot/grubx64.efi"},
+		// then the first one sorted
+		{[]string{"efi", "EFI"}, "Efi/boot/grubx64.efi", "EFI/boot/grubx64.efi"},
+		// the top file is not followed
+		{nil, "uboot.env", "uboot.env"},
+	} {
+		fs := newBootfs()
+		for _, d := range t.dirs {
+			fs.addDir(d)
+		}
+		c.Check(fs.resolveCase(t.in), Equals, t.out, Commentf("dirs %v", t.dirs))
+	}
+}
+
+func (s *BootfsSuite) TestOutputName(c *C) {
+	c.Check(outputName("pc", 0), Equals, "pc-0")
+	c.Check(outputName("my volume", 3), Equals, "my-volume-3")
+}
+
+func (s *BootfsSuite) TestWriteTar(c *C) {
+	src := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(src, "EFI/ubuntu"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "EFI/ubuntu/grub.cfg"), []byte("set timeout=3\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "config.txt"), []byte("arm_64bit=1\n"), 0644), IsNil)
+	c.Assert(os.Symlink("ubuntu", filepath.Join(src, "EFI/boot")), IsNil)
+
+	fs := newBootfs()
+	c.Assert(fs.addPath(src, "/"), IsNil)
+
+	out := c.MkDir()
+	tarPath, manifestPath := filepath.Join(out, "system-boot.tar"), filepath.Join(out, "system-boot.manifest")
+	st := &rplib.VolumeStructure{Name: "system-boot", Label: "system-boot", Filesystem: "vfat"}
+	mtime := time.Unix(1500000000, 0).UTC()
+	c.Assert(fs.writeTar(st, tarPath, manifestPath, mtime), IsNil)
+
+	f, err := os.Open(tarPath)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, hdr.Name)
+		c.Check(hdr.ModTime.Equal(mtime), Equals, true, Commentf("%s mtime %v", hdr.Name, hdr.ModTime))
+		c.Check(hdr.Uname, Equals, "root")
+		c.Check(hdr.Uid, Equals, 0)
+	}
+	c.Check(names, DeepEquals, []string{"./EFI/", "./EFI/boot", "./EFI/ubuntu/", "./EFI/ubuntu/grub.cfg", "./config.txt"})
+
+	manifest, err := ioutil.ReadFile(manifestPath)
+	c.Assert(err, IsNil)
+	c.Check(string(manifest), Equals, `# name: system-boot label: system-boot role: system-boot filesystem: vfat
+./EFI/ 0755 dir
+./EFI/boot 0777 link ubuntu
+./EFI/ubuntu/ 0755 dir
+./EFI/ubuntu/grub.cfg 0644 14 b956740a4e7d4fca95c72db14d1fefd5c6085ef4aae885e3919f6cb001d6b11a
+./config.txt 0644 12 25533c29b143d3c05173bf526719e8eaec169741370ab47087ab99cc38b9a08f
+`)
+}
+
+func (s *BootfsSuite) TestWriteTarRawManifest(c *C) {
+	fs := newBootfs()
+	fs.add("pc-boot.img", &entry{mode: 0644, data: []byte("boot")})
+
+	out := c.MkDir()
+	st := &rplib.VolumeStructure{Name: "mbr"}
+	manifestPath := filepath.Join(out, "mbr.manifest")
+	c.Assert(fs.writeTar(st, filepath.Join(out, "mbr.tar"), manifestPath, time.Unix(0, 0)), IsNil)
+
+	manifest, err := ioutil.ReadFile(manifestPath)
+	c.Assert(err, IsNil)
+	c.Check(string(manifest), Matches, "# name: mbr label:  role:  filesystem: none\n./pc-boot.img 0644 4 [0-9a-f]{64}\n")
+}